@@ -0,0 +1,3 @@
+module github.com/saivarma10/k3s-netmon-debug
+
+go 1.19
@@ -1,442 +1,6047 @@
-package main
-
-import (
-	"bufio"
-	"encoding/json"
-	"flag"
-	"fmt"
-	"io"
-	"io/ioutil"
-	"os"
-	"os/exec"
-	"regexp"
-	"strings"
-	"time"
-)
-
-const (
-	k3sConfigFile = "/etc/systemd/system/k3s.service"
-	nodePortRange = "1000-32000"
-	tcpdumpFilter = "udp port 4729 or udp port 9996 or udp port 6343 or udp port 4739"
-	captureFile   = "capture.pcap"
-)
-const scriptContent = `#!/bin/bash
-
-K3S_CONFIG_FILE="/etc/systemd/system/k3s.service"
-NODEPORT_RANGE="1000-32000"
-
-update_nodeport_range() {
-  echo "Updating K3s NodePort range to ${NODEPORT_RANGE}..."
-  cp "${K3S_CONFIG_FILE}" "${K3S_CONFIG_FILE}.bak"
-  if [ $? -ne 0 ]; then
-    echo "Failed to back up the K3s service file. Exiting."
-    exit 1
-  fi
-  sed -i "s|^ExecStart=.*|ExecStart=/usr/local/bin/k3s server --service-node-port-range=${NODEPORT_RANGE}|" "${K3S_CONFIG_FILE}"
-  if [ $? -ne 0 ]; then
-    echo "Failed to update the K3s service file. Exiting."
-    exit 1
-  fi
-}
-
-restart_k3s() {
-  echo "Restarting K3s service to apply changes..."
-  systemctl daemon-reload
-  systemctl restart k3s
-
-  if [ $? -ne 0 ]; then
-    echo "Failed to restart K3s service. Exiting."
-    exit 1
-  fi
-
-  echo "K3s service restarted successfully."
-}
-
-update_nodeport_range
-restart_k3s
-
-echo "NodePort range updated to ${NODEPORT_RANGE} and K3s restarted successfully."
-`
-
-// Configuration struct to hold all configurable parameters
-type Config struct {
-	PodName            string
-	ContainerName      string
-	ServiceName        string
-	DependentPods      []string
-	K3sConfigFile      string
-	NodePortRange      string
-	TcpdumpFilter      string
-	CaptureFile        string
-	LogFile            string
-	VerboseConfigPath  string
-	VerboseConfigValue string
-}
-
-// ANSI color codes
-const (
-	colorReset  = "\033[0m"
-	colorRed    = "\033[31m"
-	colorGreen  = "\033[32m"
-	colorYellow = "\033[33m"
-	colorCyan   = "\033[36m"
-)
-
-type Pod struct {
-	Metadata struct {
-		Name string `json:"name"`
-	} `json:"metadata"`
-	Status struct {
-		Phase string `json:"phase"`
-	} `json:"status"`
-}
-
-type Service struct {
-	Metadata struct {
-		Name string `json:"name"`
-	} `json:"metadata"`
-}
-
-var config Config
-
-func init() {
-	// Define command line flags
-	flag.StringVar(&config.PodName, "pod", "", "Name of the main pod to monitor")
-	flag.StringVar(&config.ContainerName, "container", "", "Name of the container within the pod")
-	flag.StringVar(&config.ServiceName, "service", "", "Name of the service to monitor")
-	dependentPodsStr := flag.String("dependent-pods", "", "Comma-separated list of dependent pods")
-	flag.StringVar(&config.K3sConfigFile, "k3s-config", "/etc/systemd/system/k3s.service", "Path to K3s config file")
-	flag.StringVar(&config.NodePortRange, "nodeport-range", "1000-32000", "NodePort range")
-	flag.StringVar(&config.TcpdumpFilter, "tcpdump-filter", "udp", "tcpdump filter string")
-	flag.StringVar(&config.CaptureFile, "capture-file", "packets.pcap", "Packet capture file name")
-	flag.StringVar(&config.LogFile, "log-file", "debug.log", "Log file name")
-	flag.StringVar(&config.VerboseConfigPath, "verbose-config-path", "/etc/config/config.conf", "Path to verbose config file")
-	flag.StringVar(&config.VerboseConfigValue, "verbose-config-value", "verbose: enabled", "Value to add to verbose config")
-
-	// Parse flags
-	flag.Parse()
-
-	// Process dependent pods
-	if *dependentPodsStr != "" {
-		config.DependentPods = strings.Split(*dependentPodsStr, ",")
-	}
-
-	// Validate required flags
-	if config.PodName == "" || config.ContainerName == "" || config.ServiceName == "" {
-		fmt.Println("Error: Required flags -pod, -container, and -service must be provided")
-		fmt.Println("\nUsage:")
-		flag.PrintDefaults()
-		os.Exit(1)
-	}
-}
-
-func printProgress(current, total int, prefix string) {
-	width := 40
-	percentage := float64(current) * 100 / float64(total)
-	completed := int(float64(width) * float64(current) / float64(total))
-	remaining := width - completed
-
-	fmt.Printf("\r%s [%s%s] %.1f%% ", prefix,
-		strings.Repeat("=", completed),
-		strings.Repeat(" ", remaining),
-		percentage)
-
-	if current == total {
-		fmt.Println()
-	}
-}
-
-func printSpinner(duration time.Duration, message string) {
-	spinChars := []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
-	startTime := time.Now()
-
-	for time.Since(startTime) < duration {
-		for _, char := range spinChars {
-			fmt.Printf("\r%s %s", char, message)
-			time.Sleep(100 * time.Millisecond)
-		}
-	}
-	fmt.Println()
-}
-
-func showMenu() string {
-	fmt.Printf("\n%sNetwork Monitoring Debug Tool - Available Options%s\n", colorCyan, colorReset)
-	fmt.Println("------------------------------------------------")
-	fmt.Println("1. Check pod and service status")
-	fmt.Println("2. Update node port range and restart k3s")
-	fmt.Println("3. View network packets source IP addresses")
-	fmt.Println("4. Capture network packets to file")
-	fmt.Println("5. Collect debug logs")
-	fmt.Println("6. Exit")
-	fmt.Printf("\n%sEnter your choice (1-6):%s ", colorYellow, colorReset)
-
-	reader := bufio.NewReader(os.Stdin)
-	choice, _ := reader.ReadString('\n')
-	return strings.TrimSpace(choice)
-}
-func copyFile(src, dst string) error {
-	sourceFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer sourceFile.Close()
-
-	destFile, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer destFile.Close()
-
-	_, err = io.Copy(destFile, sourceFile)
-	return err
-}
-func updateNodePortRange() {
-	fmt.Printf("Updating K3s NodePort range to %s...\n", nodePortRange)
-
-	backupFile := k3sConfigFile + ".bak"
-	err := copyFile(k3sConfigFile, backupFile)
-	if err != nil {
-		fmt.Println("Failed to back up the K3s service file. Exiting.")
-	}
-	tmpFile, err := ioutil.TempFile("", "update_k3s_nodeport_*.sh")
-	if err != nil {
-		fmt.Println("Error creating temp file:", err)
-		os.Exit(1)
-	}
-	defer os.Remove(tmpFile.Name())
-
-	if _, err := tmpFile.Write([]byte(scriptContent)); err != nil {
-		fmt.Println("Error writing to temp file:", err)
-		os.Exit(1)
-	}
-	tmpFile.Close()
-
-	if err := os.Chmod(tmpFile.Name(), 0755); err != nil {
-		fmt.Println("Error making script executable:", err)
-		os.Exit(1)
-	}
-
-	cmd := exec.Command("/bin/bash", tmpFile.Name())
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	fmt.Println("Running the script...")
-	if err := cmd.Run(); err != nil {
-		fmt.Println("Error executing script:", err)
-		os.Exit(1)
-	}
-
-	fmt.Println("Script executed successfully.")
-
-	fmt.Println("K3s service file updated successfully.")
-}
-
-func collectLogs() bool {
-	fmt.Printf("%sEnabling debug logs in pod %s...%s\n", colorCyan, config.PodName, colorReset)
-
-	verboseCmd := fmt.Sprintf("kubectl exec -it $(kubectl get pod -l app=%s -o jsonpath='{.items[0].metadata.name}') -c %s -- sh -c \"echo '%s' >> %s\"",
-		config.PodName, config.ContainerName, config.VerboseConfigValue, config.VerboseConfigPath)
-
-	cmd := exec.Command("sh", "-c", verboseCmd)
-
-	if err := cmd.Run(); err != nil {
-		fmt.Printf("%sError: Failed to enable debug logs: %v%s\n", colorRed, err, colorReset)
-		return false
-	}
-
-	fmt.Printf("%sStarting log collection for 5 minutes...%s\n", colorGreen, colorReset)
-	startTime := time.Now()
-	endTime := startTime.Add(5 * time.Minute)
-
-	file, err := os.Create(config.LogFile)
-	if err != nil {
-		fmt.Printf("%sError: Failed to create log file: %v%s\n", colorRed, err, colorReset)
-		return false
-	}
-	defer file.Close()
-
-	cmd = exec.Command("kubectl", "logs", "-f", getPodName(config.PodName), "-c", config.ContainerName)
-	cmd.Stdout = file
-
-	if err := cmd.Start(); err != nil {
-		fmt.Printf("%sError: Failed to start log collection: %v%s\n", colorRed, err, colorReset)
-		return false
-	}
-
-	for time.Now().Before(endTime) {
-		elapsed := time.Since(startTime)
-		progress := int(elapsed.Seconds() * 100 / 300)
-		printProgress(progress, 100, "Collecting logs: ")
-		time.Sleep(1 * time.Second)
-	}
-
-	cmd.Process.Kill()
-	return true
-}
-
-func getPodName(prefix string) string {
-	cmd := exec.Command("kubectl", "get", "pods", "-o", "jsonpath={.items[*].metadata.name}")
-	output, err := cmd.Output()
-	if err != nil {
-		return ""
-	}
-
-	podNames := strings.Fields(string(output))
-	for _, name := range podNames {
-		if strings.HasPrefix(name, prefix) {
-			return name
-		}
-	}
-	return ""
-}
-
-func checkPod(podName string) {
-	out, err := exec.Command("kubectl", "get", "pods", "-o", "json").Output()
-	if err != nil {
-		fmt.Printf("%sError getting pods: %v%s\n", colorRed, err, colorReset)
-		return
-	}
-
-	var podList struct {
-		Items []Pod `json:"items"`
-	}
-	json.Unmarshal(out, &podList)
-
-	for _, pod := range podList.Items {
-		if strings.Contains(pod.Metadata.Name, podName) {
-			fmt.Printf("%sPod %s is in status: %s%s\n", colorGreen, podName, pod.Status.Phase, colorReset)
-			return
-		}
-	}
-	fmt.Printf("%sPod %s not found!%s\n", colorYellow, podName, colorReset)
-}
-
-func checkService(serviceName string) {
-	out, err := exec.Command("kubectl", "get", "services", "-o", "json").Output()
-	if err != nil {
-		fmt.Printf("%sError getting services: %v%s\n", colorRed, err, colorReset)
-		return
-	}
-
-	var serviceList struct {
-		Items []Service `json:"items"`
-	}
-	json.Unmarshal(out, &serviceList)
-
-	for _, service := range serviceList.Items {
-		if service.Metadata.Name == serviceName {
-			fmt.Printf("%sService %s is running%s\n", colorGreen, serviceName, colorReset)
-			return
-		}
-	}
-	fmt.Printf("%sService %s not found!%s\n", colorYellow, serviceName, colorReset)
-}
-
-func capturePacketsForOneMinute() {
-	fmt.Printf("%sStarting packet capture for 1 minute...%s\n", colorCyan, colorReset)
-	cmd := exec.Command("tcpdump", "-i", "any", "-nn", config.TcpdumpFilter, "-w", config.CaptureFile)
-
-	if err := cmd.Start(); err != nil {
-		fmt.Printf("%sError starting tcpdump: %v%s\n", colorRed, err, colorReset)
-		return
-	}
-
-	startTime := time.Now()
-	endTime := startTime.Add(1 * time.Minute)
-
-	for time.Now().Before(endTime) {
-		elapsed := time.Since(startTime)
-		progress := int(elapsed.Seconds() * 100 / 60)
-		printProgress(progress, 100, "Capturing packets: ")
-		time.Sleep(1 * time.Second)
-	}
-
-	cmd.Process.Kill()
-	fmt.Printf("%sPacket capture completed and saved to %s%s\n", colorGreen, config.CaptureFile, colorReset)
-}
-
-func collectUniqueIPs() map[string]bool {
-	cmd := exec.Command("tcpdump", "-i", "any", "-nn", config.TcpdumpFilter)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		fmt.Printf("%sError creating stdout pipe: %v%s\n", colorRed, err, colorReset)
-		return nil
-	}
-
-	if err := cmd.Start(); err != nil {
-		fmt.Printf("%sError starting tcpdump: %v%s\n", colorRed, err, colorReset)
-		return nil
-	}
-
-	defer cmd.Process.Kill()
-
-	ipRegex := regexp.MustCompile(`(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})`)
-	uniqueIPs := make(map[string]bool)
-	scanner := bufio.NewScanner(stdout)
-
-	go func() {
-		time.Sleep(10 * time.Second)
-		cmd.Process.Kill()
-	}()
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		matches := ipRegex.FindAllString(line, -1)
-		for _, ip := range matches {
-			uniqueIPs[ip] = true
-		}
-	}
-
-	return uniqueIPs
-}
-
-func main() {
-	fmt.Printf("\n%sNetwork Monitoring Debug Tool v1.0%s\n", colorCyan, colorReset)
-	fmt.Printf("Monitoring pod: %s, container: %s, service: %s\n",
-		config.PodName, config.ContainerName, config.ServiceName)
-	fmt.Println("This tool helps you troubleshoot network monitoring and packet collection issues")
-
-	for {
-		choice := showMenu()
-
-		switch choice {
-		case "1":
-			checkPod(config.PodName)
-			checkService(config.ServiceName)
-			for _, pod := range config.DependentPods {
-				checkPod(pod)
-			}
-		case "2":
-			updateNodePortRange()
-		case "3":
-			fmt.Printf("%sCollecting unique IPs (10 second sample)...%s\n", colorCyan, colorReset)
-			printSpinner(10*time.Second, "Analyzing network traffic")
-			uniqueIPs := collectUniqueIPs()
-			if len(uniqueIPs) > 0 {
-				fmt.Printf("\n%sDiscovered IPs:%s\n", colorGreen, colorReset)
-				for ip := range uniqueIPs {
-					fmt.Printf("  - %s\n", ip)
-				}
-			} else {
-				fmt.Println("No packets received during sampling period")
-			}
-		case "4":
-			capturePacketsForOneMinute()
-		case "5":
-			if collectLogs() {
-				fmt.Printf("%sLogs collected successfully. Please check %s%s\n",
-					colorGreen, config.LogFile, colorReset)
-			}
-		case "6":
-			fmt.Printf("\n%sThank you for using Network Monitoring Debug Tool. Goodbye!%s\n",
-				colorCyan, colorReset)
-			return
-		default:
-			fmt.Printf("%sInvalid choice. Please select a number between 1 and 6.%s\n",
-				colorYellow, colorReset)
-		}
-
-		fmt.Printf("\nPress Enter to continue...")
-		bufio.NewReader(os.Stdin).ReadBytes('\n')
-	}
-}
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/saivarma10/k3s-netmon-debug/netmon"
+)
+
+const (
+	k3sConfigFile = "/etc/systemd/system/k3s.service"
+	nodePortRange = "1000-32000"
+	tcpdumpFilter = "udp port 4729 or udp port 9996 or udp port 6343 or udp port 4739"
+	captureFile   = "capture.pcap"
+)
+
+// portNames documents what each port used by the filter presets carries
+var portNames = map[int]string{
+	4729:  "flow telemetry collector listener",
+	4739:  "IPFIX",
+	6343:  "sFlow",
+	9996:  "NetFlow",
+	4789:  "VXLAN, IANA port (Calico VXLAN encapsulation)",
+	8472:  "VXLAN, Linux default (k3s Flannel vxlan backend)",
+	51820: "WireGuard (k3s Flannel wireguard-native backend, Calico WireGuard)",
+	51821: "WireGuard over IPv6 (k3s Flannel wireguard-native backend)",
+}
+
+// filterPresets maps a -preset name to the UDP ports it captures
+var filterPresets = map[string][]int{
+	"telemetry": {4729, 9996, 6343, 4739},
+	"overlay":   {8472, 4789, 51820, 51821},
+}
+
+// protocolPorts are the telemetry protocols that -preset accepts with an
+// explicit transport, e.g. ipfix/tcp
+var protocolPorts = map[string]int{
+	"collector": 4729,
+	"netflow":   9996,
+	"sflow":     6343,
+	"ipfix":     4739,
+}
+
+// transports are the transports tcpdump can match ports of
+var transports = map[string]bool{"udp": true, "tcp": true, "sctp": true}
+
+// presetPort is a port captured by a preset over one transport, or all
+// traffic of the transport when Port is 0
+type presetPort struct {
+	Transport string
+	Port      int
+}
+
+// presetPorts resolves a -preset value, a comma-separated list of preset
+// names, protocol/transport pairs such as ipfix/tcp and bare transports such
+// as udp. A protocol without a transport is captured over UDP.
+func presetPorts(spec string) ([]presetPort, error) {
+	var ports []presetPort
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if transports[item] {
+			ports = append(ports, presetPort{Transport: item})
+			continue
+		}
+		if presetPorts, ok := filterPresets[item]; ok {
+			for _, port := range presetPorts {
+				ports = append(ports, presetPort{"udp", port})
+			}
+			continue
+		}
+
+		protocol, transport := item, "udp"
+		if i := strings.IndexByte(item, '/'); i >= 0 {
+			protocol, transport = item[:i], item[i+1:]
+		}
+		port, ok := protocolPorts[protocol]
+		if !ok {
+			var presets, protocols []string
+			for preset := range filterPresets {
+				presets = append(presets, preset)
+			}
+			for protocol := range protocolPorts {
+				protocols = append(protocols, protocol)
+			}
+			sort.Strings(presets)
+			sort.Strings(protocols)
+			return nil, configError("unknown preset %q (available: %s, or a protocol like ipfix/tcp: %s)",
+				item, strings.Join(presets, ", "), strings.Join(protocols, ", "))
+		}
+		if !transports[transport] {
+			return nil, configError("unknown transport %q in preset %q (want udp, tcp or sctp)", transport, item)
+		}
+		ports = append(ports, presetPort{transport, port})
+	}
+	return ports, nil
+}
+
+// String returns the tcpdump filter term of the port
+func (p presetPort) String() string {
+	if p.Port == 0 {
+		return p.Transport
+	}
+	return fmt.Sprintf("%s port %d", p.Transport, p.Port)
+}
+
+// presetFilter builds the tcpdump filter for a -preset value
+func presetFilter(spec string) (string, error) {
+	ports, err := presetPorts(spec)
+	if err != nil {
+		return "", err
+	}
+	terms := make([]string, len(ports))
+	for i, port := range ports {
+		terms[i] = port.String()
+	}
+	return strings.Join(terms, " or "), nil
+}
+
+const scriptContent = `#!/bin/bash
+
+NODEPORT_RANGE="${NODEPORT_RANGE:-1000-32000}"
+
+restart_k3s() {
+  echo "Restarting K3s service to apply changes..."
+  systemctl daemon-reload
+  systemctl restart k3s
+
+  if [ $? -ne 0 ]; then
+    echo "Failed to restart K3s service. Exiting."
+    exit 1
+  fi
+
+  echo "K3s service restarted successfully."
+}
+
+restart_k3s
+
+echo "NodePort range updated to ${NODEPORT_RANGE} and K3s restarted successfully."
+`
+
+// Configuration struct to hold all configurable parameters
+type Config struct {
+	Pods               []string
+	ContainerName      string
+	ServiceName        string
+	Targets            []string
+	Workloads          []string
+	DependentPods      []string
+	CriticalPods       []string
+	K3sConfigFile      string
+	NodePortFile       string
+	NodePortRange      string
+	TcpdumpFilter      string
+	TcpdumpFilterFile  string
+	CaptureFile        string
+	LogFile            string
+	VerboseConfigPath  string
+	VerboseConfigValue string
+	Action             string
+	Output             string
+	NoColor            bool
+	Quiet              bool
+	ProgressWidth      int
+	CommandLog         string
+	ProgressStyle      string
+	IPBaseline         string
+	Preset             string
+	Interfaces         []string
+	MergeCaptures      bool
+	SplitByPort        bool
+	FirstPacketPerFlow bool
+	TimelineMatch      string
+	Completion         string
+	Shell              string
+	TimelineWindow     time.Duration
+	CaptureRotate      time.Duration
+	CaptureKeep        int
+	MinFreeSpace       byteSize
+	Snaplen            int
+	TimePrecision      string
+	Direction          string
+	LogAppend          bool
+	LogSince           time.Duration
+	SinceLastRestart   bool
+	LogFollow          bool
+	LogGrep            string
+	LogStopPattern     string
+	LogGrepAnchored    bool
+	Redact             bool
+	RedactPatterns     string
+	LogMaxLines        int
+	LogMaxBytes        byteSize
+	K3sReadyTimeout    time.Duration
+	NodePortTarget     string
+	KeepScript         bool
+	TempDir            string
+	Wait               bool
+	WaitTimeout        time.Duration
+	Selector           string
+	Yes                bool
+	PostCaptureHook    string
+	CaptureBuffer      int
+	CaptureCount       int
+	Preview            bool
+	PreviewCount       int
+	PcapFile           string
+	JSONIndent         bool
+	TalkerThreshold    int
+	EndpointsInterval  time.Duration
+	ResourceLog        string
+	ResourceInterval   time.Duration
+	KubeContext        string
+	Verbose            bool
+	CapturePod         string
+	DebugImage         string
+	DebugCommand       string
+	MTUTarget          string
+	ServeAddr          string
+	WebhookURL         string
+	WebhookFormat      string
+	WebhookTimeout     time.Duration
+	IPAllowlist        string
+	OnlyUnknownIPs     bool
+	GeoIPDBs           []string
+	IPFormat           string
+	IPLog              string
+	IPLogInterval      time.Duration
+	IPLogMaxSize       byteSize
+	IPLogKeep          int
+}
+
+// ANSI color codes, cleared by setupTerminal when colors are disabled
+var (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorCyan   = "\033[36m"
+)
+
+// interactive is true when progress can be animated in place with carriage
+// returns. It is decided once at startup by setupTerminal.
+var interactive = true
+
+// isTerminal reports whether w is a character device such as a TTY
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// setupTerminal decides once how progress and colors are written, based on
+// whether output goes to a terminal and on -no-color and -quiet
+func setupTerminal() {
+	interactive = isTerminal(ui) && !config.NoColor && !config.Quiet
+	if config.NoColor || !isTerminal(os.Stdout) {
+		colorReset, colorRed, colorGreen, colorYellow, colorCyan = "", "", "", "", ""
+	}
+}
+
+// Output formats understood by render
+const (
+	formatText     = "text"
+	formatJSON     = "json"
+	formatMarkdown = "markdown"
+	formatOneline  = "oneline"
+)
+
+// ui receives progress bars and status chatter while an action runs. It is
+// switched to stderr for machine-readable formats so that stdout only
+// carries the rendered report.
+var ui io.Writer = os.Stdout
+
+// pcapStdout is the real stdout while -capture-file - streams the capture
+// to it; os.Stdout then points at stderr so nothing else can write there
+var pcapStdout *os.File
+
+// logStdout is the real stdout while -log-file - writes the collected logs
+// to it, with os.Stdout pointing at stderr like for pcapStdout
+var logStdout *os.File
+
+// ipStdout is the real stdout while -ip-format writes the IP list to it,
+// with os.Stdout pointing at stderr like for pcapStdout
+var ipStdout *os.File
+
+// IP list formats of -ip-format
+const (
+	ipFormatPlain = "plain"
+	ipFormatCSV   = "csv"
+	ipFormatJSON  = "json"
+	ipFormatHosts = "hosts"
+)
+
+// Matrix is a grid of results between labelled rows and columns, such as
+// the pod connectivity matrix
+type Matrix struct {
+	Labels []string   `json:"labels"`
+	Cells  [][]string `json:"cells"`
+}
+
+// PodRestart is a container restart seen while an action was running
+type PodRestart struct {
+	Time         time.Time `json:"time"`
+	Pod          string    `json:"pod"`
+	Container    string    `json:"container"`
+	RestartCount int       `json:"restartCount"`
+}
+
+// CaptureStats are the statistics tcpdump printed when a capture ended
+type CaptureStats struct {
+	Interface string `json:"interface"`
+	Port      int    `json:"port,omitempty"`
+	File      string `json:"file"`
+	Captured  int    `json:"captured"`
+	Received  int    `json:"receivedByFilter"`
+	Dropped   int    `json:"droppedByKernel"`
+	// Flows is the distinct flows kept with -first-packet-per-flow
+	Flows int `json:"flows,omitempty"`
+}
+
+// captureName names a capture by its interface and, with -split-by-port, its
+// port, e.g. "eth0 port 4729"
+func captureName(iface string, port int) string {
+	if port == 0 {
+		return iface
+	}
+	return fmt.Sprintf("%s port %d", iface, port)
+}
+
+// captureTotals adds up the statistics of several captures
+func captureTotals(captures []CaptureStats) CaptureStats {
+	total := CaptureStats{Interface: "total"}
+	for _, stats := range captures {
+		total.Captured += stats.Captured
+		total.Received += stats.Received
+		total.Dropped += stats.Dropped
+	}
+	return total
+}
+
+// Report captures the results of any action so that formatting happens in
+// one place, see render
+type Report struct {
+	Action          string                  `json:"action"`
+	Success         bool                    `json:"success"`
+	Entries         []netmon.StatusEntry    `json:"entries,omitempty"`
+	Health          *Health                 `json:"health,omitempty"`
+	CNI             *netmon.CNI             `json:"cni,omitempty"`
+	Matrix          *Matrix                 `json:"matrix,omitempty"`
+	IPs             []netmon.IPCount        `json:"ips,omitempty"`
+	Flows           []netmon.FlowCount      `json:"flows,omitempty"`
+	Asymmetric      *netmon.Asymmetry       `json:"asymmetric,omitempty"`
+	Diff            *netmon.IPDiff          `json:"diff,omitempty"`
+	Restarts        []PodRestart            `json:"restarts,omitempty"`
+	Events          []netmon.Event          `json:"events,omitempty"`
+	Captures        []CaptureStats          `json:"captures,omitempty"`
+	EndpointChanges []netmon.EndpointChange `json:"endpointChanges,omitempty"`
+	Timeline        []netmon.TimelineEvent  `json:"timeline,omitempty"`
+	Files           []string                `json:"files,omitempty"`
+	Warnings        []string                `json:"warnings,omitempty"`
+	Notes           []string                `json:"notes,omitempty"`
+	Errors          []string                `json:"errors,omitempty"`
+
+	// errs are the errors behind Errors, for errors.Is and errors.As
+	errs []error
+}
+
+// Health is the overall verdict of a status check
+type Health struct {
+	// Verdict is HEALTHY, DEGRADED or DOWN
+	Verdict string `json:"verdict"`
+	// Causes are the components that are not up, e.g. "stan-0 (not found)"
+	Causes []string `json:"causes,omitempty"`
+}
+
+const (
+	healthHealthy  = "HEALTHY"
+	healthDegraded = "DEGRADED"
+	healthDown     = "DOWN"
+)
+
+func newReport(action string) Report {
+	return Report{Action: action, Success: true}
+}
+
+// addEntry records a status entry; an unhealthy entry fails the report
+// unless it is only a warning
+func (r *Report) addEntry(entry netmon.StatusEntry) {
+	r.Entries = append(r.Entries, entry)
+	if !entry.Healthy && !entry.Warning {
+		r.Success = false
+	}
+}
+
+func (r *Report) fail(err error) {
+	r.Success = false
+	r.Errors = append(r.Errors, err.Error())
+	r.errs = append(r.errs, err)
+}
+
+// Err returns the first error the report failed with, or nil
+func (r Report) Err() error {
+	if len(r.errs) == 0 {
+		return nil
+	}
+	return r.errs[0]
+}
+
+// configError reports an invalid flag value or combination
+func configError(format string, args ...interface{}) error {
+	return &netmon.ActionError{Kind: netmon.ErrConfig, Err: fmt.Errorf(format, args...)}
+}
+
+// kubectlError reports a failed kubectl invocation run by the CLI itself
+func kubectlError(args []string, err error) error {
+	return &netmon.ActionError{Kind: netmon.ErrKubectl, Command: "kubectl " + strings.Join(args, " "), Err: err}
+}
+
+func (r *Report) note(format string, args ...interface{}) {
+	r.Notes = append(r.Notes, fmt.Sprintf(format, args...))
+}
+
+// warn records a problem that does not fail the action but can invalidate
+// its results, shown more prominently than a note
+func (r *Report) warn(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+func validFormat(format string) bool {
+	switch format {
+	case formatText, formatJSON, formatMarkdown, formatOneline:
+		return true
+	}
+	return false
+}
+
+// render writes r to w in the given format
+func render(r Report, format string, w io.Writer) {
+	switch format {
+	case formatJSON:
+		renderJSON(r, w)
+	case formatMarkdown:
+		renderMarkdown(r, w)
+	case formatOneline:
+		renderOneline(r, w)
+	default:
+		renderText(r, w)
+	}
+}
+
+// renderJSON writes the report indented with -json-indent, on one line
+// otherwise
+func renderJSON(r Report, w io.Writer) {
+	encoder := json.NewEncoder(w)
+	if config.JSONIndent {
+		encoder.SetIndent("", "  ")
+	}
+	encoder.Encode(r)
+}
+
+func entryColor(entry netmon.StatusEntry) string {
+	switch {
+	case entry.Healthy:
+		return colorGreen
+	case entry.Warning:
+		return colorYellow
+	}
+	return colorRed
+}
+
+func healthColor(verdict string) string {
+	switch verdict {
+	case healthHealthy:
+		return colorGreen
+	case healthDegraded:
+		return colorYellow
+	}
+	return colorRed
+}
+
+// healthCauses returns " caused by ..." listing h's causes, or "" without
+func healthCauses(h Health) string {
+	if len(h.Causes) == 0 {
+		return ""
+	}
+	return " caused by " + strings.Join(h.Causes, ", ")
+}
+
+// writeIPs writes ips in one of the -ip-format formats: plain is the list
+// of the text report, csv has an ip,count header, json is an array of
+// objects and hosts has one IP per line, as allowlists and firewall rules
+// take them
+func writeIPs(w io.Writer, ips []netmon.IPCount, format string) error {
+	switch format {
+	case ipFormatCSV:
+		csvWriter := csv.NewWriter(w)
+		csvWriter.Write([]string{"ip", "count"})
+		for _, ip := range ips {
+			csvWriter.Write([]string{ip.IP, strconv.Itoa(ip.Count)})
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	case ipFormatJSON:
+		if ips == nil {
+			ips = []netmon.IPCount{}
+		}
+		return json.NewEncoder(w).Encode(ips)
+	case ipFormatHosts:
+		for _, ip := range ips {
+			if _, err := fmt.Fprintln(w, ip.IP); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, ip := range ips {
+		direction := ""
+		if ip.Direction != "" {
+			direction = " (" + ip.Direction + ")"
+		}
+		if ip.GeoIP != "" {
+			direction += "  " + ip.GeoIP
+		}
+		if ip.Unknown {
+			fmt.Fprintf(w, "  - %s%-15s  %d packets%s (not in allowlist)%s\n", colorRed, ip.IP, ip.Count, direction, colorReset)
+			continue
+		}
+		fmt.Fprintf(w, "  - %-15s  %d packets%s\n", ip.IP, ip.Count, direction)
+	}
+	return nil
+}
+
+func renderText(r Report, w io.Writer) {
+	if len(r.Entries) > 0 {
+		typeWidth, resourceWidth, statusWidth := len("TYPE"), len("RESOURCE"), len("STATUS")
+		for _, entry := range r.Entries {
+			typeWidth = maxInt(typeWidth, len(entry.Type))
+			resourceWidth = maxInt(resourceWidth, len(entry.Resource))
+			statusWidth = maxInt(statusWidth, len(entry.Status))
+		}
+		fmt.Fprintf(w, "%-*s  %-*s  %-*s  %s\n", typeWidth, "TYPE", resourceWidth, "RESOURCE", statusWidth, "STATUS", "DETAIL")
+		for _, entry := range r.Entries {
+			fmt.Fprintf(w, "%-*s  %-*s  %s%-*s%s  %s\n", typeWidth, entry.Type, resourceWidth, entry.Resource,
+				entryColor(entry), statusWidth, entry.Status, colorReset, entry.Detail)
+		}
+	}
+	if r.Health != nil {
+		fmt.Fprintf(w, "\nOverall: %s%s%s%s\n", healthColor(r.Health.Verdict), r.Health.Verdict, colorReset, healthCauses(*r.Health))
+	}
+
+	if r.Matrix != nil {
+		renderMatrixText(*r.Matrix, w)
+	}
+
+	// with -ip-format the list went to stdout on its own
+	if len(r.IPs) > 0 && ipStdout == nil {
+		fmt.Fprintf(w, "\n%sDiscovered IPs:%s\n", colorGreen, colorReset)
+		writeIPs(w, r.IPs, ipFormatPlain)
+	}
+
+	if len(r.Flows) > 0 {
+		fmt.Fprintf(w, "\n%sTop flows:%s\n", colorGreen, colorReset)
+		srcWidth, dstWidth := len("SOURCE"), len("DESTINATION")
+		for _, flow := range r.Flows {
+			srcWidth = maxInt(srcWidth, len(flowEndpoint(flow.SrcIP, flow.SrcPort)))
+			dstWidth = maxInt(dstWidth, len(flowEndpoint(flow.DstIP, flow.DstPort)))
+		}
+		fmt.Fprintf(w, "  %-*s  %-*s  %-5s  %s\n", srcWidth, "SOURCE", dstWidth, "DESTINATION", "PROTO", "PACKETS")
+		for _, flow := range r.Flows {
+			fmt.Fprintf(w, "  %-*s  %-*s  %-5s  %d\n", srcWidth, flowEndpoint(flow.SrcIP, flow.SrcPort),
+				dstWidth, flowEndpoint(flow.DstIP, flow.DstPort), flow.Proto, flow.Count)
+		}
+	}
+
+	if r.Asymmetric != nil {
+		fmt.Fprintf(w, "\n%sPossible asymmetric flows:%s\n", colorYellow, colorReset)
+		if len(r.Asymmetric.SourcesOnly) > 0 {
+			fmt.Fprintf(w, "  only sending:   %s\n", strings.Join(r.Asymmetric.SourcesOnly, ", "))
+		}
+		if len(r.Asymmetric.DestinationsOnly) > 0 {
+			fmt.Fprintf(w, "  only receiving: %s\n", strings.Join(r.Asymmetric.DestinationsOnly, ", "))
+		}
+	}
+
+	if r.Diff != nil {
+		renderDiffText(*r.Diff, w)
+	}
+
+	if len(r.Captures) > 0 {
+		fmt.Fprintf(w, "\n%stcpdump statistics:%s\n", colorGreen, colorReset)
+		rows := r.Captures
+		if len(rows) > 1 {
+			rows = append(rows[:len(rows):len(rows)], captureTotals(rows))
+		}
+		ifaceWidth := len("INTERFACE")
+		for _, stats := range rows {
+			ifaceWidth = maxInt(ifaceWidth, len(captureName(stats.Interface, stats.Port)))
+		}
+		fmt.Fprintf(w, "  %-*s  %10s  %18s  %17s\n", ifaceWidth, "INTERFACE", "CAPTURED", "RECEIVED BY FILTER", "DROPPED BY KERNEL")
+		for _, stats := range rows {
+			dropColor := ""
+			if stats.Dropped > 0 {
+				dropColor = colorRed
+			}
+			fmt.Fprintf(w, "  %-*s  %10d  %18d  %s%17d%s\n", ifaceWidth, captureName(stats.Interface, stats.Port), stats.Captured,
+				stats.Received, dropColor, stats.Dropped, colorReset)
+		}
+	}
+
+	if len(r.EndpointChanges) > 0 {
+		fmt.Fprintf(w, "\n%sEndpoint changes:%s\n", colorYellow, colorReset)
+		for _, change := range r.EndpointChanges {
+			fmt.Fprintf(w, "  - %s\n", endpointChangeText(change))
+		}
+	}
+
+	if len(r.Timeline) > 0 {
+		fmt.Fprintf(w, "\n%sTimeline:%s\n", colorGreen, colorReset)
+		for _, event := range r.Timeline {
+			if event.Match {
+				fmt.Fprintf(w, "  %s  %-6s  %s%s%s\n", event.Time.Format(timelineTime), event.Source, colorYellow, event.Text, colorReset)
+				continue
+			}
+			fmt.Fprintf(w, "  %s  %-6s  %s\n", event.Time.Format(timelineTime), event.Source, event.Text)
+		}
+	}
+
+	if len(r.Events) > 0 {
+		fmt.Fprintf(w, "\n%sPod events:%s\n", colorCyan, colorReset)
+		for _, event := range r.Events {
+			line := fmt.Sprintf("  %s  %-7s  %s  %s: %s", event.Time.Format(time.RFC3339), event.Type, event.Pod, event.Reason, event.Message)
+			if event.Count > 1 {
+				line += fmt.Sprintf(" (x%d)", event.Count)
+			}
+			if event.Type == netmon.EventWarning {
+				line = colorRed + line + colorReset
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+
+	if len(r.Restarts) > 0 {
+		fmt.Fprintf(w, "\n%sPod restarts during the run:%s\n", colorRed, colorReset)
+		for _, restart := range r.Restarts {
+			fmt.Fprintf(w, "  - %s  %s/%s (restart count %d)\n", restart.Time.Format(time.RFC3339),
+				restart.Pod, restart.Container, restart.RestartCount)
+		}
+	}
+
+	for _, file := range r.Files {
+		fmt.Fprintf(w, "%sSaved %s%s\n", colorGreen, file, colorReset)
+	}
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(w, "%sWARNING: %s%s\n", colorRed, warning, colorReset)
+	}
+	for _, note := range r.Notes {
+		fmt.Fprintln(w, note)
+	}
+	for _, msg := range r.Errors {
+		fmt.Fprintf(w, "%sError: %s%s\n", colorRed, msg, colorReset)
+	}
+}
+
+// flowEndpoint formats one end of a flow as ip:port
+func flowEndpoint(ip string, port int) string {
+	return ip + ":" + strconv.Itoa(port)
+}
+
+func renderDiffText(d netmon.IPDiff, w io.Writer) {
+	fmt.Fprintf(w, "\n%sChanges relative to %s:%s\n", colorCyan, d.Baseline, colorReset)
+	if len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 {
+		fmt.Fprintln(w, "  no changes")
+		return
+	}
+	for _, ip := range d.Added {
+		fmt.Fprintf(w, "%s  + %-15s  %d packets (new)%s\n", colorGreen, ip.IP, ip.Count, colorReset)
+	}
+	for _, ip := range d.Removed {
+		fmt.Fprintf(w, "%s  - %-15s  %d packets (disappeared)%s\n", colorRed, ip.IP, ip.Count, colorReset)
+	}
+	for _, ip := range d.Changed {
+		fmt.Fprintf(w, "  ~ %-15s  %d -> %d (%+d)\n", ip.IP, ip.Old, ip.New, ip.Delta)
+	}
+}
+
+func renderMatrixText(m Matrix, w io.Writer) {
+	corner := "source \\ target"
+	rows := make([]string, len(m.Labels))
+	width := len(corner)
+	for i, label := range m.Labels {
+		rows[i] = fmt.Sprintf("[%d] %s", i+1, label)
+		width = maxInt(width, len(rows[i]))
+	}
+
+	fmt.Fprintf(w, "\n%-*s", width, corner)
+	for i := range m.Labels {
+		fmt.Fprintf(w, " %-8s", fmt.Sprintf("[%d]", i+1))
+	}
+	fmt.Fprintln(w)
+
+	for i, row := range m.Cells {
+		fmt.Fprintf(w, "%-*s", width, rows[i])
+		for _, cell := range row {
+			color := colorReset
+			switch probeResult(cell) {
+			case probeOK:
+				color = colorGreen
+			case probeFailed:
+				color = colorRed
+			case probeUnavailable, probeNoPorts:
+				color = colorYellow
+			}
+			fmt.Fprintf(w, " %s%-8s%s", color, cell, colorReset)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w)
+}
+
+// markdownIP renders a discovered IP, in bold when it is not in the
+// allowlist, followed by its GeoIP annotation
+func markdownIP(ip netmon.IPCount) string {
+	cell := ip.IP
+	if ip.Unknown {
+		cell = "**" + ip.IP + "** (not in allowlist)"
+	}
+	if ip.GeoIP != "" {
+		cell += " " + markdownEscape(ip.GeoIP)
+	}
+	return cell
+}
+
+// markdownEscape keeps a value from breaking a markdown table cell
+func markdownEscape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "|", "\\|"), "\n", " ")
+}
+
+func renderMarkdown(r Report, w io.Writer) {
+	result := "success"
+	if !r.Success {
+		result = "failed"
+	}
+	fmt.Fprintf(w, "### %s (%s)\n\n", r.Action, result)
+
+	if len(r.Entries) > 0 {
+		fmt.Fprintln(w, "| Resource | Type | Status |")
+		fmt.Fprintln(w, "|----------|------|--------|")
+		for _, entry := range r.Entries {
+			status := entry.Status
+			if entry.Detail != "" {
+				status += " (" + entry.Detail + ")"
+			}
+			fmt.Fprintf(w, "| %s | %s | %s |\n", markdownEscape(entry.Resource), entry.Type, markdownEscape(status))
+		}
+		fmt.Fprintln(w)
+	}
+	if r.Health != nil {
+		fmt.Fprintf(w, "**Overall: %s**%s\n\n", r.Health.Verdict, markdownEscape(healthCauses(*r.Health)))
+	}
+
+	if r.Matrix != nil {
+		fmt.Fprint(w, "| source \\ target |")
+		for _, label := range r.Matrix.Labels {
+			fmt.Fprintf(w, " %s |", markdownEscape(label))
+		}
+		fmt.Fprint(w, "\n|---|")
+		for range r.Matrix.Labels {
+			fmt.Fprint(w, "---|")
+		}
+		fmt.Fprintln(w)
+		for i, row := range r.Matrix.Cells {
+			fmt.Fprintf(w, "| %s |", markdownEscape(r.Matrix.Labels[i]))
+			for _, cell := range row {
+				fmt.Fprintf(w, " %s |", cell)
+			}
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w)
+	}
+
+	// with -ip-format the list went to stdout on its own
+	hasIPs := len(r.IPs) > 0 && ipStdout == nil
+	if hasIPs && r.IPs[0].Direction != "" {
+		fmt.Fprintln(w, "| IP | Packets | Direction |")
+		fmt.Fprintln(w, "|----|---------|-----------|")
+		for _, ip := range r.IPs {
+			fmt.Fprintf(w, "| %s | %d | %s |\n", markdownIP(ip), ip.Count, ip.Direction)
+		}
+		fmt.Fprintln(w)
+	} else if hasIPs {
+		fmt.Fprintln(w, "| IP | Packets |")
+		fmt.Fprintln(w, "|----|---------|")
+		for _, ip := range r.IPs {
+			fmt.Fprintf(w, "| %s | %d |\n", markdownIP(ip), ip.Count)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.Flows) > 0 {
+		fmt.Fprintln(w, "| Source | Destination | Protocol | Packets |")
+		fmt.Fprintln(w, "|--------|-------------|----------|---------|")
+		for _, flow := range r.Flows {
+			fmt.Fprintf(w, "| %s | %s | %s | %d |\n", flowEndpoint(flow.SrcIP, flow.SrcPort),
+				flowEndpoint(flow.DstIP, flow.DstPort), flow.Proto, flow.Count)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if r.Asymmetric != nil {
+		fmt.Fprintln(w, "Possible asymmetric flows:")
+		fmt.Fprintln(w)
+		if len(r.Asymmetric.SourcesOnly) > 0 {
+			fmt.Fprintf(w, "- only sending: %s\n", strings.Join(r.Asymmetric.SourcesOnly, ", "))
+		}
+		if len(r.Asymmetric.DestinationsOnly) > 0 {
+			fmt.Fprintf(w, "- only receiving: %s\n", strings.Join(r.Asymmetric.DestinationsOnly, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+
+	if r.Diff != nil {
+		fmt.Fprintf(w, "Changes relative to `%s`:\n\n", r.Diff.Baseline)
+		fmt.Fprintln(w, "| IP | Change | Baseline | Current |")
+		fmt.Fprintln(w, "|----|--------|----------|---------|")
+		for _, ip := range r.Diff.Added {
+			fmt.Fprintf(w, "| %s | new | 0 | %d |\n", ip.IP, ip.Count)
+		}
+		for _, ip := range r.Diff.Removed {
+			fmt.Fprintf(w, "| %s | disappeared | %d | 0 |\n", ip.IP, ip.Count)
+		}
+		for _, ip := range r.Diff.Changed {
+			fmt.Fprintf(w, "| %s | %+d | %d | %d |\n", ip.IP, ip.Delta, ip.Old, ip.New)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.Captures) > 0 {
+		fmt.Fprintln(w, "| Interface | File | Captured | Received by filter | Dropped by kernel |")
+		fmt.Fprintln(w, "|-----------|------|----------|--------------------|-------------------|")
+		for _, stats := range r.Captures {
+			dropped := strconv.Itoa(stats.Dropped)
+			if stats.Dropped > 0 {
+				dropped = "**" + dropped + "**"
+			}
+			fmt.Fprintf(w, "| %s | `%s` | %d | %d | %s |\n", markdownEscape(captureName(stats.Interface, stats.Port)), stats.File,
+				stats.Captured, stats.Received, dropped)
+		}
+		if len(r.Captures) > 1 {
+			total := captureTotals(r.Captures)
+			fmt.Fprintf(w, "| **total** | | %d | %d | %d |\n", total.Captured, total.Received, total.Dropped)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.Timeline) > 0 {
+		fmt.Fprintln(w, "| Time | Source | Event |")
+		fmt.Fprintln(w, "|------|--------|-------|")
+		for _, event := range r.Timeline {
+			text := "`" + strings.ReplaceAll(event.Text, "`", "'") + "`"
+			if event.Match {
+				text = "**" + text + "**"
+			}
+			fmt.Fprintf(w, "| %s | %s | %s |\n", event.Time.Format(timelineTime), event.Source, markdownEscape(text))
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.EndpointChanges) > 0 {
+		fmt.Fprintln(w, "| Time | Added | Removed | Ready | Not ready |")
+		fmt.Fprintln(w, "|------|-------|---------|-------|-----------|")
+		for _, change := range r.EndpointChanges {
+			fmt.Fprintf(w, "| %s | %s | %s | %d | %s |\n", change.Time.Format(time.RFC3339),
+				markdownEscape(strings.Join(change.Added, ", ")), markdownEscape(strings.Join(change.Removed, ", ")),
+				change.Ready, markdownEscape(strings.Join(change.NotReady, ", ")))
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.Events) > 0 {
+		fmt.Fprintln(w, "| Time | Type | Pod | Reason | Message | Count |")
+		fmt.Fprintln(w, "|------|------|-----|--------|---------|-------|")
+		for _, event := range r.Events {
+			eventType := event.Type
+			if eventType == netmon.EventWarning {
+				eventType = "**" + eventType + "**"
+			}
+			fmt.Fprintf(w, "| %s | %s | %s | %s | %s | %d |\n", event.Time.Format(time.RFC3339), eventType,
+				markdownEscape(event.Pod), markdownEscape(event.Reason), markdownEscape(event.Message), event.Count)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.Restarts) > 0 {
+		fmt.Fprintln(w, "| Time | Pod | Container | Restart count |")
+		fmt.Fprintln(w, "|------|-----|-----------|---------------|")
+		for _, restart := range r.Restarts {
+			fmt.Fprintf(w, "| %s | %s | %s | %d |\n", restart.Time.Format(time.RFC3339),
+				markdownEscape(restart.Pod), markdownEscape(restart.Container), restart.RestartCount)
+		}
+		fmt.Fprintln(w)
+	}
+
+	for _, file := range r.Files {
+		fmt.Fprintf(w, "- Saved `%s`\n", file)
+	}
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(w, "> **Warning:** %s\n\n", warning)
+	}
+	for _, note := range r.Notes {
+		fmt.Fprintf(w, "%s\n\n", note)
+	}
+	for _, msg := range r.Errors {
+		fmt.Fprintf(w, "**Error:** %s\n\n", msg)
+	}
+
+	if cliFlags != nil {
+		fmt.Fprintln(w, "<details><summary>Configuration</summary>")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "```")
+		cliFlags.VisitAll(func(f *flag.Flag) {
+			fmt.Fprintf(w, "-%s=%s\n", f.Name, f.Value)
+		})
+		fmt.Fprintln(w, "```")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "</details>")
+	}
+}
+
+// renderOneline writes a single terse line without colors or a trailing
+// newline, e.g. "pods:3/3 svc:ok ports:4729,9996", for shell prompts and
+// status bars. Reports without pods or services are summarized as
+// "<action>:ok" or "<action>:failed".
+func renderOneline(r Report, w io.Writer) {
+	var parts []string
+	pods, healthyPods := 0, 0
+	for _, entry := range r.Entries {
+		switch entry.Type {
+		case "pod":
+			pods++
+			if entry.Healthy {
+				healthyPods++
+			}
+		case "service":
+			state := "ok"
+			if !entry.Healthy {
+				state = strings.ReplaceAll(entry.Status, " ", "-")
+			}
+			parts = append(parts, "svc:"+state)
+			if len(entry.Ports) > 0 {
+				ports := make([]string, len(entry.Ports))
+				for i, port := range entry.Ports {
+					ports[i] = strconv.Itoa(port)
+				}
+				parts = append(parts, "ports:"+strings.Join(ports, ","))
+			}
+		}
+	}
+	if pods > 0 {
+		parts = append([]string{fmt.Sprintf("pods:%d/%d", healthyPods, pods)}, parts...)
+	}
+	if r.Health != nil {
+		parts = append(parts, "health:"+strings.ToLower(r.Health.Verdict))
+	}
+	if len(parts) == 0 || len(r.Errors) > 0 {
+		result := "ok"
+		if !r.Success {
+			result = "failed"
+		}
+		parts = append(parts, r.Action+":"+result)
+	}
+	fmt.Fprint(w, strings.Join(parts, " "))
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+var config Config
+
+// cliFlags is the flag set of the command being run, used by the actions to
+// validate the flags they depend on
+var cliFlags *flag.FlagSet
+
+// stringList is a flag.Value holding a comma-separated list of names
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = nil
+	if value != "" {
+		*s = strings.Split(value, ",")
+	}
+	return nil
+}
+
+// byteSize is a flag.Value holding a size in bytes, written as a plain
+// number or with a K, M or G suffix
+type byteSize uint64
+
+func (b *byteSize) String() string {
+	return netmon.FormatBytes(uint64(*b))
+}
+
+func (b *byteSize) Set(value string) error {
+	value = strings.ToUpper(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B"))
+	multiplier := uint64(1)
+	for i, suffix := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(value, suffix) {
+			multiplier = 1 << (10 * uint(i+1))
+			value = strings.TrimSuffix(value, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n * multiplier)
+	return nil
+}
+
+// byteSizeVar defines a byteSize flag with a default value, like the Var
+// methods of flag.FlagSet do for the built-in types
+func byteSizeVar(fs *flag.FlagSet, p *byteSize, name string, value byteSize, usage string) {
+	*p = value
+	fs.Var(p, name, usage)
+}
+
+// registerFlag defines the named flag on fs, bound to the matching config field
+func registerFlag(fs *flag.FlagSet, name string) {
+	switch name {
+	case "pod":
+		fs.Var((*stringList)(&config.Pods), "pod", "Comma-separated list of main pods to monitor")
+	case "container":
+		fs.StringVar(&config.ContainerName, "container", "", "Name of the container within the pod")
+	case "service":
+		fs.StringVar(&config.ServiceName, "service", "", "Name of the service to monitor")
+	case "target":
+		fs.Var((*stringList)(&config.Targets), "target", "Comma-separated kubectl-style kind/name targets, e.g. pod/flow-collector or svc/flow-collector, adding to -pod and -service")
+	case "workload":
+		fs.Var((*stringList)(&config.Workloads), "workload", "Comma-separated kind/name of DaemonSets, StatefulSets or Deployments whose pods are checked as a group, e.g. daemonset/collector")
+	case "dependent-pods":
+		fs.Var((*stringList)(&config.DependentPods), "dependent-pods", "Comma-separated list of dependent pods")
+	case "critical-pods":
+		fs.Var((*stringList)(&config.CriticalPods), "critical-pods", "Comma-separated -dependent-pods whose failure takes the system down rather than degrading it")
+	case "k3s-config":
+		fs.StringVar(&config.K3sConfigFile, "k3s-config", k3sConfigFile, "Path to the K3s systemd unit")
+	case "nodeport-file":
+		fs.StringVar(&config.NodePortFile, "nodeport-file", "", "File edited by nodeport and revert-nodeport instead of the -nodeport-target's default")
+	case "nodeport-range":
+		fs.StringVar(&config.NodePortRange, "nodeport-range", nodePortRange, "NodePort range")
+	case "nodeport-target":
+		fs.StringVar(&config.NodePortTarget, "nodeport-target", "k3s-unit", "Where the NodePort range is configured: k3s-unit, k3s-config or apiserver-manifest")
+	case "temp-dir":
+		fs.StringVar(&config.TempDir, "temp-dir", "", "Directory for the generated update script, which must allow running scripts (default the OS temp dir)")
+	case "keep-script":
+		fs.BoolVar(&config.KeepScript, "keep-script", false, "Keep the generated k3s update script as "+keptScriptFile+" for inspection")
+	case "k3s-ready-timeout":
+		fs.DurationVar(&config.K3sReadyTimeout, "k3s-ready-timeout", 2*time.Minute, "Maximum time to wait for k3s to become ready after a restart")
+	case "tcpdump-filter":
+		fs.StringVar(&config.TcpdumpFilter, "tcpdump-filter", "udp", "tcpdump filter string")
+	case "tcpdump-filter-file":
+		fs.StringVar(&config.TcpdumpFilterFile, "tcpdump-filter-file", "", "File to read the tcpdump filter from when -tcpdump-filter is not given (# starts a comment)")
+	case "capture-file":
+		fs.StringVar(&config.CaptureFile, "capture-file", "packets.pcap", "Packet capture file name")
+	case "log-file":
+		fs.StringVar(&config.LogFile, "log-file", "debug.log", "Log file name, or - for stdout")
+	case "log-max-lines":
+		fs.IntVar(&config.LogMaxLines, "log-max-lines", 0, "Stop log collection after this many lines (0 for no limit)")
+	case "log-max-bytes":
+		byteSizeVar(fs, &config.LogMaxBytes, "log-max-bytes", 0, "Stop log collection after this many bytes, e.g. 50M (0 for no limit)")
+	case "log-since":
+		fs.DurationVar(&config.LogSince, "log-since", 0, "Also collect the log history of this period before now, e.g. 10m")
+	case "since-last-restart":
+		fs.BoolVar(&config.SinceLastRestart, "since-last-restart", false, "Collect the logs since the container last started, passed to kubectl logs as --since-time")
+	case "log-follow":
+		fs.BoolVar(&config.LogFollow, "log-follow", true, "Keep following new log lines for 5 minutes")
+	case "log-grep":
+		fs.StringVar(&config.LogGrep, "log-grep", "", "Only keep log lines matching this regular expression")
+	case "log-stop-pattern":
+		fs.StringVar(&config.LogStopPattern, "log-stop-pattern", "", "Stop log collection after the first line matching this regular expression, keeping that line")
+	case "log-grep-anchored":
+		fs.BoolVar(&config.LogGrepAnchored, "log-grep-anchored", false, "Require -log-grep to match whole lines instead of any substring")
+	case "redact":
+		fs.BoolVar(&config.Redact, "redact", false, "Replace tokens, passwords, AWS keys and email addresses in collected logs with "+redacted)
+	case "redact-patterns":
+		fs.StringVar(&config.RedactPatterns, "redact-patterns", "", "File of additional regular expressions to redact from collected logs, one per line (implies -redact)")
+	case "log-append":
+		fs.BoolVar(&config.LogAppend, "log-append", false, "Append to the log file instead of overwriting it")
+	case "verbose-config-path":
+		fs.StringVar(&config.VerboseConfigPath, "verbose-config-path", "/etc/config/config.conf", "Path to verbose config file")
+	case "verbose-config-value":
+		fs.StringVar(&config.VerboseConfigValue, "verbose-config-value", "verbose: enabled", "Value to add to verbose config")
+	case "wait":
+		fs.BoolVar(&config.Wait, "wait", false, "Wait for pods to become ready instead of checking once")
+	case "wait-timeout":
+		fs.DurationVar(&config.WaitTimeout, "wait-timeout", 5*time.Minute, "Maximum time to wait for pods with -wait")
+	case "selector":
+		fs.StringVar(&config.Selector, "selector", "", "Label selector of the pods to act on, e.g. app=npm-collector")
+	case "yes":
+		fs.BoolVar(&config.Yes, "yes", false, "Do not ask for confirmation before disruptive actions")
+	case "force":
+		fs.BoolVar(&config.Yes, "force", false, "Same as -yes")
+	case "output":
+		fs.StringVar(&config.Output, "output", formatText, "Output format: text, json, markdown or oneline")
+	case "interface":
+		fs.Var((*stringList)(&config.Interfaces), "interface", "Comma-separated interfaces to capture on in parallel, or patterns such as veth* or /^cni[0-9]+$/ (default any)")
+	case "split-by-port":
+		fs.BoolVar(&config.SplitByPort, "split-by-port", false, "Run one tcpdump per port of the filter, each writing its own file (e.g. packets-4729.pcap)")
+	case "first-packet-per-flow":
+		fs.BoolVar(&config.FirstPacketPerFlow, "first-packet-per-flow", false, "Keep only the first packet of each flow (TCP SYNs, the first UDP datagram per 5-tuple) and count the flows")
+	case "merge":
+		fs.BoolVar(&config.MergeCaptures, "merge", false, "Merge multi-interface captures into one time-ordered file")
+	case "capture-rotate":
+		fs.DurationVar(&config.CaptureRotate, "capture-rotate", 0, "Rotate the capture into a new timestamped file at this interval until interrupted")
+	case "snaplen":
+		fs.IntVar(&config.Snaplen, "snaplen", 0, "Bytes of each packet to capture (0 captures full packets)")
+	case "capture-count":
+		fs.IntVar(&config.CaptureCount, "capture-count", 0, "Stop the capture after this many packets (tcpdump -c) instead of after 1 minute")
+	case "preview":
+		fs.BoolVar(&config.Preview, "preview", false, "Show the first packets matching the filter before capturing to a file")
+	case "preview-count":
+		fs.IntVar(&config.PreviewCount, "preview-count", 10, "Packets shown by -preview")
+	case "capture-buffer":
+		fs.IntVar(&config.CaptureBuffer, "capture-buffer", 0, "Kernel capture buffer size in KB, passed to tcpdump as -B (default tcpdump's)")
+	case "time-precision":
+		fs.StringVar(&config.TimePrecision, "time-precision", "", "Capture timestamp precision: micro or nano (default tcpdump's)")
+	case "direction":
+		fs.StringVar(&config.Direction, "direction", "", "Only capture traffic received (in) or sent (out) by this host; in, out or both also tag sampled IPs by direction")
+	case "min-free-space":
+		byteSizeVar(fs, &config.MinFreeSpace, "min-free-space", 100<<20, "Stop the capture early when free space in the capture directory drops below this size (e.g. 500M, 0 to disable)")
+	case "post-capture-hook":
+		fs.StringVar(&config.PostCaptureHook, "post-capture-hook", "", "Command to run on each capture file afterwards; {file}, {interface} and {duration} (seconds) are substituted")
+	case "capture-keep":
+		fs.IntVar(&config.CaptureKeep, "capture-keep", 0, "With -capture-rotate, number of files per interface to keep (0 keeps all)")
+	case "preset":
+		fs.StringVar(&config.Preset, "preset", "", "Comma-separated filter presets to use instead of -tcpdump-filter: telemetry, overlay or protocol/transport pairs such as ipfix/tcp")
+	case "capture-pod":
+		fs.StringVar(&config.CapturePod, "capture-pod", "", "Capture inside the network namespace of the pod with this name prefix, which must run on this node (see -container)")
+	case "debug-image":
+		fs.StringVar(&config.DebugImage, "debug-image", "nicolaka/netshoot", "Image of the ephemeral debug container")
+	case "debug-command":
+		fs.StringVar(&config.DebugCommand, "debug-command", "", "Command to run in the debug container instead of an interactive shell")
+	case "webhook-url":
+		fs.StringVar(&config.WebhookURL, "webhook-url", "", "POST a JSON summary to this URL when the action finishes")
+	case "webhook-format":
+		fs.StringVar(&config.WebhookFormat, "webhook-format", "json", "Webhook payload format: json or slack")
+	case "webhook-timeout":
+		fs.DurationVar(&config.WebhookTimeout, "webhook-timeout", 10*time.Second, "Timeout of each webhook attempt")
+	case "serve-addr":
+		fs.StringVar(&config.ServeAddr, "serve-addr", "", "Serve the status report as JSON on this address, e.g. :8080, instead of printing it once")
+	case "mtu-target":
+		fs.StringVar(&config.MTUTarget, "mtu-target", "", "Host or IP to probe the path MTU to, from the first -pod pod if given, else from this host")
+	case "ip-log":
+		fs.StringVar(&config.IPLog, "ip-log", "ips.jsonl", "JSON-lines file record-ips appends its samples to")
+	case "ip-log-interval":
+		fs.DurationVar(&config.IPLogInterval, "ip-log-interval", time.Minute, "Time between the starts of two record-ips samples (at least 10s)")
+	case "ip-log-max-size":
+		byteSizeVar(fs, &config.IPLogMaxSize, "ip-log-max-size", 100<<20, "Rotate the -ip-log file into a timestamped one before it grows past this size (e.g. 10M)")
+	case "ip-log-keep":
+		fs.IntVar(&config.IPLogKeep, "ip-log-keep", 5, "Number of rotated -ip-log files to keep (0 keeps all)")
+	case "talker-threshold":
+		fs.IntVar(&config.TalkerThreshold, "talker-threshold", 0, "Alert when a sampling window sees more unique IPs than this")
+	case "endpoints-interval":
+		fs.DurationVar(&config.EndpointsInterval, "endpoints-interval", 2*time.Second, "How often watch-endpoints polls the service's endpoints")
+	case "resource-log":
+		fs.StringVar(&config.ResourceLog, "resource-log", "", "CSV file to record the CPU and memory usage of the -pod pods to during a capture or log collection, sampled with kubectl top")
+	case "resource-interval":
+		fs.DurationVar(&config.ResourceInterval, "resource-interval", 10*time.Second, "How often -resource-log samples resource usage")
+	case "timeline-match":
+		fs.StringVar(&config.TimelineMatch, "timeline-match", "(?i)error|warn|fail|drop|timeout", "Log lines to build the timeline around (regular expression, empty for the whole timeline)")
+	case "timeline-window":
+		fs.DurationVar(&config.TimelineWindow, "timeline-window", 2*time.Second, "Keep packets and log lines within this long of a matching log line")
+	case "pcap-file":
+		fs.StringVar(&config.PcapFile, "pcap-file", "", "Saved capture (pcap, or the pcapng of -merge) to analyze")
+	case "ip-allowlist":
+		fs.StringVar(&config.IPAllowlist, "ip-allowlist", "", "File of allowed IPs and CIDRs; discovered IPs outside of it are highlighted")
+	case "ip-allowlist-only-unknown":
+		fs.BoolVar(&config.OnlyUnknownIPs, "ip-allowlist-only-unknown", false, "With -ip-allowlist, only list the IPs it does not cover")
+	case "ip-format":
+		fs.StringVar(&config.IPFormat, "ip-format", ipFormatPlain, "Format of the IP list: plain, or csv, json or hosts written alone to stdout")
+	case "geoip-db":
+		fs.Var((*stringList)(&config.GeoIPDBs), "geoip-db", "Comma-separated MaxMind .mmdb files (e.g. GeoLite2-Country, GeoLite2-ASN) to annotate public IPs with")
+	case "ip-baseline":
+		fs.StringVar(&config.IPBaseline, "ip-baseline", "", "Previously saved IP sample (JSON report or ip,count CSV) to diff against")
+	case "json-indent":
+		fs.BoolVar(&config.JSONIndent, "json-indent", isTerminal(os.Stdout), "Indent JSON output (default on when stdout is a terminal)")
+	case "context":
+		fs.StringVar(&config.KubeContext, "context", "", "kubeconfig context to use for every kubectl command (default the current context)")
+	case "verbose":
+		fs.BoolVar(&config.Verbose, "verbose", false, "Print the cluster and API server kubectl talks to before running")
+	case "no-color":
+		fs.BoolVar(&config.NoColor, "no-color", false, "Disable colors and animated progress")
+	case "quiet":
+		fs.BoolVar(&config.Quiet, "quiet", false, "Do not print progress while actions run")
+	case "command-log":
+		fs.StringVar(&config.CommandLog, "command-log", "", "Append every command run (kubectl, tcpdump, systemctl...) with its start time, duration and exit status to this file")
+	case "progress-width":
+		fs.IntVar(&config.ProgressWidth, "progress-width", 0, "Width of progress bars in characters (default fit the terminal, or 40)")
+	case "progress-style":
+		fs.StringVar(&config.ProgressStyle, "progress-style", "ascii", "Progress bar characters: ascii or unicode")
+	case "completion":
+		fs.StringVar(&config.Completion, "completion", "", "Print a completion script for bash or zsh and exit")
+	case "shell":
+		fs.StringVar(&config.Shell, "shell", "", "Shell to install completion for: bash or zsh (default from $SHELL)")
+	case "action":
+		fs.StringVar(&config.Action, "action", "", "Run a single action (e.g. status, update-nodeport) instead of the menu")
+	default:
+		panic("unknown flag: " + name)
+	}
+}
+
+// commonFlags are accepted by every command
+var commonFlags = []string{"context", "verbose", "output", "json-indent", "no-color", "quiet",
+	"progress-width", "progress-style", "command-log", "webhook-url", "webhook-format", "webhook-timeout"}
+
+// command is a CLI subcommand with its own flag set
+type command struct {
+	name    string
+	aliases []string
+	summary string
+	flags   []string
+	run     func() Report
+}
+
+var commands = []command{
+	{
+		name:    "menu",
+		summary: "Interactive menu with all actions (default)",
+		flags: []string{
+			"action", "completion",
+			"pod", "container", "service", "target", "workload", "dependent-pods", "critical-pods", "wait", "wait-timeout",
+			"k3s-config", "nodeport-target", "nodeport-file", "nodeport-range", "k3s-ready-timeout", "keep-script", "temp-dir",
+			"interface", "tcpdump-filter", "tcpdump-filter-file", "preset", "direction", "ip-baseline", "ip-allowlist", "ip-allowlist-only-unknown",
+			"geoip-db", "ip-format", "capture-file", "merge", "split-by-port", "first-packet-per-flow",
+			"snaplen", "capture-buffer", "capture-count", "preview", "preview-count", "time-precision", "capture-rotate", "capture-keep", "min-free-space", "post-capture-hook",
+			"log-file", "log-append", "log-since", "since-last-restart", "log-follow", "log-grep", "log-grep-anchored", "log-stop-pattern", "redact", "redact-patterns",
+			"log-max-lines", "log-max-bytes", "verbose-config-path", "verbose-config-value", "resource-log", "resource-interval",
+			"selector", "yes", "force", "pcap-file", "talker-threshold", "capture-pod", "debug-image", "debug-command",
+		},
+		// run is nil: main starts the interactive menu
+	},
+	{
+		name:    "status",
+		summary: "Check pod and service status",
+		flags:   []string{"pod", "service", "target", "workload", "dependent-pods", "critical-pods", "wait", "wait-timeout", "k3s-config", "serve-addr"},
+		run:     runStatus,
+	},
+	{
+		name:    "nodeport",
+		aliases: []string{"update-nodeport"},
+		summary: "Update node port range and restart k3s",
+		flags:   []string{"k3s-config", "nodeport-target", "nodeport-file", "nodeport-range", "k3s-ready-timeout", "keep-script", "temp-dir", "yes", "force"},
+		run:     runNodePort,
+	},
+	{
+		name:    "revert-nodeport",
+		summary: "Restore the NodePort range from the backup of the last update and restart k3s",
+		flags:   []string{"k3s-config", "nodeport-target", "nodeport-file", "k3s-ready-timeout", "yes", "force"},
+		run:     runRevertNodePort,
+	},
+	{
+		name:    "ips",
+		summary: "View network packets source IP addresses",
+		flags: []string{"tcpdump-filter", "tcpdump-filter-file", "preset", "direction", "capture-buffer", "ip-baseline",
+			"ip-allowlist", "ip-allowlist-only-unknown", "geoip-db", "ip-format"},
+		run: runIPs,
+	},
+	{
+		name:    "watch-ips",
+		summary: "Sample unique IPs continuously and alert when they exceed -talker-threshold",
+		flags:   []string{"tcpdump-filter", "tcpdump-filter-file", "preset", "capture-buffer", "talker-threshold"},
+		run:     runWatchIPs,
+	},
+	{
+		name:    "record-ips",
+		summary: "Append a timestamped IP sample to a rotating JSON-lines file at every interval",
+		flags: []string{"tcpdump-filter", "tcpdump-filter-file", "preset", "direction", "capture-buffer",
+			"ip-log", "ip-log-interval", "ip-log-max-size", "ip-log-keep"},
+		run: runRecordIPs,
+	},
+	{
+		name:    "watch-endpoints",
+		summary: "Log every change of a service's ready endpoints until interrupted",
+		flags:   []string{"service", "target", "endpoints-interval"},
+		run:     runWatchEndpoints,
+	},
+	{
+		name:    "timeline",
+		summary: "Interleave the packets of a saved capture with a log file by timestamp around interesting log lines",
+		flags:   []string{"pcap-file", "log-file", "timeline-match", "timeline-window"},
+		run:     runTimeline,
+	},
+	{
+		name:    "replay",
+		summary: "Analyze the source IPs and flows of a saved capture file",
+		flags:   []string{"pcap-file", "ip-baseline", "ip-allowlist", "ip-allowlist-only-unknown", "geoip-db", "ip-format"},
+		run:     runReplay,
+	},
+	{
+		name:    "capture",
+		summary: "Capture network packets to file",
+		flags: []string{"interface", "tcpdump-filter", "tcpdump-filter-file", "preset", "direction", "capture-file", "merge", "split-by-port", "first-packet-per-flow", "snaplen",
+			"capture-buffer", "capture-count", "preview", "preview-count", "time-precision", "capture-rotate", "capture-keep", "min-free-space",
+			"post-capture-hook", "pod", "target", "capture-pod", "container", "resource-log", "resource-interval"},
+		run: runCapture,
+	},
+	{
+		name:    "logs",
+		summary: "Collect debug logs",
+		flags: []string{"pod", "target", "container", "log-file", "log-append", "log-since", "since-last-restart", "log-follow",
+			"log-grep", "log-grep-anchored", "log-stop-pattern", "redact", "redact-patterns", "log-max-lines", "log-max-bytes",
+			"verbose-config-path", "verbose-config-value", "resource-log", "resource-interval"},
+		run: runLogs,
+	},
+	{
+		name:    "restart-pod",
+		summary: "Restart pods by rolling out their deployment or deleting them",
+		flags:   []string{"pod", "target", "selector", "wait-timeout", "yes", "force"},
+		run:     runRestartPod,
+	},
+	{
+		name:    "debug",
+		summary: "Launch an ephemeral debug container in a pod and open a shell or run a command",
+		flags:   []string{"pod", "target", "container", "debug-image", "debug-command"},
+		run:     runDebug,
+	},
+	{
+		name:    "mtu",
+		summary: "Check interface and overlay MTUs and probe the path MTU to a target",
+		flags:   []string{"interface", "pod", "target", "container", "mtu-target"},
+		run:     runMTU,
+	},
+	{
+		name:    "connectivity",
+		summary: "Probe reachability between the main pod and dependent pods",
+		flags:   []string{"pod", "target", "dependent-pods"},
+		run:     runConnectivity,
+	},
+	{
+		name:    "preflight",
+		summary: "Verify kubectl, tcpdump, the k3s unit and output permissions",
+		flags:   []string{"k3s-config", "capture-file", "temp-dir"},
+		run:     runPreflight,
+	},
+	{
+		name:    "install-completion",
+		summary: "Install bash or zsh completion of the commands and flags",
+		flags:   []string{"shell"},
+		// run is set by main
+	},
+}
+
+// commandFlags returns the flags of cmd with their usage, as registered
+// for it, including the common flags
+func commandFlags(cmd command) []*flag.Flag {
+	// registering sets the flags' defaults in config
+	saved := config
+	defer func() { config = saved }()
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	for _, name := range append(cmd.flags, commonFlags...) {
+		registerFlag(fs, name)
+	}
+	var flags []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	return flags
+}
+
+// completionScript returns a completion script for shell, bash or zsh,
+// completing the commands and the flags of each for the program name
+func completionScript(shell, name string) (string, error) {
+	function := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	var b strings.Builder
+	switch shell {
+	case "bash":
+		var names []string
+		for _, cmd := range commands {
+			names = append(names, append([]string{cmd.name}, cmd.aliases...)...)
+		}
+		fmt.Fprintf(&b, "# bash completion for %s\n", name)
+		fmt.Fprintf(&b, "%s() {\n", function)
+		b.WriteString("    local cur=${COMP_WORDS[COMP_CWORD]} cmd=menu\n")
+		b.WriteString("    if [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then\n")
+		fmt.Fprintf(&b, "        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(names, " "))
+		b.WriteString("        return\n    fi\n")
+		b.WriteString("    [[ ${COMP_WORDS[1]} != -* ]] && cmd=${COMP_WORDS[1]}\n")
+		b.WriteString("    [[ $cur == -* ]] || return\n")
+		b.WriteString("    local flags\n    case $cmd in\n")
+		for _, cmd := range commands {
+			var flags []string
+			for _, f := range commandFlags(cmd) {
+				flags = append(flags, "-"+f.Name)
+			}
+			fmt.Fprintf(&b, "    %s) flags=\"%s\" ;;\n", strings.Join(append([]string{cmd.name}, cmd.aliases...), "|"), strings.Join(flags, " "))
+		}
+		b.WriteString("    esac\n")
+		b.WriteString("    COMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n}\n")
+		fmt.Fprintf(&b, "complete -o default -F %s %s\n", function, name)
+	case "zsh":
+		// entries are single-quoted, each name followed by a colon and its
+		// description, whose own colons are escaped
+		entry := func(name, description string) string {
+			return "'" + name + ":" + strings.NewReplacer("'", `'\''`, ":", `\:`).Replace(description) + "'"
+		}
+		fmt.Fprintf(&b, "#compdef %s\n\n", name)
+		fmt.Fprintf(&b, "%s() {\n", function)
+		b.WriteString("    local cmd=menu\n    local -a commands flags\n    commands=(\n")
+		for _, cmd := range commands {
+			for _, n := range append([]string{cmd.name}, cmd.aliases...) {
+				fmt.Fprintf(&b, "        %s\n", entry(n, cmd.summary))
+			}
+		}
+		b.WriteString("    )\n")
+		b.WriteString("    if (( CURRENT == 2 )) && [[ $PREFIX != -* ]]; then\n")
+		b.WriteString("        _describe command commands\n        return\n    fi\n")
+		b.WriteString("    [[ $words[2] != -* ]] && cmd=$words[2]\n")
+		b.WriteString("    case $cmd in\n")
+		for _, cmd := range commands {
+			fmt.Fprintf(&b, "    %s)\n        flags=(\n", strings.Join(append([]string{cmd.name}, cmd.aliases...), "|"))
+			for _, f := range commandFlags(cmd) {
+				fmt.Fprintf(&b, "            %s\n", entry("-"+f.Name, f.Usage))
+			}
+			b.WriteString("        ) ;;\n")
+		}
+		b.WriteString("    esac\n")
+		b.WriteString("    _describe flag flags\n}\n\n")
+		fmt.Fprintf(&b, "%s \"$@\"\n", function)
+	default:
+		return "", configError("unknown shell %q for completion (want bash or zsh)", shell)
+	}
+	return b.String(), nil
+}
+
+// runInstallCompletion writes the completion script for -shell, or the
+// login shell, where the shell loads completions from
+func runInstallCompletion() Report {
+	report := newReport("install-completion")
+	shell := config.Shell
+	if shell == "" {
+		shell = filepath.Base(os.Getenv("SHELL"))
+	}
+	name := filepath.Base(os.Args[0])
+	script, err := completionScript(shell, name)
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+
+	// bash-completion loads completions from here on demand
+	dir := filepath.Join(home, ".local", "share", "bash-completion", "completions")
+	if data := os.Getenv("XDG_DATA_HOME"); data != "" {
+		dir = filepath.Join(data, "bash-completion", "completions")
+	}
+	file := filepath.Join(dir, name)
+	if shell == "zsh" {
+		dir = filepath.Join(home, ".zsh", "completions")
+		file = filepath.Join(dir, "_"+name)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		report.fail(err)
+		return report
+	}
+	if err := os.WriteFile(file, []byte(script), 0644); err != nil {
+		report.fail(err)
+		return report
+	}
+	report.Files = append(report.Files, file)
+	if shell == "zsh" {
+		report.note("Add fpath=(%s $fpath) before compinit in ~/.zshrc if it is not there yet, then start a new shell", dir)
+	} else {
+		report.note("Start a new shell to use the completion (requires the bash-completion package)")
+	}
+	return report
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+		for _, alias := range commands[i].aliases {
+			if alias == name {
+				return &commands[i]
+			}
+		}
+	}
+	return nil
+}
+
+func printUsage() {
+	fmt.Printf("Usage: %s [command] [flags]\n", os.Args[0])
+	fmt.Printf("   or: %s -action <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		name := cmd.name
+		if len(cmd.aliases) > 0 {
+			name += " (" + strings.Join(cmd.aliases, ", ") + ")"
+		}
+		fmt.Printf("  %-28s %s\n", name, cmd.summary)
+	}
+	fmt.Printf("\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
+
+// parseCommand selects the subcommand from args and parses its flags. A menu
+// invocation with -action is resolved to the command it names.
+func parseCommand(args []string) *command {
+	name := "menu"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printUsage()
+		os.Exit(0)
+	}
+
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Printf("Error: unknown command %q\n\n", name)
+		printUsage()
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	for _, name := range append(cmd.flags, commonFlags...) {
+		registerFlag(fs, name)
+	}
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s %s [flags]\n\n%s\n\nFlags:\n", os.Args[0], cmd.name, cmd.summary)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	cliFlags = fs
+
+	if config.Completion != "" {
+		script, err := completionScript(config.Completion, filepath.Base(os.Args[0]))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(script)
+		os.Exit(0)
+	}
+
+	if config.ProgressWidth < 0 {
+		fmt.Println("Error: -progress-width must not be negative")
+		os.Exit(1)
+	}
+	if config.ProgressStyle != "" && config.ProgressStyle != "ascii" && config.ProgressStyle != "unicode" {
+		fmt.Printf("Error: unknown -progress-style %q (want ascii or unicode)\n", config.ProgressStyle)
+		os.Exit(1)
+	}
+	if config.WebhookFormat != "" && config.WebhookFormat != "json" && config.WebhookFormat != "slack" {
+		fmt.Printf("Error: unknown -webhook-format %q (want json or slack)\n", config.WebhookFormat)
+		os.Exit(1)
+	}
+	if !validFormat(config.Output) {
+		fmt.Printf("Error: unknown output format %q (want text, json, markdown or oneline)\n", config.Output)
+		os.Exit(1)
+	}
+	if config.Output != formatText {
+		ui = os.Stderr
+	}
+	if config.LogFile == "-" && config.CaptureFile == "-" {
+		fmt.Println("Error: -log-file - cannot be combined with -capture-file -")
+		os.Exit(1)
+	}
+	if config.LogFile == "-" {
+		// like -capture-file -, stdout is reserved for the collected logs
+		logStdout = os.Stdout
+		os.Stdout = os.Stderr
+		ui = os.Stderr
+	}
+	if config.CaptureFile == "-" {
+		streamCaptureToStdout()
+	}
+	switch config.IPFormat {
+	case "", ipFormatPlain:
+	case ipFormatCSV, ipFormatJSON, ipFormatHosts:
+		if pcapStdout != nil {
+			fmt.Println("Error: -ip-format cannot be combined with -capture-file -")
+			os.Exit(1)
+		}
+		if logStdout != nil {
+			fmt.Println("Error: -ip-format cannot be combined with -log-file -")
+			os.Exit(1)
+		}
+		// like -capture-file -, stdout is reserved for the IP list
+		ipStdout = os.Stdout
+		os.Stdout = os.Stderr
+		ui = os.Stderr
+	default:
+		fmt.Printf("Error: unknown -ip-format %q (want plain, csv, json or hosts)\n", config.IPFormat)
+		os.Exit(1)
+	}
+	setupTerminal()
+	if config.CommandLog != "" {
+		openCommandLog(config.CommandLog)
+	}
+
+	if config.ResourceInterval < 0 || config.ResourceLog != "" && config.ResourceInterval == 0 {
+		fmt.Println("Error: -resource-interval must be positive")
+		os.Exit(1)
+	}
+	if err := applyTargets(fs); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if config.Preset != "" {
+		if flagWasSet(fs, "tcpdump-filter") {
+			fmt.Println("Error: -preset and -tcpdump-filter cannot be combined")
+			os.Exit(1)
+		}
+		if config.TcpdumpFilterFile != "" {
+			fmt.Println("Error: -preset and -tcpdump-filter-file cannot be combined")
+			os.Exit(1)
+		}
+		filter, err := presetFilter(config.Preset)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		config.TcpdumpFilter = filter
+		if !config.Quiet {
+			fmt.Fprintf(ui, "Using filter preset %s:\n", config.Preset)
+			ports, _ := presetPorts(config.Preset)
+			for _, port := range ports {
+				if port.Port == 0 {
+					fmt.Fprintf(ui, "  %-10s all %s traffic\n", port.Transport, strings.ToUpper(port.Transport))
+					continue
+				}
+				fmt.Fprintf(ui, "  %-10s %s\n", fmt.Sprintf("%s/%d", port.Transport, port.Port), portNames[port.Port])
+			}
+		}
+	}
+
+	if config.TcpdumpFilterFile != "" {
+		loadFilterFile(fs)
+	}
+	if flagWasSet(fs, "tcpdump-filter") || config.Preset != "" || config.TcpdumpFilterFile != "" {
+		for _, warning := range netmon.FilterWarnings(config.TcpdumpFilter) {
+			fmt.Fprintf(ui, "%sWarning: capture filter: %s%s\n", colorYellow, warning, colorReset)
+		}
+	}
+
+	if config.Snaplen < 0 {
+		fmt.Println("Error: -snaplen must be 0 or a positive number of bytes")
+		os.Exit(1)
+	}
+	if config.CaptureBuffer < 0 || flagWasSet(fs, "capture-buffer") && config.CaptureBuffer == 0 {
+		fmt.Println("Error: -capture-buffer must be a positive number of KB")
+		os.Exit(1)
+	}
+	if config.CaptureCount < 0 || flagWasSet(fs, "capture-count") && config.CaptureCount == 0 {
+		fmt.Println("Error: -capture-count must be a positive number of packets")
+		os.Exit(1)
+	}
+	if config.PreviewCount <= 0 && flagWasSet(fs, "preview-count") {
+		fmt.Println("Error: -preview-count must be a positive number of packets")
+		os.Exit(1)
+	}
+	if config.CaptureCount > 0 && config.CaptureRotate > 0 {
+		fmt.Println("Error: -capture-count cannot be combined with -capture-rotate")
+		os.Exit(1)
+	}
+	switch config.Direction {
+	case "", netmon.DirectionIn, netmon.DirectionOut, netmon.DirectionBoth:
+	default:
+		fmt.Printf("Error: unknown -direction %q (want in, out or both)\n", config.Direction)
+		os.Exit(1)
+	}
+	if config.TimePrecision != "" && config.TimePrecision != "micro" && config.TimePrecision != "nano" {
+		fmt.Printf("Error: unknown -time-precision %q (want micro or nano)\n", config.TimePrecision)
+		os.Exit(1)
+	}
+	if _, err := newGrepWriter(nil, config.LogGrep, config.LogGrepAnchored); config.LogGrep != "" && err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if _, err := newStopWriter(nil, config.LogStopPattern); config.LogStopPattern != "" && err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if config.SinceLastRestart && config.LogSince > 0 {
+		fmt.Println("Error: -since-last-restart cannot be combined with -log-since")
+		os.Exit(1)
+	}
+	if config.RedactPatterns != "" {
+		if _, err := loadRedactions(config.RedactPatterns); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if config.PostCaptureHook != "" {
+		if _, err := hookCommand(config.PostCaptureHook, nil); err != nil {
+			fmt.Printf("Error: -post-capture-hook: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	for _, pod := range config.CriticalPods {
+		if !containsString(config.DependentPods, pod) {
+			fmt.Printf("Error: -critical-pods %s is not one of -dependent-pods\n", pod)
+			os.Exit(1)
+		}
+	}
+	if config.CaptureKeep != 0 && config.CaptureRotate <= 0 {
+		fmt.Println("Error: -capture-keep requires -capture-rotate")
+		os.Exit(1)
+	}
+
+	if config.KubeContext != "" {
+		useKubeContext()
+	}
+	if config.Verbose {
+		if cluster, err := netmon.CurrentCluster(context.Background()); err != nil {
+			fmt.Fprintf(ui, "%sCould not determine the kubectl cluster: %v%s\n", colorYellow, err, colorReset)
+		} else {
+			fmt.Fprintf(ui, "Using kubectl context %s: cluster %s at %s\n", cluster.Context, cluster.Name, cluster.Server)
+		}
+	}
+
+	if config.Action != "" {
+		cmd = findCommand(config.Action)
+		if cmd == nil || cmd.name == "menu" {
+			fmt.Printf("Error: unknown action %q\n\n", config.Action)
+			printUsage()
+			os.Exit(1)
+		}
+	}
+	return cmd
+}
+
+// streamCaptureToStdout reserves stdout for the pcap stream of -capture-file -.
+// Progress, the report and any stray print go to stderr instead, so text can
+// never corrupt the stream.
+func streamCaptureToStdout() {
+	if isTerminal(os.Stdout) {
+		fmt.Println("Error: -capture-file - writes a binary pcap stream; pipe it, e.g. into wireshark -k -i -")
+		os.Exit(1)
+	}
+	switch {
+	case len(config.Interfaces) > 1:
+		fmt.Println("Error: -capture-file - captures a single -interface")
+		os.Exit(1)
+	case config.MergeCaptures:
+		fmt.Println("Error: -merge cannot be combined with -capture-file -")
+		os.Exit(1)
+	case config.CaptureRotate > 0:
+		fmt.Println("Error: -capture-rotate cannot be combined with -capture-file -")
+		os.Exit(1)
+	case config.PostCaptureHook != "":
+		fmt.Println("Error: -post-capture-hook cannot be combined with -capture-file -")
+		os.Exit(1)
+	case config.SplitByPort:
+		fmt.Println("Error: -split-by-port cannot be combined with -capture-file -")
+		os.Exit(1)
+	case config.FirstPacketPerFlow:
+		fmt.Println("Error: -first-packet-per-flow cannot be combined with -capture-file -")
+		os.Exit(1)
+	}
+	pcapStdout = os.Stdout
+	os.Stdout = os.Stderr
+	ui = os.Stderr
+}
+
+// openCommandLog appends every command run from now on to path
+func openCommandLog(path string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Printf("Error: opening -command-log: %v\n", err)
+		os.Exit(1)
+	}
+	netmon.CommandLog = f
+}
+
+// useKubeContext makes every kubectl command use -context after checking
+// that the kubeconfig defines it
+func useKubeContext() {
+	contexts, err := netmon.KubeContexts(context.Background())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	found := false
+	for _, name := range contexts {
+		found = found || name == config.KubeContext
+	}
+	if !found {
+		fmt.Printf("Error: kubectl context %q does not exist (available: %s)\n", config.KubeContext, strings.Join(contexts, ", "))
+		os.Exit(1)
+	}
+	netmon.KubeContext = config.KubeContext
+}
+
+// loadFilterFile sets the tcpdump filter from -tcpdump-filter-file, unless
+// -tcpdump-filter was given, after checking that tcpdump can compile it
+func loadFilterFile(fs *flag.FlagSet) {
+	if flagWasSet(fs, "tcpdump-filter") {
+		fmt.Fprintf(ui, "%sIgnoring -tcpdump-filter-file since -tcpdump-filter was given%s\n", colorYellow, colorReset)
+		return
+	}
+
+	filter, err := netmon.LoadFilterFile(config.TcpdumpFilterFile)
+	if err == nil {
+		err = netmon.ValidateFilter(context.Background(), filter)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	config.TcpdumpFilter = filter
+	if !config.Quiet {
+		fmt.Fprintf(ui, "Using filter from %s: %s\n", config.TcpdumpFilterFile, filter)
+	}
+}
+
+// flagWasSet reports whether the named flag was given on the command line
+func flagWasSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// targetKinds maps the kinds -target accepts, with kubectl's plural and
+// short names, to the flag a target of that kind adds to
+var targetKinds = map[string]string{
+	"pod": "pod", "pods": "pod", "po": "pod",
+	"service": "service", "services": "service", "svc": "service",
+	"daemonset": "workload", "daemonsets": "workload", "ds": "workload",
+	"statefulset": "workload", "statefulsets": "workload", "sts": "workload",
+	"deployment": "workload", "deployments": "workload", "deploy": "workload",
+}
+
+// parseTarget splits a kubectl-style kind/name target such as pod/myapp-xyz
+// or svc/myservice, returning the kind as the flag it stands for
+func parseTarget(s string) (kind, name string, err error) {
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return "", "", fmt.Errorf("target %q is not kind/name, e.g. pod/%s or svc/%s", s, s, s)
+	}
+	kind, ok := targetKinds[strings.ToLower(s[:i])]
+	if !ok {
+		return "", "", fmt.Errorf("target %q has unknown kind %q (want pod, svc, daemonset, statefulset or deployment)", s, s[:i])
+	}
+	name = s[i+1:]
+	if name == "" || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("target %q has no valid name after %s/", s, s[:i])
+	}
+	return kind, name, nil
+}
+
+// applyTargets adds the -target pods to -pod, its service to -service and
+// its workloads to -workload, so the checks and actions see them as if given
+// with those flags
+func applyTargets(fs *flag.FlagSet) error {
+	pods := append([]string(nil), config.Pods...)
+	workloads := append([]string(nil), config.Workloads...)
+	var services []string
+	for _, target := range config.Targets {
+		kind, name, err := parseTarget(target)
+		if err != nil {
+			return err
+		}
+		if fs.Lookup(kind) == nil {
+			return fmt.Errorf("%s takes no %s target: %s", fs.Name(), kind, target)
+		}
+		switch kind {
+		case "pod":
+			pods = append(pods, name)
+		case "service":
+			services = append(services, name)
+		case "workload":
+			workloads = append(workloads, target)
+		}
+	}
+	if config.ServiceName != "" {
+		services = append([]string{config.ServiceName}, services...)
+	}
+	if len(services) > 1 {
+		return fmt.Errorf("only one service can be monitored, got %s", strings.Join(services, ", "))
+	}
+	if len(pods) > len(config.Pods) {
+		fs.Set("pod", strings.Join(pods, ","))
+	}
+	if len(workloads) > len(config.Workloads) {
+		fs.Set("workload", strings.Join(workloads, ","))
+	}
+	for _, workload := range config.Workloads {
+		if _, err := netmon.ParseWorkload(workload); err != nil {
+			return err
+		}
+	}
+	if len(services) == 1 && config.ServiceName == "" {
+		fs.Set("service", services[0])
+	}
+	return nil
+}
+
+// requireFlags checks that every named flag was given a value, so each action
+// only demands the flags it actually uses
+func requireFlags(names ...string) error {
+	var missing []string
+	for _, name := range names {
+		if f := cliFlags.Lookup(name); f == nil || f.Value.String() == "" {
+			missing = append(missing, "-"+name)
+		}
+	}
+	if len(missing) > 0 {
+		return configError("required flags %s must be provided", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// netmonConfig returns the library configuration for the parsed flags and
+// the terminal chosen by setupTerminal
+func netmonConfig() netmon.Config {
+	c := netmon.Config{
+		Interfaces:         config.Interfaces,
+		TcpdumpFilter:      config.TcpdumpFilter,
+		CaptureFile:        config.CaptureFile,
+		CaptureRotate:      config.CaptureRotate,
+		CaptureKeep:        config.CaptureKeep,
+		MinFreeSpace:       uint64(config.MinFreeSpace),
+		Snaplen:            config.Snaplen,
+		CaptureBuffer:      config.CaptureBuffer,
+		CaptureCount:       config.CaptureCount,
+		SplitByPort:        config.SplitByPort,
+		FirstPacketPerFlow: config.FirstPacketPerFlow,
+		TimePrecision:      config.TimePrecision,
+		Direction:          config.Direction,
+		Wait:               config.Wait,
+		WaitTimeout:        config.WaitTimeout,
+		Output:             ui,
+		Color:              colorReset != "",
+		Interactive:        interactive,
+		Quiet:              config.Quiet,
+		ProgressWidth:      config.ProgressWidth,
+		ProgressStyle:      config.ProgressStyle,
+	}
+	if pcapStdout != nil {
+		c.CaptureWriter = pcapStdout
+	}
+	return c
+}
+
+func printProgress(current, total int, prefix string) {
+	netmonConfig().Progress(current, total, prefix)
+}
+
+// clearStatusLine erases an in-place status line before a result is printed
+func clearStatusLine() {
+	netmonConfig().ClearStatusLine()
+}
+
+// startSpinner shows message with a spinner while work runs, until ctx is
+// canceled or the returned stop is called. stop returns once the spinner
+// line is finished, so output that follows starts on a new line.
+func startSpinner(ctx context.Context, message string) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		printSpinner(ctx, message)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// printSpinner animates message with the time spent so far until ctx is
+// done. Without a terminal it prints message once.
+func printSpinner(ctx context.Context, message string) {
+	spinChars := []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+	if !interactive {
+		if !config.Quiet {
+			fmt.Fprintf(ui, "%s...\n", message)
+		}
+		<-ctx.Done()
+		return
+	}
+
+	startTime := time.Now()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		fmt.Fprintf(ui, "\r%s %s (%ds)", spinChars[i%len(spinChars)], message, int(time.Since(startTime).Seconds()))
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(ui)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stdin is shared by every prompt so that buffered piped input is not lost
+// between reads
+var stdin = bufio.NewReader(os.Stdin)
+
+// inputLine is a line read from stdin with its read error
+type inputLine struct {
+	text string
+	err  error
+}
+
+// pendingInput is a read of stdin that was still waiting when quitOnKey
+// stopped watching; readLine takes its line instead of reading again
+var (
+	pendingInput   chan inputLine
+	pendingInputMu sync.Mutex
+)
+
+// readLine reads one line of input. io.EOF is only returned once the input
+// is exhausted, so a final line without a newline is still returned.
+func readLine() (string, error) {
+	pendingInputMu.Lock()
+	pending := pendingInput
+	pendingInput = nil
+	pendingInputMu.Unlock()
+	if pending != nil {
+		line := <-pending
+		return line.text, line.err
+	}
+	return readStdinLine()
+}
+
+func readStdinLine() (string, error) {
+	line, err := stdin.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimSpace(line), err
+}
+
+// quitReason is the stop reason of actions stopped with q
+const quitReason = "stopped with q"
+
+// quitOnKey returns a context that is also canceled when q and Enter are
+// typed on a terminal, to end a long-running action early without exiting.
+// Other lines are passed to onLine when it is set. stop ends watching the
+// keyboard and reports whether q was typed.
+func quitOnKey(parent context.Context, onLine func(text string)) (ctx context.Context, stop func() (quit bool)) {
+	ctx, cancel := context.WithCancel(parent)
+	if !isTerminal(os.Stdin) {
+		return ctx, func() bool {
+			cancel()
+			return false
+		}
+	}
+	fmt.Fprintf(ui, "%sPress q and Enter to stop early%s\n", colorCyan, colorReset)
+	return ctx, watchQuitKey(ctx, cancel, onLine)
+}
+
+// watchQuitKey reads stdin until q is typed, which calls cancel, or until
+// the returned stop is called, passing other lines to onLine if not nil. A
+// line being read when stop is called is left for the next prompt, e.g. the
+// menu's "Press Enter to continue".
+func watchQuitKey(ctx context.Context, cancel context.CancelFunc, onLine func(text string)) (stop func() (quit bool)) {
+	done := make(chan struct{})
+	var quit bool
+	go func() {
+		defer close(done)
+		for {
+			read := make(chan inputLine, 1)
+			go func() {
+				text, err := readStdinLine()
+				read <- inputLine{text, err}
+			}()
+			select {
+			case line := <-read:
+				if line.err != nil {
+					return
+				}
+				if strings.EqualFold(line.text, "q") {
+					quit = true
+					cancel()
+					return
+				}
+				if onLine != nil {
+					onLine(line.text)
+				}
+			case <-ctx.Done():
+				pendingInputMu.Lock()
+				pendingInput = read
+				pendingInputMu.Unlock()
+				return
+			}
+		}
+	}()
+	return func() bool {
+		cancel()
+		<-done
+		return quit
+	}
+}
+
+// confirm asks the user to approve a disruptive action unless -yes or -force
+// was given. Anything but y or yes, including exhausted stdin, declines.
+func confirm(question string) error {
+	if config.Yes {
+		return nil
+	}
+	fmt.Fprintf(ui, "%s%s Continue? [y/N]%s ", colorYellow, question, colorReset)
+	answer, err := readLine()
+	if err == io.EOF {
+		fmt.Fprintln(ui)
+		return configError("no confirmation on stdin, rerun with -yes to proceed non-interactively")
+	}
+	if err != nil {
+		return err
+	}
+	if answer := strings.ToLower(answer); answer != "y" && answer != "yes" {
+		return errors.New("aborted, nothing was changed")
+	}
+	return nil
+}
+
+// confirmStart prints a one-line summary of a long-running action before it
+// starts so a wrong pod or filter is caught early. With ask, on a terminal
+// and without -yes, it also waits for Enter; n cancels the action.
+func confirmStart(summary string, ask bool) error {
+	fmt.Fprintf(ui, "%s%s%s\n", colorCyan, summary, colorReset)
+	if !ask || config.Yes || !isTerminal(os.Stdin) {
+		return nil
+	}
+	fmt.Fprintf(ui, "%sPress Enter to start, or n to cancel:%s ", colorYellow, colorReset)
+	answer, err := readLine()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if answer := strings.ToLower(answer); answer == "n" || answer == "no" {
+		return errors.New("canceled, nothing was started")
+	}
+	return nil
+}
+
+func showMenu() (string, error) {
+	fmt.Printf("\n%sNetwork Monitoring Debug Tool - Available Options%s\n", colorCyan, colorReset)
+	fmt.Println("------------------------------------------------")
+	fmt.Println("1. Check pod and service status")
+	fmt.Println("2. Update node port range and restart k3s")
+	fmt.Println("3. View network packets source IP addresses")
+	fmt.Println("4. Capture network packets to file")
+	fmt.Println("5. Collect debug logs")
+	fmt.Println("6. Restart pod or deployment")
+	fmt.Println("7. Change capture filter")
+	fmt.Println("8. Launch debug container")
+	fmt.Println("9. Select target pod")
+	fmt.Println("10. Select target service")
+	fmt.Println("11. Exit")
+	fmt.Printf("\n%sEnter your choice (1-11):%s ", colorYellow, colorReset)
+
+	return readLine()
+}
+func copyFile(src, dst string) error {
+	sourceFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	destFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	_, err = io.Copy(destFile, sourceFile)
+	return err
+}
+
+// nodePortStrategy describes where a distribution configures the NodePort
+// range and how a change to it is applied
+type nodePortStrategy struct {
+	defaultPath string
+	// backupPath is where the original file is saved, next to it by default
+	backupPath func(path string) string
+	// check, when set, vets the file before anything is changed
+	check   func(content string) error
+	current func(content string) string
+	// update returns the file's content with the range set
+	update func(content, nodeRange string) (string, error)
+	// apply writes the updated content to path and makes it take effect
+	apply func(path, updated string) error
+	// restart makes an edited file take effect, e.g. when a backup is
+	// restored
+	restart func() error
+	// disruption warns what applying the change interrupts
+	disruption string
+}
+
+// nodePortStrategies are the values accepted by -nodeport-target
+var nodePortStrategies = map[string]nodePortStrategy{
+	"k3s-unit": {
+		defaultPath: k3sConfigFile,
+		check:       checkK3sServerUnit,
+		current:     configuredNodePortRange,
+		update:      setUnitNodePortRange,
+		apply:       applyK3sUnit,
+		restart:     func() error { return restartK3s(true) },
+		disruption:  "This will restart k3s and briefly disrupt the API server.",
+	},
+	"k3s-config": {
+		defaultPath: "/etc/rancher/k3s/config.yaml",
+		current:     configuredYAMLNodePortRange,
+		update: func(content, nodeRange string) (string, error) {
+			return setK3sConfigNodePortRange(content, nodeRange), nil
+		},
+		apply:      applyK3sConfigFile,
+		restart:    func() error { return restartK3s(false) },
+		disruption: "This will restart k3s and briefly disrupt the API server.",
+	},
+	"apiserver-manifest": {
+		defaultPath: "/etc/kubernetes/manifests/kube-apiserver.yaml",
+		// kubelet loads every file in the manifests directory, so the
+		// backup must live outside of it
+		backupPath: func(path string) string {
+			return filepath.Join(filepath.Dir(filepath.Dir(path)), filepath.Base(path)+".bak")
+		},
+		current:    configuredYAMLNodePortRange,
+		update:     setManifestNodePortRange,
+		apply:      applyAPIServerManifest,
+		restart:    waitForAPIServerManifest,
+		disruption: "This will make kubelet restart the API server, briefly disrupting it.",
+	},
+}
+
+// execStartArg is one argument of a unit's ExecStart command along with
+// where it sits in the unit file
+type execStartArg struct {
+	value      string
+	start, end int
+	// quote is the quote character the argument was written with, if any
+	quote byte
+}
+
+var execStartLineRegex = regexp.MustCompile(`(?m)^[ \t]*ExecStart=`)
+
+// parseExecStart splits the ExecStart command of a systemd unit into its
+// arguments, following systemd's quoting and backslash line continuations
+func parseExecStart(unit string) ([]execStartArg, error) {
+	loc := execStartLineRegex.FindStringIndex(unit)
+	if loc == nil {
+		return nil, errors.New("no ExecStart line found")
+	}
+
+	var args []execStartArg
+	i := loc[1]
+	for i < len(unit) {
+		switch c := unit[i]; {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+		case c == '\\' && strings.HasPrefix(unit[i+1:], "\n"):
+			i += 2
+			continue
+		case c == '\n':
+			return args, nil
+		case c == '\'' || c == '"':
+			end := i + 1
+			var value strings.Builder
+			for end < len(unit) && unit[end] != c {
+				if unit[end] == '\\' && c == '"' && end+1 < len(unit) {
+					end++
+				}
+				value.WriteByte(unit[end])
+				end++
+			}
+			if end == len(unit) {
+				return nil, fmt.Errorf("unterminated %c quote in ExecStart", c)
+			}
+			args = append(args, execStartArg{value: value.String(), start: i, end: end + 1, quote: c})
+			i = end + 1
+			continue
+		}
+
+		end := i
+		for end < len(unit) && !strings.ContainsRune(" \t\n", rune(unit[end])) &&
+			!(unit[end] == '\\' && strings.HasPrefix(unit[end+1:], "\n")) {
+			end++
+		}
+		args = append(args, execStartArg{value: unit[i:end], start: i, end: end})
+		i = end
+	}
+	return args, nil
+}
+
+// k3sRole returns the k3s subcommand, "server" or "agent", run by an
+// ExecStart command, or "" if there is none
+func k3sRole(args []execStartArg) string {
+	for _, arg := range args {
+		switch arg.value {
+		case "server", "agent":
+			return arg.value
+		}
+	}
+	return ""
+}
+
+// checkK3sServerUnit refuses to edit anything but a k3s server unit, since
+// the NodePort range is an API server setting that an agent does not accept
+func checkK3sServerUnit(unit string) error {
+	args, err := parseExecStart(unit)
+	if err != nil {
+		return err
+	}
+	switch k3sRole(args) {
+	case "server":
+		return nil
+	case "agent":
+		return configError("this node runs a k3s agent; the NodePort range can only be set on a k3s server node")
+	}
+	return configError("no k3s server command found in the unit's ExecStart")
+}
+
+const nodePortRangeArg = "--service-node-port-range"
+
+// nodePortRangeValue returns the index of the argument holding the NodePort
+// range and the range itself, or -1 if the range is not set. Both the
+// --flag=value and the --flag value forms are recognised.
+func nodePortRangeValue(args []execStartArg) (int, string) {
+	for i, arg := range args {
+		if strings.HasPrefix(arg.value, nodePortRangeArg+"=") {
+			return i, strings.TrimPrefix(arg.value, nodePortRangeArg+"=")
+		}
+		if arg.value == nodePortRangeArg && i+1 < len(args) {
+			return i + 1, args[i+1].value
+		}
+	}
+	return -1, ""
+}
+
+// quoteArg writes value the way another ExecStart argument was written
+func quoteArg(value string, like execStartArg) string {
+	if like.quote == 0 {
+		return value
+	}
+	return string(like.quote) + value + string(like.quote)
+}
+
+// setUnitNodePortRange sets the --service-node-port-range argument of the
+// unit's ExecStart, replacing the existing value or appending the argument
+// after the last one. Every other argument and the unit's layout are kept.
+func setUnitNodePortRange(unit, nodeRange string) (string, error) {
+	args, err := parseExecStart(unit)
+	if err != nil {
+		return "", err
+	}
+	if len(args) == 0 {
+		return "", errors.New("empty ExecStart command")
+	}
+
+	if i, _ := nodePortRangeValue(args); i >= 0 {
+		arg := args[i]
+		value := nodeRange
+		if strings.HasPrefix(arg.value, nodePortRangeArg+"=") {
+			value = nodePortRangeArg + "=" + nodeRange
+		}
+		return unit[:arg.start] + quoteArg(value, arg) + unit[arg.end:], nil
+	}
+
+	last := args[len(args)-1]
+	added := " " + quoteArg(nodePortRangeArg+"="+nodeRange, last)
+	// the installer puts each argument on its own continuation line, so
+	// follow that layout when the command already spans several lines
+	if first := args[0]; strings.Contains(unit[first.start:last.start], "\\\n") {
+		lineStart := strings.LastIndex(unit[:last.start], "\n") + 1
+		indent := unit[lineStart:last.start]
+		added = " \\\n" + indent + quoteArg(nodePortRangeArg+"="+nodeRange, last)
+	}
+	return unit[:last.end] + added + unit[last.end:], nil
+}
+
+// configuredNodePortRange returns the NodePort range set in the unit's
+// ExecStart, or "" if none is set
+func configuredNodePortRange(unit string) string {
+	args, err := parseExecStart(unit)
+	if err != nil {
+		return ""
+	}
+	_, nodeRange := nodePortRangeValue(args)
+	return nodeRange
+}
+
+var (
+	yamlNodePortRangeRegex     = regexp.MustCompile(`service-node-port-range["']?\s*[:=]\s*["']?(\d+-\d+)`)
+	k3sConfigNodePortLineRegex = regexp.MustCompile(`(?m)^service-node-port-range:.*$`)
+	manifestNodePortArgRegex   = regexp.MustCompile(`(?m)^(\s*-\s*)--service-node-port-range=\S+`)
+	manifestAPIServerRegex     = regexp.MustCompile(`(?m)^(\s*-\s*)kube-apiserver\s*$`)
+)
+
+// configuredYAMLNodePortRange returns the NodePort range set in a k3s
+// config.yaml or a kube-apiserver manifest, or "" if none is set
+func configuredYAMLNodePortRange(content string) string {
+	if m := yamlNodePortRangeRegex.FindStringSubmatch(content); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// setK3sConfigNodePortRange sets the service-node-port-range key of a k3s
+// config.yaml, adding it when missing
+func setK3sConfigNodePortRange(content, nodeRange string) string {
+	line := fmt.Sprintf("service-node-port-range: %q", nodeRange)
+	if k3sConfigNodePortLineRegex.MatchString(content) {
+		return k3sConfigNodePortLineRegex.ReplaceAllLiteralString(content, line)
+	}
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content + line + "\n"
+}
+
+// setManifestNodePortRange sets --service-node-port-range in the command of
+// a kube-apiserver static pod manifest, adding it after kube-apiserver itself
+// when missing
+func setManifestNodePortRange(content, nodeRange string) (string, error) {
+	if manifestNodePortArgRegex.MatchString(content) {
+		return manifestNodePortArgRegex.ReplaceAllString(content, "${1}--service-node-port-range="+nodeRange), nil
+	}
+	loc := manifestAPIServerRegex.FindStringSubmatchIndex(content)
+	if loc == nil {
+		return "", errors.New("kube-apiserver command not found in manifest")
+	}
+	arg := "\n" + content[loc[2]:loc[3]] + "--service-node-port-range=" + nodeRange
+	return content[:loc[1]] + arg + content[loc[1]:], nil
+}
+
+// nodePortTargetPath returns the file edited for a strategy: -nodeport-file
+// when given, else -k3s-config for the k3s unit and the strategy's default
+// path for the others
+func nodePortTargetPath(target string, strategy nodePortStrategy) string {
+	switch {
+	case config.NodePortFile != "":
+		return config.NodePortFile
+	case target == "k3s-unit":
+		return config.K3sConfigFile
+	}
+	return strategy.defaultPath
+}
+
+// updateNodePortRange applies config.NodePortRange to the configured
+// -nodeport-target and restarts what is needed. It reports false without
+// touching anything when the range is already configured.
+func updateNodePortRange() (bool, error) {
+	strategy, ok := nodePortStrategies[config.NodePortTarget]
+	if !ok {
+		return false, configError("unknown NodePort target %q (want k3s-unit, k3s-config or apiserver-manifest)",
+			config.NodePortTarget)
+	}
+	path := nodePortTargetPath(config.NodePortTarget, strategy)
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, configError("%s target file %s does not exist", config.NodePortTarget, path)
+	}
+	if err != nil {
+		return false, fmt.Errorf("reading %s: %v", path, err)
+	}
+	if strategy.check != nil {
+		if err := strategy.check(string(content)); err != nil {
+			return false, err
+		}
+	}
+	if strategy.current(string(content)) == config.NodePortRange {
+		return false, nil
+	}
+	updated, err := strategy.update(string(content), config.NodePortRange)
+	if err != nil {
+		return false, fmt.Errorf("updating %s: %v", path, err)
+	}
+	fmt.Fprintf(ui, "Changing the NodePort range in %s from %s to %s:\n",
+		path, rangeOrDefault(strategy.current(string(content))), config.NodePortRange)
+	printDiff(path, path+" (updated)", string(content), updated)
+	if err := confirm(strategy.disruption); err != nil {
+		return false, err
+	}
+
+	fmt.Fprintf(ui, "Updating NodePort range in %s to %s...\n", path, config.NodePortRange)
+
+	backupFile := nodePortBackupPath(strategy, path)
+	if err := copyFile(path, backupFile); err != nil {
+		return false, fmt.Errorf("backing up %s: %v", path, err)
+	}
+
+	return true, strategy.apply(path, updated)
+}
+
+// nodePortBackupPath returns where updateNodePortRange saves the original
+// of path
+func nodePortBackupPath(strategy nodePortStrategy, path string) string {
+	if strategy.backupPath != nil {
+		return strategy.backupPath(path)
+	}
+	return path + ".bak"
+}
+
+// revertNodePortRange restores the file of the configured -nodeport-target
+// from the backup updateNodePortRange left, after showing how the two differ
+// and asking, and restarts what is needed. It returns the restored range.
+func revertNodePortRange() (string, error) {
+	strategy, ok := nodePortStrategies[config.NodePortTarget]
+	if !ok {
+		return "", configError("unknown NodePort target %q (want k3s-unit, k3s-config or apiserver-manifest)",
+			config.NodePortTarget)
+	}
+	path := nodePortTargetPath(config.NodePortTarget, strategy)
+	backupFile := nodePortBackupPath(strategy, path)
+
+	backup, err := os.ReadFile(backupFile)
+	if os.IsNotExist(err) {
+		return "", configError("no backup %s found; nothing to revert", backupFile)
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %v", backupFile, err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %v", path, err)
+	}
+	restored := strategy.current(string(backup))
+	if string(content) == string(backup) {
+		return restored, errNothingToRevert
+	}
+
+	fmt.Fprintf(ui, "Restoring %s from %s (NodePort range %s -> %s):\n",
+		path, backupFile, rangeOrDefault(strategy.current(string(content))), rangeOrDefault(restored))
+	printDiff(path, backupFile, string(content), string(backup))
+	if err := confirm(strategy.disruption); err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, backup, info.Mode().Perm()); err != nil {
+		return "", fmt.Errorf("writing %s: %v", path, err)
+	}
+	return restored, strategy.restart()
+}
+
+// errNothingToRevert is returned by revertNodePortRange when the file
+// already matches its backup
+var errNothingToRevert = errors.New("the file already matches its backup")
+
+// rangeOrDefault describes a configured NodePort range, "" meaning none is
+// set and the API server's default applies
+func rangeOrDefault(nodeRange string) string {
+	if nodeRange == "" {
+		return "default"
+	}
+	return nodeRange
+}
+
+// printDiff shows how a, the content of file aName, becomes b as a unified
+// diff, removed lines in red and added ones in green
+func printDiff(aName, bName, a, b string) {
+	fmt.Fprintf(ui, "--- %s\n+++ %s\n", aName, bName)
+	for _, line := range unifiedDiff(lineDiff(a, b), 2) {
+		color := ""
+		switch line[0] {
+		case '-':
+			color = colorRed
+		case '+':
+			color = colorGreen
+		case '@':
+			color = colorCyan
+		}
+		if color == "" {
+			fmt.Fprintln(ui, line)
+		} else {
+			fmt.Fprintf(ui, "%s%s%s\n", color, line, colorReset)
+		}
+	}
+}
+
+// unifiedDiff turns the output of lineDiff into hunks with context lines
+// around each change, each headed by "@@ -start,count +start,count @@"
+func unifiedDiff(diff []string, context int) []string {
+	// a change is within context of another when fewer than 2*context+1
+	// unchanged lines separate them
+	var out []string
+	for start := 0; start < len(diff); {
+		for start < len(diff) && diff[start][0] == ' ' {
+			start++
+		}
+		if start == len(diff) {
+			break
+		}
+		end, unchanged := start, 0
+		for i := start; i < len(diff); i++ {
+			if diff[i][0] == ' ' {
+				if unchanged++; unchanged > 2*context {
+					break
+				}
+				continue
+			}
+			unchanged = 0
+			end = i + 1
+		}
+		from := start - context
+		if from < 0 {
+			from = 0
+		}
+		to := end + context
+		if to > len(diff) {
+			to = len(diff)
+		}
+		aLine, bLine := 1, 1
+		for _, line := range diff[:from] {
+			if line[0] != '+' {
+				aLine++
+			}
+			if line[0] != '-' {
+				bLine++
+			}
+		}
+		aCount, bCount := 0, 0
+		for _, line := range diff[from:to] {
+			if line[0] != '+' {
+				aCount++
+			}
+			if line[0] != '-' {
+				bCount++
+			}
+		}
+		out = append(out, fmt.Sprintf("@@ -%d,%d +%d,%d @@", aLine, aCount, bLine, bCount))
+		out = append(out, diff[from:to]...)
+		start = to
+	}
+	return out
+}
+
+// lineDiff returns the lines of a and b in file order, those missing from b
+// prefixed with "-", those missing from a with "+" and the others with " "
+func lineDiff(a, b string) []string {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	// lcs[i][j] is the length of the longest common subsequence of x[i:]
+	// and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var diff []string
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			diff = append(diff, " "+x[i])
+			i++
+			j++
+		case j == len(y) || i < len(x) && lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "-"+x[i])
+			i++
+		default:
+			diff = append(diff, "+"+y[j])
+			j++
+		}
+	}
+	return diff
+}
+
+// keptScriptFile is where -keep-script leaves the update script
+const keptScriptFile = "update_k3s_nodeport.sh"
+
+// checkTempDir verifies that scripts can be written to and run from dir, ""
+// being the OS temp dir, by running a trivial one. Hardened nodes often
+// mount /tmp noexec, which only shows once the update script fails.
+func checkTempDir(dir string) error {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	script, err := ioutil.TempFile(dir, ".netmon-exec-check-*.sh")
+	if err != nil {
+		return fmt.Errorf("temp dir %s is not writable: %v; choose another with -temp-dir", dir, err)
+	}
+	defer os.Remove(script.Name())
+	_, err = script.WriteString("#!/bin/sh\nexit 0\n")
+	script.Close()
+	if err == nil {
+		err = os.Chmod(script.Name(), 0700)
+	}
+	if err != nil {
+		return fmt.Errorf("writing to temp dir %s: %v", dir, err)
+	}
+	if out, err := netmon.Command(context.Background(), script.Name()).CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot run scripts in temp dir %s (mounted noexec?): %v %s; choose another with -temp-dir",
+			dir, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// renderScript returns the update script with the configured range as its
+// default, so that a kept copy can be rerun or reviewed on its own
+func renderScript(unitPath string) string {
+	header := fmt.Sprintf("#!/bin/bash\n# Generated by k8s-netmon-debug after setting --service-node-port-range=%s in %s\n",
+		config.NodePortRange, unitPath)
+	script := strings.Replace(scriptContent, "#!/bin/bash\n", header, 1)
+	return strings.Replace(script, "${NODEPORT_RANGE:-"+nodePortRange+"}", "${NODEPORT_RANGE:-"+config.NodePortRange+"}", 1)
+}
+
+// applyK3sUnit updates the range in the k3s unit's ExecStart and restarts
+// k3s with the embedded script
+func applyK3sUnit(path, updated string) error {
+	// checked before the unit is touched, so a noexec temp dir leaves it as it was
+	if !config.KeepScript {
+		if err := checkTempDir(config.TempDir); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(path, []byte(updated), 0644); err != nil {
+		return fmt.Errorf("writing %s: %v", path, err)
+	}
+
+	script := renderScript(path)
+	var scriptFile *os.File
+	var err error
+	if config.KeepScript {
+		scriptFile, err = os.OpenFile(keptScriptFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	} else {
+		scriptFile, err = ioutil.TempFile(config.TempDir, "update_k3s_nodeport_*.sh")
+	}
+	if err != nil {
+		return fmt.Errorf("creating script file: %v", err)
+	}
+	if config.KeepScript {
+		fmt.Fprintf(ui, "Keeping the update script at %s\n", scriptFile.Name())
+	} else {
+		defer os.Remove(scriptFile.Name())
+	}
+
+	if _, err := scriptFile.Write([]byte(script)); err != nil {
+		return fmt.Errorf("writing script file: %v", err)
+	}
+	scriptFile.Close()
+
+	if err := os.Chmod(scriptFile.Name(), 0755); err != nil {
+		return fmt.Errorf("making script executable: %v", err)
+	}
+
+	cmd := netmon.Command(context.Background(), "/bin/bash", scriptFile.Name())
+	cmd.Env = append(os.Environ(), "NODEPORT_RANGE="+config.NodePortRange)
+	cmd.Stdout = ui
+	cmd.Stderr = os.Stderr
+
+	fmt.Fprintln(ui, "Running the script...")
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("executing script: %v", err)
+	}
+
+	fmt.Fprintln(ui, "Script executed successfully.")
+	return waitForAPIServer("k3s", config.K3sReadyTimeout)
+}
+
+// applyK3sConfigFile sets the range in /etc/rancher/k3s/config.yaml and
+// restarts k3s
+func applyK3sConfigFile(path, updated string) error {
+	if err := os.WriteFile(path, []byte(updated), 0644); err != nil {
+		return fmt.Errorf("writing %s: %v", path, err)
+	}
+
+	return restartK3s(false)
+}
+
+// restartK3s restarts k3s, after reloading systemd when the unit changed,
+// and waits for the API server
+func restartK3s(daemonReload bool) error {
+	if daemonReload {
+		if out, err := netmon.Command(context.Background(), "systemctl", "daemon-reload").CombinedOutput(); err != nil {
+			return fmt.Errorf("reloading systemd: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	fmt.Fprintln(ui, "Restarting K3s service to apply changes...")
+	if out, err := netmon.Command(context.Background(), "systemctl", "restart", "k3s").CombinedOutput(); err != nil {
+		return fmt.Errorf("restarting k3s: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return waitForAPIServer("k3s", config.K3sReadyTimeout)
+}
+
+// applyAPIServerManifest sets the kube-apiserver flag in its static pod
+// manifest. kubelet notices the change and recreates the pod by itself.
+func applyAPIServerManifest(path, updated string) error {
+	if err := os.WriteFile(path, []byte(updated), 0600); err != nil {
+		return fmt.Errorf("writing %s: %v", path, err)
+	}
+
+	return waitForAPIServerManifest()
+}
+
+// waitForAPIServerManifest waits for kubelet to recreate kube-apiserver from
+// its changed manifest
+func waitForAPIServerManifest() error {
+	// Give kubelet time to tear down the old API server, otherwise it would
+	// answer the readiness probe before the new flag is in effect
+	fmt.Fprintln(ui, "Waiting for kubelet to restart kube-apiserver...")
+	time.Sleep(10 * time.Second)
+	return waitForAPIServer("", config.K3sReadyTimeout)
+}
+
+// waitForAPIServer polls until the systemd unit, if any, is active and the
+// API server answers /readyz, showing the unit's journal as it is written. A
+// unit that fails or crashes into an automatic restart ends the wait at once
+// with the error lines of its journal. On timeout the tail of the journal is
+// included in the error since it usually explains why it did not come up.
+func waitForAPIServer(unit string, timeout time.Duration) error {
+	fmt.Fprintf(ui, "Waiting up to %s for the API server to become ready...\n", timeout)
+	startTime := time.Now()
+	deadline := startTime.Add(timeout)
+	state := "API not ready"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var journal <-chan string
+	// recent are the journal lines shown so far, for the error of a failure
+	var recent []string
+	if unit != "" {
+		journal = tailJournal(ctx, unit)
+	}
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		active := "active"
+		if unit != "" {
+			out, _ := netmon.Command(context.Background(), "systemctl", "show", unit, "-p", "ActiveState", "-p", "SubState").Output()
+			var sub string
+			active, sub = unitState(string(out))
+			state = "unit " + active
+			if active == "failed" || sub == "auto-restart" {
+				clearStatusLine()
+				what := "failed"
+				if active != "failed" {
+					what = "exited and is being restarted by systemd"
+				}
+				if len(recent) == 0 {
+					out, _ := netmon.Command(context.Background(), "journalctl", "-u", unit, "-n", "20", "--no-pager").CombinedOutput()
+					recent = strings.Split(strings.TrimSpace(string(out)), "\n")
+				}
+				return fmt.Errorf("%s %s after %s; errors in its journal:\n%s",
+					unit, what, time.Since(startTime).Round(time.Second), strings.Join(journalErrors(recent), "\n"))
+			}
+		}
+		if active == "active" {
+			if unit != "" {
+				state = "unit active, API not ready"
+			}
+			if err := netmon.Command(context.Background(), "kubectl", netmon.KubectlArgs("get", "--raw", "/readyz")...).Run(); err == nil {
+				clearStatusLine()
+				fmt.Fprintf(ui, "%sAPI server is ready (%s)%s\n", colorGreen, time.Since(startTime).Round(time.Second), colorReset)
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			clearStatusLine()
+			if unit == "" {
+				return fmt.Errorf("API server not ready after %s (%s)", timeout, state)
+			}
+			journal, _ := netmon.Command(context.Background(), "journalctl", "-u", unit, "-n", "20", "--no-pager").CombinedOutput()
+			return fmt.Errorf("%s not ready after %s (%s); last %s journal entries:\n%s",
+				unit, timeout, state, unit, strings.TrimSpace(string(journal)))
+		}
+
+		elapsed := time.Since(startTime)
+		printProgress(int(elapsed*100/timeout), 100, "Waiting for API server: ")
+	wait:
+		for {
+			select {
+			case line, ok := <-journal:
+				if !ok {
+					journal = nil
+					continue
+				}
+				clearStatusLine()
+				fmt.Fprintf(ui, "  %s\n", line)
+				if recent = append(recent, line); len(recent) > 200 {
+					recent = recent[1:]
+				}
+				printProgress(int(time.Since(startTime)*100/timeout), 100, "Waiting for API server: ")
+			case <-ticker.C:
+				break wait
+			}
+		}
+	}
+}
+
+// tailJournal follows the journal of unit, starting with its last 10
+// entries, until ctx is canceled. The channel is closed when journalctl
+// ends, e.g. because there is no journal.
+func tailJournal(ctx context.Context, unit string) <-chan string {
+	lines := make(chan string)
+	cmd := netmon.Command(ctx, "journalctl", "-u", unit, "-f", "-n", "10", "--no-pager", "-o", "short-iso")
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		close(lines)
+		return lines
+	}
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+			}
+		}
+		cmd.Wait()
+	}()
+	return lines
+}
+
+// unitState returns the ActiveState and SubState of systemctl show output
+func unitState(show string) (active, sub string) {
+	for _, line := range strings.Split(show, "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		switch key {
+		case "ActiveState":
+			active = value
+		case "SubState":
+			sub = value
+		}
+	}
+	return active, sub
+}
+
+// journalErrors returns the last 20 journal lines reporting errors, such as
+// k3s's level=error and level=fatal lines and systemd's failure messages, or
+// the last 20 lines when none does
+func journalErrors(lines []string) []string {
+	var errs []string
+	for _, line := range lines {
+		lower := strings.ToLower(line)
+		if strings.Contains(lower, "level=error") || strings.Contains(lower, "level=fatal") ||
+			strings.Contains(lower, "failed") || strings.Contains(lower, "error:") {
+			errs = append(errs, line)
+		}
+	}
+	if len(errs) == 0 {
+		errs = lines
+	}
+	if len(errs) > 20 {
+		errs = errs[len(errs)-20:]
+	}
+	return errs
+}
+
+// logJob is the log collection from one of the -pod pods
+type logJob struct {
+	pod        string
+	container  string
+	file       string
+	stopReason string
+	// stopMatch is the line that matched -log-stop-pattern, if one did
+	stopMatch string
+	// started is when the container last started, with -since-last-restart,
+	// after restarts earlier instances
+	started  time.Time
+	restarts int
+	err      error
+	// redactions counts the secrets -redact removed, by kind
+	redactions map[string]int
+}
+
+// newLogJob resolves the pod matching prefix and its container. With several
+// pods each gets its own log file, e.g. debug.log becomes debug-<pod>.log.
+func newLogJob(prefix string, multiple bool) (*logJob, error) {
+	podName := netmon.GetPodName(context.Background(), prefix)
+	if podName == "" {
+		return nil, configError("no pod found with prefix %s", prefix)
+	}
+	container, err := resolveContainer(podName, config.ContainerName)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &logJob{pod: podName, container: container, file: config.LogFile}
+	if config.SinceLastRestart {
+		if job.started, job.restarts, err = netmon.ContainerStart(context.Background(), podName, container); err != nil {
+			return nil, fmt.Errorf("-since-last-restart: %w", err)
+		}
+	}
+	if multiple && config.LogFile != "-" {
+		ext := filepath.Ext(config.LogFile)
+		job.file = strings.TrimSuffix(config.LogFile, ext) + "-" + podName + ext
+	}
+	return job, nil
+}
+
+// collectLogs enables debug logging in the job's pod and collects its logs:
+// the history from -log-since, then, with -log-follow, new lines for five
+// minutes. It stops early when -log-max-lines or -log-max-bytes is reached,
+// or after a line matching -log-stop-pattern, and returns what stopped the
+// collection, or "" if nothing did. A single collection reports its progress
+// to progress, which draws the bar or calls Config.ProgressFunc; it is nil
+// for the pods of a parallel collection, which share one bar.
+func collectLogs(ctx context.Context, job *logJob, progress func(current, total int, stage string)) (string, error) {
+	fmt.Fprintf(ui, "%sEnabling debug logs in pod %s...%s\n", colorCyan, job.pod, colorReset)
+
+	// the value and path are arguments of the script, never part of it
+	execArgs := []string{"exec", job.pod, "-c", job.container, "--",
+		"sh", "-c", `printf '%s\n' "$1" >> "$2"`, "sh", config.VerboseConfigValue, config.VerboseConfigPath}
+	if out, err := netmon.Command(ctx, "kubectl", netmon.KubectlArgs(execArgs...)...).CombinedOutput(); err != nil {
+		return "", kubectlError(execArgs[:4], fmt.Errorf("failed to enable debug logs: %v: %s", err, firstLine(strings.TrimSpace(string(out)))))
+	}
+
+	output, err := openLogOutput(job.file)
+	if err != nil {
+		return "", fmt.Errorf("failed to create log file: %v", err)
+	}
+	defer output.Close()
+
+	limit := newLimitWriter(output, int64(config.LogMaxLines), int64(config.LogMaxBytes))
+	var stdout io.Writer = limit
+	if config.Redact || config.RedactPatterns != "" {
+		redact, err := newRedactWriter(limit, config.RedactPatterns)
+		if err != nil {
+			return "", err
+		}
+		stdout = redact
+		// deferred before the grep report, so it runs after it flushes
+		defer func() { job.redactions = redact.flush() }()
+	}
+	var grep *grepWriter
+	if config.LogGrep != "" {
+		if grep, err = newGrepWriter(stdout, config.LogGrep, config.LogGrepAnchored); err != nil {
+			return "", err
+		}
+		stdout = grep
+		defer grep.report(job.pod)
+	}
+	// the stop pattern sees every line, before -log-grep drops any
+	var stop *stopWriter
+	if config.LogStopPattern != "" {
+		if stop, err = newStopWriter(stdout, config.LogStopPattern); err != nil {
+			return "", err
+		}
+		stdout = stop
+		defer func() {
+			stop.flush()
+			job.stopMatch = stop.match
+		}()
+	}
+
+	args := []string{"logs", job.pod, "-c", job.container}
+	if config.LogSince > 0 {
+		args = append(args, "--since", config.LogSince.String())
+	}
+	// without a restart the whole log is the current instance's
+	if job.restarts > 0 {
+		args = append(args, "--since-time", job.started.Format(time.RFC3339))
+	}
+
+	if !config.LogFollow {
+		if progress != nil {
+			printLogCollectionStart()
+		}
+		// a stop pattern match ends kubectl instead of reading the rest
+		runCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		if stop != nil {
+			go func() {
+				select {
+				case <-stop.done:
+					cancel()
+				case <-runCtx.Done():
+				}
+			}()
+		}
+		var stderr bytes.Buffer
+		cmd := netmon.Command(runCtx, "kubectl", netmon.KubectlArgs(args...)...)
+		cmd.Stdout = stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); stop != nil && stop.stopped() {
+			return stop.reason(), nil
+		} else if ctx.Err() != nil {
+			return quitReason, nil
+		} else if err != nil {
+			return "", kubectlError(args, fmt.Errorf("%v: %s", err, firstLine(strings.TrimSpace(stderr.String()))))
+		}
+		return limit.reason, nil
+	}
+
+	if progress != nil {
+		printLogCollectionStart()
+	}
+	startTime := time.Now()
+	endTime := startTime.Add(5 * time.Minute)
+
+	cmd := netmon.Command(context.Background(), "kubectl", netmon.KubectlArgs(append(args, "-f")...)...)
+	cmd.Stdout = stdout
+
+	if err := cmd.Start(); err != nil {
+		return "", kubectlError(args, fmt.Errorf("failed to start log collection: %v", err))
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	var stopped <-chan struct{}
+	if stop != nil {
+		stopped = stop.done
+	}
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for time.Now().Before(endTime) {
+		if progress != nil {
+			elapsed := time.Since(startTime)
+			percent := int(elapsed.Seconds() * 100 / 300)
+			prefix := "Collecting logs: "
+			// plain-line progress is only repeated when its prefix is stable
+			if grep != nil && interactive {
+				matched, total := grep.counts()
+				prefix = fmt.Sprintf("Collecting logs (%d of %d lines match): ", matched, total)
+			}
+			progress(percent, 100, prefix)
+		}
+		select {
+		case <-limit.done:
+			clearStatusLine()
+			fmt.Fprintf(ui, "%sStopping early for %s: %s%s\n", colorYellow, job.pod, limit.reason, colorReset)
+			return limit.reason, nil
+		case <-stopped:
+			clearStatusLine()
+			fmt.Fprintf(ui, "%sStopping early for %s: %s%s\n", colorYellow, job.pod, stop.reason(), colorReset)
+			return stop.reason(), nil
+		case <-ctx.Done():
+			clearStatusLine()
+			return quitReason, nil
+		case <-ticker.C:
+		}
+	}
+	return "", nil
+}
+
+// printLogCollectionStart announces what collectLogs is about to collect
+func printLogCollectionStart() {
+	switch {
+	case !config.LogFollow && config.LogSince > 0:
+		fmt.Fprintf(ui, "%sCollecting logs from the last %s...%s\n", colorGreen, config.LogSince, colorReset)
+	case !config.LogFollow && config.SinceLastRestart:
+		fmt.Fprintf(ui, "%sCollecting logs since the last container start...%s\n", colorGreen, colorReset)
+	case !config.LogFollow:
+		fmt.Fprintf(ui, "%sCollecting the full log history...%s\n", colorGreen, colorReset)
+	case config.LogSince > 0:
+		fmt.Fprintf(ui, "%sCollecting logs from the last %s and following for 5 minutes...%s\n", colorGreen, config.LogSince, colorReset)
+	case config.SinceLastRestart:
+		fmt.Fprintf(ui, "%sCollecting logs since the last container start and following for 5 minutes...%s\n", colorGreen, colorReset)
+	default:
+		fmt.Fprintf(ui, "%sStarting log collection for 5 minutes...%s\n", colorGreen, colorReset)
+	}
+}
+
+// limitWriter passes writes through until a line or byte limit is reached,
+// then discards the rest and closes done. A zero limit is unlimited.
+type limitWriter struct {
+	w                  io.Writer
+	maxLines, maxBytes int64
+	lines, bytes       int64
+	// reason describes the limit that was reached; read it after done
+	reason string
+	done   chan struct{}
+}
+
+func newLimitWriter(w io.Writer, maxLines, maxBytes int64) *limitWriter {
+	return &limitWriter{w: w, maxLines: maxLines, maxBytes: maxBytes, done: make(chan struct{})}
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.reason != "" {
+		return len(p), nil
+	}
+
+	keep := len(p)
+	if l.maxBytes > 0 && l.bytes+int64(keep) >= l.maxBytes {
+		keep = int(l.maxBytes - l.bytes)
+		l.reason = fmt.Sprintf("reached -log-max-bytes %s", netmon.FormatBytes(uint64(l.maxBytes)))
+	}
+	if l.maxLines > 0 {
+		lines := l.lines
+		for i, c := range p[:keep] {
+			if c == '\n' {
+				if lines++; lines == l.maxLines {
+					keep = i + 1
+					l.reason = fmt.Sprintf("reached -log-max-lines %d", l.maxLines)
+					break
+				}
+			}
+		}
+	}
+
+	n, err := l.w.Write(p[:keep])
+	l.bytes += int64(n)
+	l.lines += int64(bytes.Count(p[:n], []byte("\n")))
+	if l.reason != "" {
+		close(l.done)
+	}
+	if err != nil {
+		return n, err
+	}
+	return len(p), nil
+}
+
+// stopWriter passes the lines written to it on to the next writer up to and
+// including the first one matching a pattern, then discards the rest and
+// closes done
+type stopWriter struct {
+	w       io.Writer
+	pattern *regexp.Regexp
+	partial []byte
+	// match is the line that matched, without its newline; read it after done
+	match string
+	done  chan struct{}
+}
+
+func newStopWriter(w io.Writer, pattern string) (*stopWriter, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, configError("invalid -log-stop-pattern: %v", err)
+	}
+	return &stopWriter{w: w, pattern: re, done: make(chan struct{})}, nil
+}
+
+func (s *stopWriter) Write(p []byte) (int, error) {
+	if s.stopped() {
+		return len(p), nil
+	}
+	s.partial = append(s.partial, p...)
+	for !s.stopped() {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := s.writeLine(s.partial[:i+1]); err != nil {
+			return len(p), err
+		}
+		s.partial = s.partial[i+1:]
+	}
+	s.partial = nil
+	return len(p), nil
+}
+
+func (s *stopWriter) writeLine(line []byte) error {
+	if _, err := s.w.Write(line); err != nil {
+		return err
+	}
+	if text := string(bytes.TrimRight(line, "\r\n")); s.pattern.MatchString(text) {
+		s.match = text
+		close(s.done)
+	}
+	return nil
+}
+
+// flush passes on a trailing line without a newline
+func (s *stopWriter) flush() {
+	if len(s.partial) > 0 && !s.stopped() {
+		s.writeLine(s.partial)
+	}
+	s.partial = nil
+}
+
+// stopped reports whether a line matched
+func (s *stopWriter) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// reason describes the match for the report
+func (s *stopWriter) reason() string {
+	return fmt.Sprintf("found -log-stop-pattern: %s", s.match)
+}
+
+// grepWriter splits what is written to it into lines and passes only those
+// matching a pattern on to the next writer, counting both
+type grepWriter struct {
+	w       io.Writer
+	pattern *regexp.Regexp
+	partial []byte
+	// total and matched are read by the progress display while kubectl
+	// writes, so they are accessed atomically
+	total, matched int64
+}
+
+// newGrepWriter compiles pattern, which must match the whole line when
+// anchored is set and any part of it otherwise
+func newGrepWriter(w io.Writer, pattern string, anchored bool) (*grepWriter, error) {
+	if anchored {
+		pattern = "^(?:" + pattern + ")$"
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, configError("invalid -log-grep pattern: %v", err)
+	}
+	return &grepWriter{w: w, pattern: re}, nil
+}
+
+func (g *grepWriter) Write(p []byte) (int, error) {
+	g.partial = append(g.partial, p...)
+	for {
+		i := bytes.IndexByte(g.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := g.partial[:i+1]
+		if err := g.writeLine(line); err != nil {
+			return len(p), err
+		}
+		g.partial = g.partial[i+1:]
+	}
+}
+
+func (g *grepWriter) writeLine(line []byte) error {
+	atomic.AddInt64(&g.total, 1)
+	if !g.pattern.Match(bytes.TrimRight(line, "\r\n")) {
+		return nil
+	}
+	atomic.AddInt64(&g.matched, 1)
+	_, err := g.w.Write(line)
+	return err
+}
+
+// counts returns the number of matched and total lines so far
+func (g *grepWriter) counts() (matched, total int64) {
+	return atomic.LoadInt64(&g.matched), atomic.LoadInt64(&g.total)
+}
+
+// report filters a trailing line without a newline and prints the counts
+func (g *grepWriter) report(pod string) {
+	if len(g.partial) > 0 {
+		g.writeLine(g.partial)
+		g.partial = nil
+	}
+	matched, total := g.counts()
+	fmt.Fprintf(ui, "%d of %d log lines from %s matched %s\n", matched, total, pod, config.LogGrep)
+}
+
+// redacted replaces the secrets removed by -redact
+const redacted = "[REDACTED]"
+
+// redaction is a kind of secret removed from logs. Its replacement may refer
+// to the groups of its pattern, e.g. to keep the name of a password setting.
+type redaction struct {
+	kind        string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// defaultRedactions are the secrets -redact removes
+var defaultRedactions = []redaction{
+	{"bearer token", regexp.MustCompile(`(?i)\b(bearer\s+)[A-Za-z0-9._~+/-]+=*`), "${1}" + redacted},
+	{"AWS access key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), redacted},
+	{"credential setting", regexp.MustCompile(`(?i)\b((?:password|passwd|pwd|secret|token|api[_-]?key|aws_secret_access_key)["']?\s*[:=]\s*["']?)[^\s"',;&]+`),
+		"${1}" + redacted},
+	{"email address", regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`), redacted},
+}
+
+// loadRedactions reads a -redact-patterns file, one regular expression per
+// line. Blank lines and lines starting with # are skipped.
+func loadRedactions(path string) ([]redaction, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, configError("reading -redact-patterns: %v", err)
+	}
+	var redactions []redaction
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			return nil, configError("%s:%d: invalid pattern: %v", path, i+1, err)
+		}
+		redactions = append(redactions, redaction{"custom pattern", re, redacted})
+	}
+	return redactions, nil
+}
+
+// redactWriter splits what is written to it into lines and replaces the
+// secrets in them before passing them on, so they never reach the log file
+type redactWriter struct {
+	w          io.Writer
+	redactions []redaction
+	partial    []byte
+	counts     map[string]int
+}
+
+// newRedactWriter redacts the defaultRedactions and the patterns of the
+// patternsFile, if any
+func newRedactWriter(w io.Writer, patternsFile string) (*redactWriter, error) {
+	redactions := defaultRedactions
+	if patternsFile != "" {
+		custom, err := loadRedactions(patternsFile)
+		if err != nil {
+			return nil, err
+		}
+		redactions = append(append([]redaction{}, redactions...), custom...)
+	}
+	return &redactWriter{w: w, redactions: redactions, counts: map[string]int{}}, nil
+}
+
+func (r *redactWriter) Write(p []byte) (int, error) {
+	r.partial = append(r.partial, p...)
+	for {
+		i := bytes.IndexByte(r.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if _, err := r.w.Write(r.redact(r.partial[:i+1])); err != nil {
+			return len(p), err
+		}
+		r.partial = r.partial[i+1:]
+	}
+}
+
+// redact returns line with every secret replaced, counting them
+func (r *redactWriter) redact(line []byte) []byte {
+	for _, red := range r.redactions {
+		if n := len(red.pattern.FindAllIndex(line, -1)); n > 0 {
+			r.counts[red.kind] += n
+			line = red.pattern.ReplaceAll(line, []byte(red.replacement))
+		}
+	}
+	return line
+}
+
+// flush redacts and writes a trailing line without a newline and returns
+// the redactions by kind
+func (r *redactWriter) flush() map[string]int {
+	if len(r.partial) > 0 {
+		r.w.Write(r.redact(r.partial))
+		r.partial = nil
+	}
+	return r.counts
+}
+
+// redactionSummary describes redaction counts, e.g. "3 credential setting, 1 email
+// address" or "nothing found"
+func redactionSummary(counts map[string]int) string {
+	var kinds []string
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	if len(kinds) == 0 {
+		return "nothing found"
+	}
+	sort.Strings(kinds)
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = fmt.Sprintf("%d %s", counts[kind], kind)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// resolveContainer checks that the pod has the named container. If it does
+// not, the pod's containers are listed and, when there is only one and stdin
+// is a terminal, the user is offered to collect from it instead.
+func resolveContainer(podName, container string) (string, error) {
+	containers, err := netmon.PodContainers(context.Background(), podName)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range containers {
+		if name == container {
+			return container, nil
+		}
+	}
+
+	fmt.Fprintf(ui, "%sContainer %s not found in pod %s. Available containers: %s%s\n",
+		colorYellow, container, podName, strings.Join(containers, ", "), colorReset)
+	if len(containers) == 1 && isTerminal(os.Stdin) {
+		fmt.Fprintf(ui, "Collect logs from %s instead? [y/N]: ", containers[0])
+		if answer, err := readLine(); err == nil && strings.EqualFold(answer, "y") {
+			return containers[0], nil
+		}
+	}
+	return "", configError("container %s not found in pod %s (available: %s)",
+		container, podName, strings.Join(containers, ", "))
+}
+
+// openLogOutput opens the destination for collected logs: stdout for "-",
+// otherwise the log file, appended to with -log-append and truncated if not
+func openLogOutput(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		if logStdout != nil {
+			return nopWriteCloser{logStdout}, nil
+		}
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if config.LogAppend {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	return os.OpenFile(path, flags, 0644)
+}
+
+// nopWriteCloser keeps stdout open when it is used as a log destination
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// restartPollInterval is how often watchRestarts checks restart counts
+const restartPollInterval = 5 * time.Second
+
+// watchRestarts polls the pods matching the given names in the background and
+// warns whenever one of their containers restarts. The returned function
+// stops the watch and returns the restarts seen.
+func watchRestarts(names []string) func() []PodRestart {
+	if len(names) == 0 {
+		return func() []PodRestart { return nil }
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var restarts []PodRestart
+
+	go func() {
+		defer close(done)
+		// counts holds the last restart count per pod/container
+		counts := map[string]int{}
+		first := true
+		ticker := time.NewTicker(restartPollInterval)
+		defer ticker.Stop()
+		for {
+			if pods, err := netmon.ListPods(context.Background()); err == nil {
+				for _, name := range names {
+					pod, ok := netmon.FindPod(pods, name)
+					if !ok {
+						continue
+					}
+					for _, status := range pod.Status.ContainerStatuses {
+						key := pod.Metadata.Name + "/" + status.Name
+						last, seen := counts[key]
+						counts[key] = status.RestartCount
+						if first || !seen || status.RestartCount <= last {
+							continue
+						}
+						restart := PodRestart{Time: time.Now(), Pod: pod.Metadata.Name,
+							Container: status.Name, RestartCount: status.RestartCount}
+						restarts = append(restarts, restart)
+						clearStatusLine()
+						fmt.Fprintf(ui, "\n%s!!! %s: container %s in pod %s restarted (restart count %d) !!!%s\n",
+							colorRed, restart.Time.Format("15:04:05"), status.Name, pod.Metadata.Name,
+							status.RestartCount, colorReset)
+					}
+				}
+				first = false
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() []PodRestart {
+		close(stop)
+		<-done
+		return restarts
+	}
+}
+
+// resourceWarnRatio is the share of a limit at which -resource-log warns
+const resourceWarnRatio = 0.9
+
+// resourceSamples is what sampleResources recorded
+type resourceSamples struct {
+	File string
+	// Rows is the number of container samples written
+	Rows     int
+	Warnings []string
+	Err      error
+}
+
+// sampleResources records the CPU and memory usage of the containers of the
+// pods matching names to a CSV file every interval in the background,
+// warning when one gets within resourceWarnRatio of its limit. Sampling
+// stops for good when the cluster has no metrics API. The returned function
+// stops sampling and returns what was recorded.
+func sampleResources(names []string, path string, interval time.Duration) func() resourceSamples {
+	result := resourceSamples{File: path}
+	if path == "" {
+		return func() resourceSamples { return resourceSamples{} }
+	}
+	if len(names) == 0 {
+		result.Err = configError("-resource-log needs -pod")
+		return func() resourceSamples { return result }
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		result.Err = err
+		return func() resourceSamples { return result }
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"time", "pod", "container", "cpu_millicores", "cpu_limit_millicores", "memory_bytes", "memory_limit_bytes"})
+	w.Flush()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// limits holds the limits of each pod's containers once looked up
+		limits := map[string][]netmon.ContainerUsage{}
+		warned := map[string]bool{}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, name := range names {
+				pod := netmon.GetPodName(context.Background(), name)
+				if pod == "" {
+					continue
+				}
+				if _, ok := limits[pod]; !ok {
+					limits[pod], _ = netmon.PodLimits(context.Background(), pod)
+				}
+				usage, err := netmon.PodUsage(context.Background(), pod)
+				if errors.Is(err, netmon.ErrMetricsUnavailable) {
+					result.Err = err
+					clearStatusLine()
+					fmt.Fprintf(ui, "%sNot sampling resource usage: %v%s\n", colorYellow, netmon.ErrMetricsUnavailable, colorReset)
+					return
+				}
+				if err != nil {
+					result.Err = err
+					continue
+				}
+				now := time.Now()
+				for _, container := range usage {
+					limit := containerLimit(limits[pod], container.Container)
+					w.Write([]string{now.Format(time.RFC3339), pod, container.Container,
+						strconv.FormatInt(container.CPU, 10), strconv.FormatInt(limit.CPU, 10),
+						strconv.FormatInt(container.Memory, 10), strconv.FormatInt(limit.Memory, 10)})
+					result.Rows++
+					for _, warning := range resourceWarnings(pod, container, limit) {
+						if key := pod + "/" + container.Container + "/" + warning.resource; !warned[key] {
+							warned[key] = true
+							result.Warnings = append(result.Warnings, warning.text)
+							clearStatusLine()
+							fmt.Fprintf(ui, "%s%s: %s%s\n", colorYellow, now.Format("15:04:05"), warning.text, colorReset)
+						}
+					}
+				}
+				w.Flush()
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() resourceSamples {
+		close(stop)
+		<-done
+		w.Flush()
+		if err := w.Error(); err != nil && result.Err == nil {
+			result.Err = err
+		}
+		if err := f.Close(); err != nil && result.Err == nil {
+			result.Err = err
+		}
+		return result
+	}
+}
+
+// containerLimit returns the limits of container among limits, none when
+// it is not listed
+func containerLimit(limits []netmon.ContainerUsage, container string) netmon.ContainerUsage {
+	for _, limit := range limits {
+		if limit.Container == container {
+			return limit
+		}
+	}
+	return netmon.ContainerUsage{Container: container}
+}
+
+// resourceWarning is a resource, cpu or memory, of a container whose usage
+// approaches its limit
+type resourceWarning struct {
+	resource string
+	text     string
+}
+
+// resourceWarnings returns the resources of a container whose usage is
+// within resourceWarnRatio of its limit
+func resourceWarnings(pod string, usage, limit netmon.ContainerUsage) []resourceWarning {
+	var warnings []resourceWarning
+	if limit.CPU > 0 && float64(usage.CPU) >= resourceWarnRatio*float64(limit.CPU) {
+		warnings = append(warnings, resourceWarning{"cpu", fmt.Sprintf("cpu of container %s in pod %s at %dm of its %dm limit (%d%%), it is likely throttled",
+			usage.Container, pod, usage.CPU, limit.CPU, usage.CPU*100/limit.CPU)})
+	}
+	if limit.Memory > 0 && float64(usage.Memory) >= resourceWarnRatio*float64(limit.Memory) {
+		warnings = append(warnings, resourceWarning{"memory", fmt.Sprintf("memory of container %s in pod %s at %s of its %s limit (%d%%), close to being OOM-killed",
+			usage.Container, pod, netmon.FormatBytes(uint64(usage.Memory)), netmon.FormatBytes(uint64(limit.Memory)), usage.Memory*100/limit.Memory)})
+	}
+	return warnings
+}
+
+// addResourceSamples adds the outcome of sampleResources to report. Not
+// being able to sample is noted, since it does not affect the action itself.
+func addResourceSamples(report *Report, samples resourceSamples) {
+	if samples.Err != nil {
+		report.note("Resource usage: %v", samples.Err)
+	}
+	for _, warning := range samples.Warnings {
+		report.warn("%s", warning)
+	}
+	if samples.Rows > 0 {
+		report.Files = append(report.Files, samples.File)
+		report.note("Recorded %d resource usage samples to %s", samples.Rows, samples.File)
+	}
+}
+
+// precisionError returns the line of tcpdump's stderr complaining about the
+// timestamp precision, or "" if there is none
+func precisionError(stderr string) string {
+	for _, line := range strings.Split(stderr, "\n") {
+		if strings.Contains(line, "precision") {
+			return strings.TrimSpace(line)
+		}
+	}
+	return ""
+}
+
+// preflightCheck is a single environment check run by the preflight action.
+// Hard checks make the action fail; soft checks only warn.
+type preflightCheck struct {
+	name string
+	hard bool
+	run  func() (bool, string)
+}
+
+func checkKubectl() (bool, string) {
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		return false, "kubectl not found in PATH"
+	}
+	out, err := netmon.Command(context.Background(), "kubectl", netmon.KubectlArgs("auth", "can-i", "get", "pods")...).CombinedOutput()
+	answer := strings.TrimSpace(string(out))
+	if err != nil || answer != "yes" {
+		return false, fmt.Sprintf("cannot get pods: %s", firstLine(answer))
+	}
+	return true, "authenticated, can get pods"
+}
+
+func checkTcpdump() (bool, string) {
+	path, err := exec.LookPath("tcpdump")
+	if err != nil {
+		return false, "tcpdump not found in PATH"
+	}
+	if !netmon.TcpdumpCanCapture() {
+		return false, "no capture privileges (need root or CAP_NET_RAW)"
+	}
+	return true, path
+}
+
+func checkK3sConfigReadable() (bool, string) {
+	file, err := os.Open(config.K3sConfigFile)
+	if err != nil {
+		return false, err.Error()
+	}
+	file.Close()
+	return true, config.K3sConfigFile
+}
+
+func checkOutputWritable() (bool, string) {
+	dir := filepath.Dir(config.CaptureFile)
+	tmpFile, err := os.CreateTemp(dir, ".netmon-preflight-*")
+	if err != nil {
+		return false, err.Error()
+	}
+	tmpFile.Close()
+	os.Remove(tmpFile.Name())
+	return true, dir
+}
+
+func checkTempDirExecutable() (bool, string) {
+	if err := checkTempDir(config.TempDir); err != nil {
+		return false, err.Error()
+	}
+	if config.TempDir == "" {
+		return true, os.TempDir()
+	}
+	return true, config.TempDir
+}
+
+// checkPortListeners checks that the ports of the filter, or the telemetry
+// ports when it names none, have a listener on the host
+func checkPortListeners() (bool, string) {
+	ports := netmon.FilterPorts(config.TcpdumpFilter)
+	if len(ports) == 0 {
+		ports = filterPresets["telemetry"]
+	}
+	bound, unbound, err := portListeners(netmonConfig(), ports)
+	if err != nil {
+		return false, err.Error()
+	}
+	detail := "bound: " + strings.Join(bound, ", ")
+	if len(unbound) > 0 {
+		missing := make([]string, len(unbound))
+		for i, port := range unbound {
+			missing[i] = strconv.Itoa(port)
+		}
+		if len(bound) == 0 {
+			return false, "no listener on " + strings.Join(missing, ", ")
+		}
+		return false, fmt.Sprintf("no listener on %s; %s", strings.Join(missing, ", "), detail)
+	}
+	return true, detail
+}
+
+// portListeners sorts ports into those with a listener, described as e.g.
+// "4729/udp collector (pid 812)", and those without
+func portListeners(c netmon.Config, ports []int) (bound []string, unbound []int, err error) {
+	listeners, err := c.Listeners()
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing sockets: %v", err)
+	}
+	// IPv4 and IPv6 sockets of the same process describe alike
+	seen := map[string]bool{}
+	for _, port := range ports {
+		found := false
+		for _, l := range listeners {
+			if l.Port != port {
+				continue
+			}
+			found = true
+			description := fmt.Sprintf("%d/%s", port, l.Transport)
+			if l.Process != "" {
+				description += " " + l.Process
+			}
+			if !seen[description] {
+				seen[description] = true
+				bound = append(bound, description)
+			}
+		}
+		if !found {
+			unbound = append(unbound, port)
+		}
+	}
+	return bound, unbound, nil
+}
+
+// warnUnboundPorts warns about ports of the filter that nothing in the
+// network namespace of target listens on, which explains a capture without
+// packets
+func warnUnboundPorts(c netmon.Config, target string, report *Report) {
+	ports := netmon.FilterPorts(c.TcpdumpFilter)
+	if len(ports) == 0 {
+		return
+	}
+	bound, unbound, err := portListeners(c, ports)
+	if err != nil {
+		return
+	}
+	if len(bound) > 0 {
+		fmt.Fprintf(ui, "Listening: %s\n", strings.Join(bound, ", "))
+	}
+	for _, port := range unbound {
+		warning := fmt.Sprintf("nothing listens on port %d in the network namespace of the %s", port, target)
+		fmt.Fprintf(ui, "%sWarning: %s%s\n", colorYellow, warning, colorReset)
+		report.warn(warning)
+	}
+	if len(unbound) > 0 && target == "host" {
+		report.note("NodePorts forwarded by kube-proxy have no listener on the host; -capture-pod checks inside the collector pod")
+	}
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func runPreflight() Report {
+	report := newReport("preflight")
+	checks := []preflightCheck{
+		{"kubectl", true, checkKubectl},
+		{"tcpdump", true, checkTcpdump},
+		{"k3s unit file", false, checkK3sConfigReadable},
+		{"output directory", true, checkOutputWritable},
+		{"temp directory", false, checkTempDirExecutable},
+		{"collector ports", false, checkPortListeners},
+	}
+
+	fmt.Fprintf(ui, "%sRunning preflight checks...%s\n", colorCyan, colorReset)
+	for _, check := range checks {
+		passed, detail := check.run()
+		entry := netmon.StatusEntry{Resource: check.name, Type: "check", Status: "PASS", Healthy: passed, Detail: detail}
+		if !passed {
+			entry.Status = "FAIL"
+			if !check.hard {
+				entry.Status = "WARN"
+				entry.Warning = true
+			}
+		}
+		report.addEntry(entry)
+	}
+
+	if !report.Success {
+		report.note("Preflight failed: fix the FAIL checks above before debugging")
+	}
+	return report
+}
+
+// probeResult is the outcome of probing one pod from another
+type probeResult string
+
+const (
+	probeOK          probeResult = "ok"
+	probeFailed      probeResult = "FAIL"
+	probeUnavailable probeResult = "n/a"
+	probeNoPorts     probeResult = "no ports"
+	probeSelf        probeResult = "-"
+)
+
+// probePort runs nc -z from inside source against TCP addr:port. Pods
+// without a shell or nc report probeUnavailable rather than a failure.
+func probePort(source, addr string, port int) probeResult {
+	script := fmt.Sprintf("command -v nc >/dev/null 2>&1 || exit 127; nc -z -w 2 %s %d", addr, port)
+	out, err := netmon.Command(context.Background(), "kubectl", netmon.KubectlArgs("exec", source, "--", "sh", "-c", script)...).CombinedOutput()
+	if err == nil {
+		return probeOK
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 127 {
+		return probeUnavailable
+	}
+	lower := strings.ToLower(string(out))
+	if strings.Contains(lower, "executable file not found") || strings.Contains(lower, "no such file") {
+		return probeUnavailable
+	}
+	return probeFailed
+}
+
+// probePod checks whether source can reach any declared TCP port of
+// target. UDP ports are not probed: nc -zu sends nothing a receiver
+// answers, so it succeeds whether or not anything listens, and a target
+// with only UDP ports is probeUnavailable.
+func probePod(source, target netmon.Pod) probeResult {
+	result := probeNoPorts
+	for _, container := range target.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Protocol != "" && !strings.EqualFold(port.Protocol, "TCP") {
+				if result == probeNoPorts {
+					result = probeUnavailable
+				}
+				continue
+			}
+			if result = probePort(source.Metadata.Name, target.Status.PodIP, port.ContainerPort); result != probeFailed {
+				return result
+			}
+		}
+	}
+	return result
+}
+
+// telemetryDatagramSize is the largest flow telemetry datagram exporters
+// commonly send, sized to fill an Ethernet frame
+const telemetryDatagramSize = 1500
+
+// runMTU reports the MTU of the capture interface and of the CNI overlay
+// interfaces and, with -mtu-target, the path MTU, warning when the smallest
+// of them would fragment telemetry datagrams
+func runMTU() Report {
+	report := newReport("mtu")
+	iface := "any"
+	if len(config.Interfaces) > 0 {
+		iface = config.Interfaces[0]
+	}
+	link, err := netmon.LinkMTU(iface)
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+	report.addEntry(netmon.StatusEntry{Resource: link.Name, Type: "mtu", Status: strconv.Itoa(link.MTU), Healthy: true,
+		Detail: "capture interface"})
+	effective := link.MTU
+
+	for _, overlay := range netmon.OverlayMTUs() {
+		entry := netmon.StatusEntry{Resource: overlay.Name, Type: "mtu", Status: strconv.Itoa(overlay.MTU), Healthy: true,
+			Detail: fmt.Sprintf("overlay, %d bytes overhead", overlay.Overhead)}
+		if overlay.MTU+overlay.Overhead > link.MTU {
+			entry.Healthy, entry.Warning = false, true
+			entry.Detail += fmt.Sprintf(", exceeds %s", link.Name)
+			report.warn(fmt.Sprintf("%s's MTU %d plus %d bytes of encapsulation exceeds the %d of %s: full-size pod packets "+
+				"are fragmented or dropped; lower it to %d", overlay.Name, overlay.MTU, overlay.Overhead, link.MTU, link.Name,
+				link.MTU-overlay.Overhead))
+		}
+		if overlay.MTU < effective {
+			effective = overlay.MTU
+		}
+		report.addEntry(entry)
+	}
+
+	if config.MTUTarget != "" {
+		ctx := context.Background()
+		pid, source := 0, "this host"
+		if len(config.Pods) > 0 {
+			podName := netmon.GetPodName(ctx, config.Pods[0])
+			if podName == "" {
+				report.fail(configError("no pod found with prefix %s", config.Pods[0]))
+				return report
+			}
+			if pid, err = netmon.ContainerPID(ctx, podName, config.ContainerName); err != nil {
+				report.fail(err)
+				return report
+			}
+			source = "pod " + podName
+		}
+		fmt.Fprintf(ui, "%sProbing the path MTU from %s to %s...%s\n", colorCyan, source, config.MTUTarget, colorReset)
+		pathMTU, err := netmon.PathMTU(ctx, pid, config.MTUTarget, link.MTU)
+		if err != nil {
+			report.addEntry(netmon.StatusEntry{Resource: config.MTUTarget, Type: "path-mtu", Status: "error", Detail: err.Error()})
+			return report
+		}
+		report.addEntry(netmon.StatusEntry{Resource: config.MTUTarget, Type: "path-mtu", Status: strconv.Itoa(pathMTU), Healthy: true,
+			Detail: "from " + source})
+		if pathMTU < effective {
+			effective = pathMTU
+		}
+	}
+
+	report.note("Effective MTU: %d", effective)
+	if effective < telemetryDatagramSize {
+		report.warn(fmt.Sprintf("telemetry datagrams larger than %d bytes (%d bytes of UDP payload) are fragmented on the way, "+
+			"and losing any fragment loses the datagram; lower the exporters' maximum packet size", effective, effective-28))
+	}
+	return report
+}
+
+func runConnectivity() Report {
+	report := newReport("connectivity")
+	if err := requireFlags("pod"); err != nil {
+		report.fail(err)
+		return report
+	}
+
+	allPods, err := netmon.ListPods(context.Background())
+	if err != nil {
+		report.fail(fmt.Errorf("getting pods: %w", err))
+		return report
+	}
+
+	var pods []netmon.Pod
+	for _, name := range append(append([]string{}, config.Pods...), config.DependentPods...) {
+		pod, ok := netmon.FindPod(allPods, name)
+		if !ok {
+			report.note("Pod %s not found, skipped", name)
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	if len(pods) < 2 {
+		report.fail(errors.New("need at least two running pods to build a connectivity matrix"))
+		return report
+	}
+
+	fmt.Fprintf(ui, "%sProbing connectivity between %d pods...%s\n", colorCyan, len(pods), colorReset)
+	matrix := &Matrix{}
+	for i, source := range pods {
+		matrix.Labels = append(matrix.Labels, source.Metadata.Name)
+		row := make([]string, len(pods))
+		for j, target := range pods {
+			result := probeSelf
+			if i != j {
+				result = probePod(source, target)
+			}
+			if result == probeFailed {
+				report.Success = false
+			}
+			row[j] = string(result)
+		}
+		matrix.Cells = append(matrix.Cells, row)
+	}
+
+	report.Matrix = matrix
+	report.note("n/a: the source pod has no sh or nc; no ports: the target declares no container ports")
+	return report
+}
+
+func runStatus() Report {
+	report := newReport("status")
+	// the pods of -workload stand in for -pod
+	required := []string{"pod", "service"}
+	if len(config.Workloads) > 0 {
+		required = required[1:]
+	}
+	if err := requireFlags(required...); err != nil {
+		report.fail(err)
+		return report
+	}
+	if config.ServeAddr != "" {
+		if config.Wait {
+			report.fail(configError("-wait cannot be combined with -serve-addr"))
+			return report
+		}
+		return serveStatus(config.ServeAddr)
+	}
+	return checkStatus(report)
+}
+
+// checkStatus adds the pod, service and CNI status to report
+func checkStatus(report Report) Report {
+	if config.Output == formatOneline && !config.Wait {
+		return statusFromSnapshot(report)
+	}
+
+	ctx, cfg := context.Background(), netmonConfig()
+	for _, pod := range config.Pods {
+		report.addEntry(netmon.CheckPod(ctx, cfg, pod))
+	}
+	addWorkloads(&report)
+	report.addEntry(netmon.CheckService(ctx, cfg, config.ServiceName))
+	for _, pod := range config.DependentPods {
+		report.addEntry(netmon.CheckPod(ctx, cfg, pod))
+	}
+	for _, pod := range append(append([]string{}, config.Pods...), config.DependentPods...) {
+		if name := netmon.GetPodName(ctx, pod); name != "" {
+			addPodEvents(&report, name)
+		}
+	}
+
+	cni := netmon.DetectCNI(ctx, flannelBackend())
+	report.CNI = &cni
+	entry := netmon.StatusEntry{Resource: "node", Type: "cni", Status: cni.String(), Healthy: cni.Name != "",
+		Detail: strings.Join(cni.Evidence, ", ")}
+	if cni.Name == "" {
+		entry.Warning = true
+		report.note("Could not determine the CNI plugin; captures of pod traffic may be encapsulated")
+	}
+	report.addEntry(entry)
+	if filter := cni.OverlayFilter(); filter != "" {
+		report.note("Overlay traffic of %s: -tcpdump-filter=%q", cni, filter)
+	}
+	addHealth(&report)
+	return report
+}
+
+// addWorkloads adds the aggregate and per-pod status of each -workload
+func addWorkloads(report *Report) {
+	for _, spec := range config.Workloads {
+		workload, err := netmon.ParseWorkload(spec)
+		if err != nil {
+			report.fail(err)
+			continue
+		}
+		entries := netmon.CheckWorkload(context.Background(), workload)
+		for _, entry := range entries {
+			report.addEntry(entry)
+		}
+		if aggregate := entries[0]; aggregate.Type == "workload" && aggregate.Status != "error" {
+			report.note("%s: %s", workload, aggregate.Status)
+		}
+	}
+}
+
+// addPodEvents adds the Kubernetes events of pod to the report, noting
+// how many are warnings such as OOMKilling or failed probes
+func addPodEvents(report *Report, pod string) {
+	events, err := netmon.PodEvents(context.Background(), pod)
+	if err != nil {
+		report.note("Could not get the events of %s: %v", pod, err)
+		return
+	}
+	warnings := 0
+	for _, event := range events {
+		if event.Type == netmon.EventWarning {
+			warnings++
+		}
+	}
+	if warnings > 0 {
+		report.note("%s has %d warning events, see the pod events", pod, warnings)
+	}
+	report.Events = append(report.Events, events...)
+}
+
+// statusCacheTTL is how long -serve-addr answers from the last status
+// report before checking again
+const statusCacheTTL = 5 * time.Second
+
+// statusHandler serves the status report as JSON, with 200 when it is
+// healthy and 503 when not, checking at most once per statusCacheTTL
+type statusHandler struct {
+	check   func() Report
+	mu      sync.Mutex
+	report  Report
+	checked time.Time
+}
+
+func (h *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	if h.checked.IsZero() || time.Since(h.checked) > statusCacheTTL {
+		h.report, h.checked = h.check(), time.Now()
+	}
+	report := h.report
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Success {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	renderJSON(report, w)
+}
+
+// serveStatus serves /status on addr until SIGINT or SIGTERM, then shuts
+// the server down, letting requests in progress finish
+func serveStatus(addr string) Report {
+	report := newReport("status")
+	mux := http.NewServeMux()
+	mux.Handle("/status", &statusHandler{check: func() Report { return checkStatus(newReport("status")) }})
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe() }()
+	fmt.Fprintf(ui, "%sServing status on http://%s/status, Ctrl-C to stop%s\n", colorCyan, addr, colorReset)
+
+	select {
+	case err := <-served:
+		report.fail(err)
+		return report
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		report.fail(err)
+	}
+	report.note("Stopped serving status on %s", addr)
+	return report
+}
+
+var k3sFlannelBackendRegex = regexp.MustCompile(`(?m)^flannel-backend:\s*["']?([\w-]+)`)
+
+// flannelBackend returns the --flannel-backend k3s runs with, from the k3s
+// unit or /etc/rancher/k3s/config.yaml, or "" when neither sets it
+func flannelBackend() string {
+	path := config.K3sConfigFile
+	if path == "" {
+		path = k3sConfigFile
+	}
+	if unit, err := os.ReadFile(path); err == nil {
+		if args, err := parseExecStart(string(unit)); err == nil {
+			for i, arg := range args {
+				if value := strings.TrimPrefix(arg.value, "--flannel-backend="); value != arg.value {
+					return value
+				}
+				if arg.value == "--flannel-backend" && i+1 < len(args) {
+					return args[i+1].value
+				}
+			}
+		}
+	}
+	if content, err := os.ReadFile("/etc/rancher/k3s/config.yaml"); err == nil {
+		if m := k3sFlannelBackendRegex.FindSubmatch(content); m != nil {
+			return string(m[1])
+		}
+	}
+	return ""
+}
+
+// statusFromSnapshot checks the pods and the service against a single
+// kubectl snapshot, which keeps -output oneline fast
+func statusFromSnapshot(report Report) Report {
+	snapshot, err := netmon.TakeSnapshot(context.Background())
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+	for _, pod := range config.Pods {
+		report.addEntry(snapshot.CheckPod(pod))
+	}
+	addWorkloads(&report)
+	report.addEntry(snapshot.CheckService(config.ServiceName))
+	for _, pod := range config.DependentPods {
+		report.addEntry(snapshot.CheckPod(pod))
+	}
+	addHealth(&report)
+	return report
+}
+
+// addHealth sets the overall verdict of a status report, which also
+// decides whether it succeeds: DOWN fails it, e.g. for a Pending -pod that
+// is only a warning in the table, while DEGRADED does not. Errors such as a
+// failed kubectl still fail it.
+func addHealth(report *Report) {
+	report.Health = rollupHealth(report.Entries)
+	report.Success = len(report.errs) == 0 && report.Health.Verdict != healthDown
+}
+
+// rollupHealth sums up the status entries in one verdict. The -pod pods,
+// the workloads, the service and the -critical-pods are essential: any of
+// them being down, including a pod that is only Pending, is DOWN. Any other
+// dependent pod being down, or a workload with only some pods ready, is
+// DEGRADED. The pods of a workload count through its aggregate entry, and
+// the CNI does not count.
+func rollupHealth(entries []netmon.StatusEntry) *Health {
+	var down, degraded []string
+	for _, entry := range entries {
+		essential := true
+		switch entry.Type {
+		case "pod":
+			main, dependent := containsString(config.Pods, entry.Resource), containsString(config.DependentPods, entry.Resource)
+			if !main && !dependent {
+				continue
+			}
+			essential = main || containsString(config.CriticalPods, entry.Resource)
+		case "service", "workload":
+		default:
+			continue
+		}
+		if entry.Healthy {
+			continue
+		}
+		cause := fmt.Sprintf("%s (%s)", entry.Resource, entry.Status)
+		// a workload only warns while some of its pods are ready
+		if essential && !(entry.Type == "workload" && entry.Warning) {
+			down = append(down, cause)
+		} else {
+			degraded = append(degraded, cause)
+		}
+	}
+
+	switch {
+	case len(down) > 0:
+		return &Health{Verdict: healthDown, Causes: down}
+	case len(degraded) > 0:
+		return &Health{Verdict: healthDegraded, Causes: degraded}
+	}
+	return &Health{Verdict: healthHealthy}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func runNodePort() Report {
+	report := newReport("nodeport")
+	changed, err := updateNodePortRange()
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+	if !changed {
+		report.note("NodePort range %s already configured, skipping restart", config.NodePortRange)
+		return report
+	}
+	report.note("K3s service file updated successfully.")
+	return report
+}
+
+func runRevertNodePort() Report {
+	report := newReport("revert-nodeport")
+	restored, err := revertNodePortRange()
+	if err == errNothingToRevert {
+		report.note("%s; NodePort range %s already configured, skipping restart", err, rangeOrDefault(restored))
+		return report
+	}
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+	report.note("NodePort range reverted to %s.", rangeOrDefault(restored))
+	return report
+}
+
+func runRestartPod() Report {
+	report := newReport("restart-pod")
+	if len(config.Pods) == 0 && config.Selector == "" {
+		report.fail(configError("-pod or -selector must be provided"))
+		return report
+	}
+
+	ctx := context.Background()
+	pods, err := netmon.ListPods(ctx)
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+	var selected []netmon.Pod
+	for _, name := range config.Pods {
+		pod, ok := netmon.FindPod(pods, name)
+		if !ok {
+			report.fail(configError("pod %s not found", name))
+			return report
+		}
+		selected = append(selected, pod)
+	}
+	if config.Selector != "" {
+		matching, err := netmon.ListPodsMatching(ctx, config.Selector)
+		if err != nil {
+			report.fail(err)
+			return report
+		}
+		if len(matching) == 0 {
+			report.fail(configError("no pods match selector %s", config.Selector))
+			return report
+		}
+		selected = append(selected, matching...)
+	}
+
+	// Several pods of one deployment need a single rollout
+	var targets []netmon.RestartTarget
+	seen := map[string]bool{}
+	for _, pod := range selected {
+		target, err := netmon.FindRestartTarget(ctx, pod)
+		if err != nil {
+			report.fail(err)
+			return report
+		}
+		if !seen[target.String()] {
+			seen[target.String()] = true
+			targets = append(targets, target)
+		}
+	}
+
+	names := make([]string, len(targets))
+	for i, target := range targets {
+		names[i] = target.String()
+	}
+	if err := confirm(fmt.Sprintf("This will restart %s.", strings.Join(names, ", "))); err != nil {
+		report.fail(err)
+		return report
+	}
+
+	cfg := netmonConfig()
+	for _, target := range targets {
+		entry := netmon.StatusEntry{Resource: target.String(), Type: "restart", Status: "restarted"}
+		if err := target.Restart(ctx); err != nil {
+			entry.Status = "failed"
+			entry.Detail = err.Error()
+			report.addEntry(entry)
+			continue
+		}
+		if !config.Quiet {
+			fmt.Fprintf(ui, "Restarted %s, waiting for its new pod...\n", target)
+		}
+		newPod, err := netmon.WaitForReplacement(ctx, cfg, target, pods)
+		if err != nil {
+			entry.Status = "not ready"
+			entry.Detail = err.Error()
+		} else {
+			entry.Healthy = true
+			entry.Detail = "new pod " + newPod
+		}
+		report.addEntry(entry)
+	}
+	return report
+}
+
+// droppedWarning explains kernel drops, which otherwise look like packets
+// the application lost
+func droppedWarning(dropped int, during string) string {
+	return fmt.Sprintf("tcpdump dropped %d packets in the kernel while %s; the capture buffer overflowed, "+
+		"so these packets are missing from the results, not lost by the application. Retry with a larger -capture-buffer",
+		dropped, during)
+}
+
+// topFlows is the number of busiest flows reported by the ips action
+const topFlows = 10
+
+func runIPs() Report {
+	report := newReport("ips")
+	if err := netmon.CheckCapturePrivileges(); err != nil {
+		report.fail(err)
+		return report
+	}
+	inputs, err := loadSampleInputs()
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+	fmt.Fprintf(ui, "%sCollecting unique IPs (10 second sample)...%s\n", colorCyan, colorReset)
+	// an interrupt ends the sample early instead of exiting
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	stopSpinner := startSpinner(ctx, "Analyzing network traffic")
+	sample, err := netmon.SampleIPs(ctx, netmonConfig())
+	stopSpinner()
+	if ctx.Err() != nil {
+		report.note("Sampling interrupted; the IPs seen until then are shown")
+	}
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+	if sample.Dropped > 0 {
+		report.warn(droppedWarning(sample.Dropped, "sampling"))
+	}
+	if config.Direction != "" && sample.Directions == nil {
+		report.note("Direction qualifiers are not supported on this host; IPs were sampled in both directions without tags")
+	}
+	addSample(&report, sample, inputs)
+	writeIPList(&report)
+	if len(report.IPs) == 0 && report.Success {
+		report.note("No packets received during sampling period")
+	}
+	return report
+}
+
+// sampleInputs are the files addSample checks a sample against, loaded
+// before sampling so that a bad path fails at once instead of after it
+type sampleInputs struct {
+	allowlist netmon.Allowlist
+	geo       netmon.GeoIP
+	baseline  netmon.IPSample
+}
+
+// loadSampleInputs loads -ip-allowlist, -geoip-db and -ip-baseline, when
+// given
+func loadSampleInputs() (sampleInputs, error) {
+	var inputs sampleInputs
+	var err error
+	if config.IPAllowlist != "" {
+		if inputs.allowlist, err = netmon.LoadAllowlist(config.IPAllowlist); err != nil {
+			return inputs, configError("loading IP allowlist: %v", err)
+		}
+	}
+	if len(config.GeoIPDBs) > 0 {
+		if inputs.geo, err = openGeoIP(config.GeoIPDBs); err != nil {
+			return inputs, configError("opening GeoIP database: %v", err)
+		}
+	}
+	if config.IPBaseline != "" {
+		if inputs.baseline, err = netmon.LoadIPSample(config.IPBaseline); err != nil {
+			return inputs, configError("loading IP baseline: %v", err)
+		}
+	}
+	return inputs, nil
+}
+
+// geoIPCache holds the GeoIP databases already read, by path, so that
+// repeated menu runs do not read them again
+var (
+	geoIPCache   = map[string]*netmon.GeoIPDB{}
+	geoIPCacheMu sync.Mutex
+)
+
+// openGeoIP opens the MaxMind databases at paths, reusing those of an
+// earlier run
+func openGeoIP(paths []string) (netmon.GeoIP, error) {
+	geoIPCacheMu.Lock()
+	defer geoIPCacheMu.Unlock()
+	var geo netmon.GeoIP
+	for _, path := range paths {
+		db, ok := geoIPCache[path]
+		if !ok {
+			var err error
+			if db, err = netmon.OpenGeoIPDB(path); err != nil {
+				return nil, err
+			}
+			geoIPCache[path] = db
+		}
+		geo = append(geo, db)
+	}
+	return geo, nil
+}
+
+// addSample adds the IPs, top flows and peak rate of a sample to the report,
+// diffed against -ip-baseline when given
+func addSample(report *Report, sample netmon.Sample, inputs sampleInputs) {
+	report.IPs = sample.Sorted()
+	if config.IPAllowlist != "" {
+		unknown := inputs.allowlist.MarkUnknown(report.IPs)
+		report.note("%d of %d IPs are not in the allowlist %s", unknown, len(report.IPs), config.IPAllowlist)
+		if config.OnlyUnknownIPs {
+			var ips []netmon.IPCount
+			for _, ip := range report.IPs {
+				if ip.Unknown {
+					ips = append(ips, ip)
+				}
+			}
+			report.IPs = ips
+		}
+	}
+	if len(config.GeoIPDBs) > 0 {
+		inputs.geo.AnnotateIPs(report.IPs)
+	}
+	report.Flows = sample.TopFlows(topFlows)
+	if asymmetry := sample.Asymmetric(); len(asymmetry.SourcesOnly)+len(asymmetry.DestinationsOnly) > 0 {
+		report.Asymmetric = &asymmetry
+	}
+	if sample.PeakPPS > 0 {
+		report.note("Peak rate: %d packets/s", sample.PeakPPS)
+	}
+
+	if config.IPBaseline != "" {
+		diff := netmon.DiffIPSamples(inputs.baseline, sample.Counts)
+		diff.Baseline = config.IPBaseline
+		report.Diff = &diff
+	}
+}
+
+// writeIPList writes the report's IPs to stdout in the -ip-format chosen,
+// unless that is plain and they are part of the rendered report
+func writeIPList(report *Report) {
+	if ipStdout == nil || !report.Success {
+		return
+	}
+	if err := writeIPs(ipStdout, report.IPs, config.IPFormat); err != nil {
+		report.fail(fmt.Errorf("writing the IP list: %w", err))
+		return
+	}
+	report.note("Wrote %d IPs to stdout as %s", len(report.IPs), config.IPFormat)
+}
+
+// ipLogEntry is one sample in the -ip-log file
+type ipLogEntry struct {
+	Time    time.Time        `json:"time"`
+	Unique  int              `json:"unique"`
+	PeakPPS int              `json:"peakPps,omitempty"`
+	Dropped int              `json:"dropped,omitempty"`
+	IPs     []netmon.IPCount `json:"ips"`
+}
+
+// appendIPLog appends line to the -ip-log file. When the line would grow it
+// past -ip-log-max-size the file is first renamed with a timestamp, like a
+// rotated capture, and the oldest renamed files beyond -ip-log-keep are
+// deleted. It returns the rotated file, if any.
+func appendIPLog(line []byte, now time.Time) (string, error) {
+	rotated := ""
+	if info, err := os.Stat(config.IPLog); err == nil && info.Size() > 0 &&
+		uint64(info.Size())+uint64(len(line)) > uint64(config.IPLogMaxSize) {
+		ext := filepath.Ext(config.IPLog)
+		rotated = strings.TrimSuffix(config.IPLog, ext) + "-" + now.Format("20060102T150405") + ext
+		if err := os.Rename(config.IPLog, rotated); err != nil {
+			return "", err
+		}
+		if config.IPLogKeep > 0 {
+			old, _ := filepath.Glob(strings.TrimSuffix(config.IPLog, ext) + "-*" + ext)
+			// the timestamps sort chronologically
+			sort.Strings(old)
+			for len(old) > config.IPLogKeep {
+				os.Remove(old[0])
+				old = old[1:]
+			}
+		}
+	}
+
+	f, err := os.OpenFile(config.IPLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return rotated, err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return rotated, err
+	}
+	return rotated, f.Close()
+}
+
+// runRecordIPs samples the unique IPs every -ip-log-interval until
+// interrupted and appends each sample to -ip-log, building the long-term
+// data that normal traffic can be told from anomalies by
+func runRecordIPs() Report {
+	report := newReport("record-ips")
+	if config.IPLogInterval < 10*time.Second {
+		report.fail(configError("-ip-log-interval must be at least the 10s sampling window"))
+		return report
+	}
+	if err := netmon.CheckCapturePrivileges(); err != nil {
+		report.fail(err)
+		return report
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Fprintf(ui, "%sRecording a 10 second IP sample every %s to %s; press Ctrl-C to stop%s\n",
+		colorCyan, config.IPLogInterval, config.IPLog, colorReset)
+
+	samples := 0
+	for ctx.Err() == nil {
+		start := time.Now()
+		sample, err := netmon.SampleIPs(ctx, netmonConfig())
+		if err != nil {
+			report.fail(err)
+			break
+		}
+		if ctx.Err() != nil {
+			break // a partial window would understate the counts
+		}
+		line, err := json.Marshal(ipLogEntry{Time: start.UTC(), Unique: len(sample.Counts), PeakPPS: sample.PeakPPS,
+			Dropped: sample.Dropped, IPs: sample.Sorted()})
+		if err != nil {
+			report.fail(err)
+			break
+		}
+		rotated, err := appendIPLog(append(line, '\n'), start)
+		if err != nil {
+			report.fail(fmt.Errorf("writing %s: %v", config.IPLog, err))
+			break
+		}
+		if rotated != "" {
+			fmt.Fprintf(ui, "Rotated %s to %s\n", config.IPLog, rotated)
+		}
+		samples++
+		if !config.Quiet {
+			fmt.Fprintf(ui, "[%s] %d unique IPs\n", start.Format("15:04:05"), len(sample.Counts))
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(start.Add(config.IPLogInterval))):
+		}
+	}
+	report.Files = append(report.Files, config.IPLog)
+	report.note("Recorded %d samples to %s", samples, config.IPLog)
+	return report
+}
+
+// runWatchIPs samples the unique IPs in back-to-back windows until
+// interrupted and raises an alert for every window with more than
+// -talker-threshold of them, naming the IPs that were not in the window
+// before
+func runWatchIPs() Report {
+	report := newReport("watch-ips")
+	if config.TalkerThreshold <= 0 {
+		report.fail(configError("-talker-threshold must be a positive number of IPs"))
+		return report
+	}
+	if err := netmon.CheckCapturePrivileges(); err != nil {
+		report.fail(err)
+		return report
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Fprintf(ui, "%sSampling unique IPs in 10 second windows, alerting above %d; press Ctrl-C to stop%s\n",
+		colorCyan, config.TalkerThreshold, colorReset)
+
+	var previous netmon.IPSample
+	windows := 0
+	for ctx.Err() == nil {
+		sample, err := netmon.SampleIPs(ctx, netmonConfig())
+		if err != nil {
+			report.fail(err)
+			return report
+		}
+		if ctx.Err() != nil {
+			break // a partial window would understate the count
+		}
+		windows++
+		now := time.Now().Format("15:04:05")
+		count := len(sample.Counts)
+		if count <= config.TalkerThreshold {
+			if !config.Quiet {
+				fmt.Fprintf(ui, "[%s] %d unique IPs\n", now, count)
+			}
+		} else {
+			var added []string
+			for ip := range sample.Counts {
+				if _, ok := previous[ip]; !ok {
+					added = append(added, ip)
+				}
+			}
+			sort.Strings(added)
+			alert := fmt.Sprintf("[%s] %d unique IPs exceeds the threshold of %d", now, count, config.TalkerThreshold)
+			if len(added) > 0 {
+				alert += "; new: " + strings.Join(added, ", ")
+			}
+			fmt.Fprintf(ui, "%sALERT %s%s\n", colorRed, alert, colorReset)
+			report.warn(alert)
+		}
+		previous = sample.Counts
+	}
+	report.note("Sampled %d windows, %d above the threshold", windows, len(report.Warnings))
+	return report
+}
+
+// runWatchEndpoints polls the endpoints of -service every -endpoints-interval
+// until interrupted and logs each change of its ready addresses, which
+// catches readiness probes flapping a service's backends
+func runWatchEndpoints() Report {
+	report := newReport("watch-endpoints")
+	if err := requireFlags("service"); err != nil {
+		report.fail(err)
+		return report
+	}
+	if config.EndpointsInterval <= 0 {
+		report.fail(configError("-endpoints-interval must be positive"))
+		return report
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	previous, err := netmon.ServiceEndpoints(ctx, config.ServiceName)
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+	start := time.Now()
+	fmt.Fprintf(ui, "%sWatching the endpoints of %s every %s; press Ctrl-C to stop%s\n",
+		colorCyan, config.ServiceName, config.EndpointsInterval, colorReset)
+	fmt.Fprintf(ui, "[%s] %d ready: %s\n", start.Format("15:04:05"), len(previous.Ready), strings.Join(previous.Ready, ", "))
+	if len(previous.NotReady) > 0 {
+		fmt.Fprintf(ui, "%s[%s] not ready: %s%s\n", colorYellow, start.Format("15:04:05"), strings.Join(previous.NotReady, ", "), colorReset)
+	}
+
+	// failed is set while polls fail, so an outage is reported once
+	failed := false
+	for {
+		select {
+		case <-ctx.Done():
+			report.note("Watched %s for %s: %d endpoint changes", config.ServiceName,
+				time.Since(start).Round(time.Second), len(report.EndpointChanges))
+			return report
+		case <-time.After(config.EndpointsInterval):
+		}
+		endpoints, err := netmon.ServiceEndpoints(ctx, config.ServiceName)
+		if err != nil {
+			if ctx.Err() == nil && !failed {
+				fmt.Fprintf(ui, "%s[%s] %v%s\n", colorYellow, time.Now().Format("15:04:05"), err, colorReset)
+				report.warn("Polling endpoints failed at %s: %v", time.Now().Format(time.RFC3339), err)
+			}
+			failed = true
+			continue
+		}
+		failed = false
+		added, removed := endpoints.Diff(previous)
+		previous = endpoints
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		change := netmon.EndpointChange{Time: time.Now(), Added: added, Removed: removed,
+			Ready: len(endpoints.Ready), NotReady: endpoints.NotReady}
+		report.EndpointChanges = append(report.EndpointChanges, change)
+		fmt.Fprintf(ui, "%s%s%s\n", colorYellow, endpointChangeText(change), colorReset)
+	}
+}
+
+// endpointChangeText formats an endpoint change as one line, e.g.
+// "[15:04:05] +10.42.0.12 (pod-a) -10.42.1.7 (pod-b); 1 ready, not ready: 10.42.1.7 (pod-b)"
+func endpointChangeText(change netmon.EndpointChange) string {
+	var parts []string
+	for _, a := range change.Added {
+		parts = append(parts, "+"+a)
+	}
+	for _, a := range change.Removed {
+		parts = append(parts, "-"+a)
+	}
+	line := fmt.Sprintf("[%s] %s; %d ready", change.Time.Format("15:04:05"), strings.Join(parts, " "), change.Ready)
+	if len(change.NotReady) > 0 {
+		line += ", not ready: " + strings.Join(change.NotReady, ", ")
+	}
+	return line
+}
+
+// runReplay analyzes the IPs and flows of a saved capture like runIPs does
+// for live traffic
+func runReplay() Report {
+	report := newReport("replay")
+	if err := requireFlags("pcap-file"); err != nil {
+		report.fail(err)
+		return report
+	}
+	inputs, err := loadSampleInputs()
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+	sample, err := netmon.ReplayPcap(config.PcapFile)
+	if err != nil {
+		report.fail(configError("reading capture: %v", err))
+		return report
+	}
+	addSample(&report, sample, inputs)
+	writeIPList(&report)
+	if len(report.IPs) == 0 && report.Success {
+		report.note("No IPv4 packets in %s", config.PcapFile)
+	}
+	return report
+}
+
+// timelineTime formats timeline events to the microsecond tcpdump records
+const timelineTime = "2006-01-02 15:04:05.000000"
+
+// runTimeline interleaves the packets of -pcap-file with the lines of
+// -log-file by timestamp, around the log lines matching -timeline-match
+func runTimeline() Report {
+	report := newReport("timeline")
+	if err := requireFlags("pcap-file"); err != nil {
+		report.fail(err)
+		return report
+	}
+	var match *regexp.Regexp
+	if config.TimelineMatch != "" {
+		var err error
+		if match, err = regexp.Compile(config.TimelineMatch); err != nil {
+			report.fail(configError("-timeline-match: %v", err))
+			return report
+		}
+	}
+
+	packets, err := netmon.PcapEvents(config.PcapFile)
+	if err != nil {
+		report.fail(configError("reading capture: %v", err))
+		return report
+	}
+	// klog timestamps have no year; the capture's completes them
+	year := time.Now().Year()
+	if len(packets) > 0 {
+		year = packets[0].Time.Year()
+	}
+	logs, err := netmon.LogEvents(config.LogFile, year)
+	if err != nil {
+		report.fail(configError("reading log file: %v", err))
+		return report
+	}
+	if len(logs) == 0 {
+		report.note("No timestamped lines in %s; collect logs with timestamps (e.g. kubectl logs --timestamps) to line them up", config.LogFile)
+	}
+
+	report.Timeline = netmon.Timeline(packets, logs, match, config.TimelineWindow)
+	matches := 0
+	for _, event := range logs {
+		if event.Match {
+			matches++
+		}
+	}
+	switch {
+	case match == nil:
+		report.note("Timeline of %d packets and %d log lines", len(packets), len(logs))
+	case matches == 0:
+		report.note("No line of %s matches %q", config.LogFile, config.TimelineMatch)
+	default:
+		report.note("%d events within %s of the %d log lines matching %q", len(report.Timeline), config.TimelineWindow,
+			matches, config.TimelineMatch)
+	}
+	if len(packets) > 0 && len(logs) > 0 && (logs[len(logs)-1].Time.Before(packets[0].Time) || logs[0].Time.After(packets[len(packets)-1].Time)) {
+		report.warn("the capture and the log do not overlap in time; check that both clocks and time zones agree (log times without a zone are taken as UTC)")
+	}
+	return report
+}
+
+func runCapture() Report {
+	if config.CapturePod != "" {
+		return capturePodTraffic(config.CapturePod, config.ContainerName)
+	}
+	return runCaptureWith(netmonConfig(), "host")
+}
+
+// capturePodTraffic captures inside the network namespace of the pod
+// matching the prefix pod, entered with nsenter through the PID of its
+// container, so traffic between pods on the same node is seen without
+// host interfaces or a debug container in the pod
+func capturePodTraffic(pod, container string) Report {
+	podName := netmon.GetPodName(context.Background(), pod)
+	if podName == "" {
+		report := newReport("capture")
+		report.fail(configError("no pod found with prefix %s", pod))
+		return report
+	}
+	pid, err := netmon.ContainerPID(context.Background(), podName, container)
+	if err != nil {
+		report := newReport("capture")
+		report.fail(err)
+		return report
+	}
+	fmt.Fprintf(ui, "%sCapturing in the network namespace of pod %s (PID %d)%s\n", colorCyan, podName, pid, colorReset)
+	c := netmonConfig()
+	c.NetnsPID = pid
+	report := runCaptureWith(c, "pod "+podName)
+	report.note("Captured inside pod %s; interface names are the pod's", podName)
+	return report
+}
+
+// captureEntry is the status entry of one capture file: its packets, size
+// and peak rate, or the error tcpdump reported. The file is added to
+// report's files.
+func captureEntry(capture netmon.Capture, report *Report) netmon.StatusEntry {
+	entry := netmon.StatusEntry{Resource: captureName(capture.Interface, capture.Port), Type: "capture", Status: fmt.Sprintf("%d packets", capture.Packets), Healthy: true}
+	if capture.File == "-" {
+		entry.Detail = "streamed to stdout"
+	} else if info, statErr := os.Stat(capture.File); statErr == nil {
+		entry.Detail = fmt.Sprintf("%s (%d bytes)", capture.File, info.Size())
+		report.Files = append(report.Files, capture.File)
+	}
+	// tcpdump exits nonzero when stopped by a signal, so only its own
+	// complaints count as a failure
+	if capture.Err != nil && !strings.Contains(capture.Stderr, "packets captured") {
+		entry.Status = "error"
+		entry.Healthy = false
+		entry.Detail = firstLine(strings.TrimSpace(capture.Stderr))
+		if line := precisionError(capture.Stderr); config.TimePrecision != "" && line != "" {
+			entry.Detail = fmt.Sprintf("%s timestamps not supported: %s", config.TimePrecision, line)
+			report.note("%s does not support -time-precision=%s; retry with micro or without the flag",
+				capture.Interface, config.TimePrecision)
+		}
+	}
+	if capture.PeakPPS > 0 {
+		entry.Detail += fmt.Sprintf(", peak %d pps", capture.PeakPPS)
+	}
+	if config.FirstPacketPerFlow && entry.Healthy {
+		entry.Status = fmt.Sprintf("%d flows", capture.Flows)
+		entry.Detail += fmt.Sprintf(", first packet of each kept out of %d", capture.Packets)
+	}
+	return entry
+}
+
+// runCaptureWith runs the captures of c, in the network namespace of target,
+// and reports them
+func runCaptureWith(c netmon.Config, target string) Report {
+	report := newReport("capture")
+	// -preview asks once the packets are shown
+	if err := confirmStart(captureSummary(c, target), !config.Preview); err != nil {
+		report.fail(err)
+		return report
+	}
+	if config.Preview && !previewCapture(c, &report) {
+		return report
+	}
+	warnUnboundPorts(c, target, &report)
+	stopWatch := watchRestarts(config.Pods)
+	stopResources := sampleResources(config.Pods, config.ResourceLog, config.ResourceInterval)
+	// an interrupt stops the captures early instead of exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	startTime := time.Now()
+	markers := &captureMarkers{start: startTime}
+	ctx, stopKeys := quitOnKey(ctx, markers.mark)
+	if isTerminal(os.Stdin) {
+		fmt.Fprintf(ui, "%sPress m and Enter to mark this moment, followed by a note to label it (m retry 3)%s\n", colorCyan, colorReset)
+	}
+	result, err := netmon.CapturePackets(ctx, c)
+	duration := time.Since(startTime)
+	if stopKeys() {
+		report.note("Capture %s after %s", quitReason, duration.Round(time.Second))
+	}
+	markers.save(&report)
+	stop()
+	report.Restarts = stopWatch()
+	addResourceSamples(&report, stopResources())
+	if errors.Is(err, netmon.ErrLowDiskSpace) {
+		report.note("Capture stopped early: free space in %s dropped below %s",
+			filepath.Dir(config.CaptureFile), netmon.FormatBytes(uint64(config.MinFreeSpace)))
+	} else if err != nil {
+		report.fail(err)
+	}
+
+	captures := result.Captures
+	// hooked are the files handed to -post-capture-hook, by interface
+	var hooked []netmon.Capture
+	total, flows := 0, 0
+	// undirected lists the interfaces already noted as lacking direction
+	// qualifiers, which rotation would otherwise repeat for every file
+	undirected := map[string]bool{}
+	for _, capture := range captures {
+		entry := captureEntry(capture, &report)
+		if (config.Direction == netmon.DirectionIn || config.Direction == netmon.DirectionOut) &&
+			capture.Direction == "" && !undirected[capture.Interface] {
+			undirected[capture.Interface] = true
+			report.note("%s does not support direction qualifiers; both directions were captured", capture.Interface)
+		}
+		report.addEntry(entry)
+		if entry.Healthy {
+			hooked = append(hooked, capture)
+		}
+		if strings.Contains(capture.Stderr, "packets captured") {
+			report.Captures = append(report.Captures, CaptureStats{Interface: capture.Interface, Port: capture.Port, File: capture.File,
+				Captured: capture.Packets, Received: capture.Received, Dropped: capture.Dropped, Flows: capture.Flows})
+		}
+		if capture.Dropped > 0 {
+			report.warn(droppedWarning(capture.Dropped, "capturing "+capture.File))
+		}
+		total += capture.Packets
+		flows += capture.Flows
+	}
+
+	if config.MergeCaptures && config.CaptureRotate > 0 {
+		report.note("-merge is not applied to rotated captures")
+	} else if config.MergeCaptures && len(captures) > 1 {
+		fmt.Fprintf(ui, "Merging %d captures...\n", len(captures))
+		if merged, err := netmon.MergeCaptures(c, captures); err != nil {
+			report.note("Could not merge captures, the per-interface files are kept: %v", err)
+		} else {
+			report.Files = append(report.Files, merged)
+			hooked = []netmon.Capture{{Interface: "merged", File: merged}}
+		}
+	}
+
+	if config.PostCaptureHook != "" && report.Success {
+		for _, capture := range hooked {
+			if err := runPostCaptureHook(capture, duration); err != nil {
+				report.fail(err)
+				report.note("The capture %s was kept", capture.File)
+			}
+		}
+	}
+
+	if len(captures) > 0 {
+		if result.Interrupted {
+			report.note("Capture interrupted; partial captures were kept")
+		}
+		interfaces := map[string]bool{}
+		for _, capture := range captures {
+			interfaces[capture.Interface] = true
+		}
+		report.note("Captured %d packets on %d interface(s)", total, len(interfaces))
+		if config.SplitByPort {
+			report.note("Packets per port: %s", portTotals(captures))
+		}
+		if config.FirstPacketPerFlow {
+			report.note("Found %d distinct flows; TCP connections opened before the capture started are missing", flows)
+		}
+	}
+	return report
+}
+
+// captureMarker is a moment marked during a capture by typing m and Enter
+type captureMarker struct {
+	Time time.Time
+	Note string
+}
+
+// captureMarkers collects the markers of a running capture, whose keyboard
+// watcher calls mark from its own goroutine
+type captureMarkers struct {
+	start   time.Time
+	mu      sync.Mutex
+	markers []captureMarker
+}
+
+// mark records a marker for a line typed during the capture, m optionally
+// followed by a note. Other lines are ignored.
+func (m *captureMarkers) mark(line string) {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	if !strings.EqualFold(fields[0], "m") {
+		return
+	}
+	marker := captureMarker{Time: time.Now()}
+	if len(fields) == 2 {
+		marker.Note = strings.TrimSpace(fields[1])
+	}
+	m.mu.Lock()
+	m.markers = append(m.markers, marker)
+	n := len(m.markers)
+	m.mu.Unlock()
+	fmt.Fprintf(ui, "%sMarker %d at +%s%s\n", colorGreen, n, marker.Time.Sub(m.start).Round(time.Millisecond), colorReset)
+}
+
+// write writes one line per marker: its time, the offset into the capture
+// and its note, e.g. "2024-05-01T14:03:05.123456Z +1m2.5s marker 1: retry 3".
+// The times are RFC 3339, so timeline accepts the file as -log-file.
+func (m *captureMarkers) write(w io.Writer) error {
+	for i, marker := range m.markers {
+		line := fmt.Sprintf("%s +%s marker %d", marker.Time.UTC().Format(time.RFC3339Nano),
+			marker.Time.Sub(m.start).Round(time.Millisecond), i+1)
+		if marker.Note != "" {
+			line += ": " + marker.Note
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// save writes the markers next to -capture-file, or into the report when
+// the capture is streamed to stdout
+func (m *captureMarkers) save(report *Report) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.markers) == 0 {
+		return
+	}
+	if config.CaptureFile == "-" {
+		var b strings.Builder
+		m.write(&b)
+		for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+			report.note("Marker %s", line)
+		}
+		return
+	}
+	path := markersFile(config.CaptureFile)
+	f, err := os.Create(path)
+	if err == nil {
+		err = m.write(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		report.fail(fmt.Errorf("writing markers: %v", err))
+		return
+	}
+	report.Files = append(report.Files, path)
+	report.note("Wrote %d marker(s) to %s", len(m.markers), path)
+}
+
+// markersFile returns the sidecar file of the markers of a capture, e.g.
+// packets-markers.txt for packets.pcap
+func markersFile(captureFile string) string {
+	return strings.TrimSuffix(captureFile, filepath.Ext(captureFile)) + "-markers.txt"
+}
+
+// portTotals lists the packets captured per port by a -split-by-port
+// capture, over all interfaces, e.g. "4729: 120, 9996: 30"
+func portTotals(captures []netmon.Capture) string {
+	var ports []int
+	packets := map[int]int{}
+	for _, capture := range captures {
+		if _, ok := packets[capture.Port]; !ok {
+			ports = append(ports, capture.Port)
+		}
+		packets[capture.Port] += capture.Packets
+	}
+	parts := make([]string, len(ports))
+	for i, port := range ports {
+		parts[i] = fmt.Sprintf("%d: %d", port, packets[port])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// captureSummary describes the capture runCaptureWith is about to start
+func captureSummary(c netmon.Config, target string) string {
+	interfaces := "any"
+	if len(c.Interfaces) > 0 {
+		interfaces = strings.Join(c.Interfaces, ",")
+	}
+	duration := "for 1 minute"
+	switch {
+	case c.CaptureRotate > 0:
+		duration = fmt.Sprintf("rotating every %s until Ctrl-C", c.CaptureRotate)
+	case c.CaptureCount > 0:
+		duration = fmt.Sprintf("until %d packets", c.CaptureCount)
+	}
+	output := c.CaptureFile
+	if output == "-" {
+		output = "stdout"
+	}
+	if c.SplitByPort {
+		output += " split by port"
+	}
+	return fmt.Sprintf("Capture: %s, interface %s, filter %q, %s, to %s", target, interfaces, c.TcpdumpFilter, duration, output)
+}
+
+// previewWindow bounds how long -preview waits for matching packets
+const previewWindow = 10 * time.Second
+
+// previewCapture shows the first -preview-count packets matching the filter
+// and, when stdin is a terminal, asks whether to go on with the capture. It
+// returns false when the capture should not run.
+func previewCapture(c netmon.Config, report *Report) bool {
+	fmt.Fprintf(ui, "%sPreviewing up to %d packets matching %q for at most %s...%s\n",
+		colorCyan, config.PreviewCount, c.TcpdumpFilter, previewWindow, colorReset)
+	packets, err := netmon.PreviewPackets(context.Background(), c, config.PreviewCount, previewWindow)
+	if err != nil {
+		report.fail(err)
+		return false
+	}
+	if len(packets) == 0 {
+		fmt.Fprintf(ui, "%sNo packets matched within %s; check the filter and interface%s\n", colorYellow, previewWindow, colorReset)
+	}
+	if config.Yes || !isTerminal(os.Stdin) {
+		return true
+	}
+	fmt.Fprintf(ui, "%sStart the capture? [Y/n]%s ", colorYellow, colorReset)
+	answer, err := readLine()
+	if err != nil && err != io.EOF {
+		report.fail(err)
+		return false
+	}
+	if answer := strings.ToLower(answer); answer == "n" || answer == "no" {
+		report.note("Capture canceled after the preview; nothing was written")
+		return false
+	}
+	return true
+}
+
+// hookCommand splits a -post-capture-hook template into its arguments,
+// quoted like a systemd ExecStart line, and substitutes the {placeholders}
+// in each. Substituting per argument keeps file names with spaces intact
+// and out of reach of a shell.
+func hookCommand(template string, values map[string]string) ([]string, error) {
+	// with the ExecStart line given, only an unterminated quote fails
+	args, err := parseExecStart("ExecStart=" + template)
+	if err != nil {
+		return nil, fmt.Errorf("unterminated quote in %q", template)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	command := make([]string, len(args))
+	for i, arg := range args {
+		command[i] = arg.value
+		for name, value := range values {
+			command[i] = strings.ReplaceAll(command[i], "{"+name+"}", value)
+		}
+	}
+	return command, nil
+}
+
+// runPostCaptureHook runs -post-capture-hook for a finished capture file and
+// shows its output
+func runPostCaptureHook(capture netmon.Capture, duration time.Duration) error {
+	command, err := hookCommand(config.PostCaptureHook, map[string]string{
+		"file":      capture.File,
+		"interface": capture.Interface,
+		"duration":  strconv.Itoa(int(duration.Round(time.Second).Seconds())),
+	})
+	if err != nil {
+		return configError("-post-capture-hook: %v", err)
+	}
+	fmt.Fprintf(ui, "Running post-capture hook: %s\n", strings.Join(command, " "))
+	out, err := netmon.Command(context.Background(), command[0], command[1:]...).CombinedOutput()
+	if len(out) > 0 {
+		ui.Write(out)
+	}
+	if err != nil {
+		return fmt.Errorf("post-capture hook failed for %s: %v", capture.File, err)
+	}
+	return nil
+}
+
+// runDebug attaches an ephemeral container running -debug-image to the
+// first -pod pod, sharing the process namespace of -container (default the
+// pod's first container) and so also its network, and runs -debug-command
+// in it or an interactive shell. The container stops when the command or
+// shell exits; Kubernetes cannot remove ephemeral containers, so it stays
+// listed as terminated until the pod is recreated.
+func runDebug() Report {
+	report := newReport("debug")
+	if err := requireFlags("pod"); err != nil {
+		report.fail(err)
+		return report
+	}
+	ctx := context.Background()
+	podName := netmon.GetPodName(ctx, config.Pods[0])
+	if podName == "" {
+		report.fail(configError("no pod found with prefix %s", config.Pods[0]))
+		return report
+	}
+	target := config.ContainerName
+	if target == "" {
+		containers, err := netmon.PodContainers(ctx, podName)
+		if err != nil {
+			report.fail(err)
+			return report
+		}
+		if len(containers) == 0 {
+			report.fail(configError("pod %s has no containers", podName))
+			return report
+		}
+		target = containers[0]
+	} else if _, err := resolveContainer(podName, target); err != nil {
+		report.fail(err)
+		return report
+	}
+
+	var command []string
+	if config.DebugCommand != "" {
+		var err error
+		if command, err = hookCommand(config.DebugCommand, nil); err != nil {
+			report.fail(configError("-debug-command: %v", err))
+			return report
+		}
+	} else if !isTerminal(os.Stdin) {
+		report.fail(configError("an interactive debug shell needs a terminal; pass -debug-command to run a command instead"))
+		return report
+	}
+
+	name := fmt.Sprintf("netmon-debug-%d", time.Now().Unix())
+	args := []string{"debug", podName, "--image=" + config.DebugImage, "--target=" + target, "--container=" + name}
+	if command == nil {
+		args = append(args, "-it")
+	} else {
+		args = append(append(args, "--attach", "--"), command...)
+	}
+	fmt.Fprintf(ui, "%sLaunching %s in pod %s, sharing the namespaces of %s...%s\n",
+		colorCyan, config.DebugImage, podName, target, colorReset)
+	cmd := netmon.Command(context.Background(), "kubectl", netmon.KubectlArgs(args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	runErr := cmd.Run()
+
+	entry := netmon.StatusEntry{Resource: podName + "/" + name, Type: "debug", Status: "exited", Healthy: runErr == nil,
+		Detail: config.DebugImage}
+	if runErr != nil {
+		entry.Status = "failed"
+		entry.Detail = runErr.Error()
+	}
+	state, err := netmon.EphemeralContainerState(ctx, podName, name)
+	switch {
+	case err != nil:
+		report.note("Could not check the debug container: %v", err)
+	case state == "running":
+		report.warn(fmt.Sprintf("debug container %s in pod %s is still running; reattach with "+
+			"kubectl attach -it %s -c %s and exit its shell to stop it", name, podName, podName, name))
+	case state != "":
+		entry.Status = state
+	}
+	report.addEntry(entry)
+	if runErr != nil {
+		report.fail(&netmon.ActionError{Kind: netmon.ErrKubectl, Command: "kubectl debug", Err: runErr})
+	}
+	if state != "" {
+		report.note("Ephemeral containers cannot be removed; %s stays in the pod spec until the pod is recreated", name)
+	}
+	return report
+}
+
+func runLogs() Report {
+	report := newReport("logs")
+	if err := requireFlags("pod", "container"); err != nil {
+		report.fail(err)
+		return report
+	}
+
+	var jobs []*logJob
+	for _, prefix := range config.Pods {
+		job, err := newLogJob(prefix, len(config.Pods) > 1)
+		if err != nil {
+			report.fail(err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	if len(jobs) == 0 {
+		return report
+	}
+
+	if err := confirmStart(logsSummary(jobs), true); err != nil {
+		report.fail(err)
+		return report
+	}
+
+	single := len(config.Pods) == 1
+	stopWatch := watchRestarts(config.Pods)
+	stopResources := sampleResources(config.Pods, config.ResourceLog, config.ResourceInterval)
+	ctx, stopKeys := quitOnKey(context.Background(), nil)
+	if single {
+		job := jobs[0]
+		job.stopReason, job.err = collectLogs(ctx, job, netmonConfig().Progress)
+	} else {
+		collectLogsFromPods(ctx, jobs)
+	}
+	stopKeys()
+	report.Restarts = stopWatch()
+	addResourceSamples(&report, stopResources())
+
+	for _, job := range jobs {
+		// with several pods every result names the pod it is about
+		from := ""
+		if !single {
+			from = " from " + job.pod
+		}
+		if job.err != nil {
+			if !single {
+				job.err = fmt.Errorf("%s: %w", job.pod, job.err)
+			}
+			report.fail(job.err)
+			continue
+		}
+		if config.SinceLastRestart {
+			report.note("Logs%s start at %s: %s", from, job.started.Format(time.RFC3339), restartSummary(job, time.Now()))
+		}
+		if job.stopReason != "" {
+			report.note("Log collection%s stopped early: %s", from, job.stopReason)
+		}
+		if config.LogStopPattern != "" && job.stopMatch == "" {
+			report.note("-log-stop-pattern %s not found in the logs%s", config.LogStopPattern, from)
+		}
+		if job.redactions != nil {
+			report.note("Redacted%s: %s", from, redactionSummary(job.redactions))
+		}
+		if job.file == "-" {
+			report.note("Logs%s collected successfully and written to stdout", from)
+			continue
+		}
+		report.Files = append(report.Files, job.file)
+		report.note("Logs%s collected successfully. Please check %s", from, job.file)
+	}
+	for _, job := range jobs {
+		addPodEvents(&report, job.pod)
+	}
+	return report
+}
+
+// restartSummary tells how long ago the container of job last started, and
+// after how many restarts
+func restartSummary(job *logJob, now time.Time) string {
+	ago := now.Sub(job.started).Round(time.Second)
+	if job.restarts == 0 {
+		return fmt.Sprintf("%s started %s ago and has not restarted, so its full log was collected", job.container, ago)
+	}
+	return fmt.Sprintf("%s restarted %d times, last %s ago", job.container, job.restarts, ago)
+}
+
+// logsSummary describes the log collection runLogs is about to start
+func logsSummary(jobs []*logJob) string {
+	targets := make([]string, len(jobs))
+	files := make([]string, len(jobs))
+	for i, job := range jobs {
+		targets[i] = job.pod + "/" + job.container
+		files[i] = job.file
+		if job.file == "-" {
+			files[i] = "stdout"
+		}
+	}
+	namespace := "the current namespace"
+	if cluster, err := netmon.CurrentCluster(context.Background()); err == nil {
+		namespace = fmt.Sprintf("namespace %s (context %s)", cluster.Namespace, cluster.Context)
+	}
+	duration := "following for 5 minutes"
+	switch {
+	case !config.LogFollow && config.LogSince > 0:
+		duration = "the last " + config.LogSince.String()
+	case !config.LogFollow && config.SinceLastRestart:
+		duration = "since the last container start"
+	case !config.LogFollow:
+		duration = "the full history"
+	case config.LogSince > 0:
+		duration = fmt.Sprintf("the last %s, then following for 5 minutes", config.LogSince)
+	case config.SinceLastRestart:
+		duration = "since the last container start, then following for 5 minutes"
+	}
+	return fmt.Sprintf("Logs: %s in %s, %s, to %s", strings.Join(targets, ", "), namespace, duration, strings.Join(files, ", "))
+}
+
+// collectLogsFromPods collects the logs of every job in parallel, showing a
+// single progress bar for all of them
+func collectLogsFromPods(ctx context.Context, jobs []*logJob) {
+	printLogCollectionStart()
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job *logJob) {
+			defer wg.Done()
+			job.stopReason, job.err = collectLogs(ctx, job, nil)
+		}(job)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	startTime := time.Now()
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			clearStatusLine()
+			return
+		case <-ticker.C:
+			if config.LogFollow {
+				progress := int(time.Since(startTime).Seconds() * 100 / 300)
+				printProgress(progress, 100, fmt.Sprintf("Collecting logs from %d pods: ", len(jobs)))
+			}
+		}
+	}
+}
+
+func runMenu() {
+	fmt.Printf("\n%sNetwork Monitoring Debug Tool v1.0%s\n", colorCyan, colorReset)
+	fmt.Printf("Monitoring pod: %s, container: %s, service: %s\n",
+		strings.Join(config.Pods, ","), config.ContainerName, config.ServiceName)
+	if cluster, err := netmon.CurrentCluster(context.Background()); err == nil {
+		fmt.Printf("Cluster: %s at %s (context %s)\n", cluster.Name, cluster.Server, cluster.Context)
+	}
+	fmt.Println("This tool helps you troubleshoot network monitoring and packet collection issues")
+
+	var session []sessionAction
+	for {
+		choice, err := showMenu()
+		if err != nil {
+			exitMenuOnInputError(err)
+			renderSessionSummary(session, os.Stdout)
+			return
+		}
+
+		var run func() Report
+		switch choice {
+		case "1":
+			run = runStatus
+		case "2":
+			run = runNodePort
+		case "3":
+			run = runIPs
+		case "4":
+			run = runCapture
+		case "5":
+			run = runLogs
+		case "6":
+			run = runRestartPod
+		case "7":
+			run = runChangeFilter
+		case "8":
+			run = runDebug
+		case "9":
+			run = runSelectPod
+		case "10":
+			run = runSelectService
+		case "11":
+			renderSessionSummary(session, os.Stdout)
+			fmt.Printf("\n%sThank you for using Network Monitoring Debug Tool. Goodbye!%s\n",
+				colorCyan, colorReset)
+			return
+		default:
+			fmt.Printf("%sInvalid choice. Please select a number between 1 and 11.%s\n",
+				colorYellow, colorReset)
+		}
+		if run != nil {
+			started := time.Now()
+			report := run()
+			session = append(session, sessionAction{Started: started, Duration: time.Since(started), Report: report})
+			render(report, config.Output, os.Stdout)
+			notifyWebhook(report)
+		}
+
+		fmt.Printf("\nPress Enter to continue...")
+		if _, err := readLine(); err != nil {
+			exitMenuOnInputError(err)
+			renderSessionSummary(session, os.Stdout)
+			return
+		}
+	}
+}
+
+// sessionAction is an action run from the menu, for the session summary
+type sessionAction struct {
+	Started  time.Time
+	Duration time.Duration
+	Report   Report
+}
+
+// renderSessionSummary prints the actions run from the menu, the files they
+// wrote with their current sizes and the errors they hit, as a record of the
+// debugging session
+func renderSessionSummary(session []sessionAction, w io.Writer) {
+	if len(session) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n%sSession summary:%s\n", colorCyan, colorReset)
+	actionWidth := len("ACTION")
+	for _, action := range session {
+		actionWidth = maxInt(actionWidth, len(action.Report.Action))
+	}
+	fmt.Fprintf(w, "%-8s  %-*s  %-8s  %-6s  %s\n", "TIME", actionWidth, "ACTION", "DURATION", "RESULT", "FILES")
+	var errs []string
+	for _, action := range session {
+		result, color := "ok", colorGreen
+		if !action.Report.Success {
+			result, color = "failed", colorRed
+		}
+		fmt.Fprintf(w, "%-8s  %-*s  %-8s  %s%-6s%s  %d\n", action.Started.Format("15:04:05"), actionWidth, action.Report.Action,
+			action.Duration.Round(time.Second), color, result, colorReset, len(action.Report.Files))
+		for _, err := range action.Report.Errors {
+			errs = append(errs, action.Report.Action+": "+err)
+		}
+	}
+
+	var files []string
+	for _, action := range session {
+		files = append(files, action.Report.Files...)
+	}
+	if len(files) > 0 {
+		fmt.Fprintf(w, "\n%sFiles written:%s\n", colorGreen, colorReset)
+		for _, file := range files {
+			size := "missing"
+			if info, err := os.Stat(file); err == nil {
+				size = netmon.FormatBytes(uint64(info.Size()))
+			}
+			fmt.Fprintf(w, "  - %s (%s)\n", file, size)
+		}
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(w, "\n%sErrors:%s\n", colorRed, colorReset)
+		for _, err := range errs {
+			fmt.Fprintf(w, "  - %s\n", err)
+		}
+	}
+}
+
+// podNamespace is the namespace of the pod picked by runSelectPod, which
+// the service picked must share since kubectl runs in one namespace
+var podNamespace string
+
+// runSelectPod lists the pods of every namespace, numbered, and makes the
+// one picked the -pod of the rest of the menu session, running kubectl in
+// its namespace
+func runSelectPod() Report {
+	report := newReport("select-pod")
+	pods, err := netmon.ListAllPods(context.Background())
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+	rows := make([][]string, len(pods))
+	for i, pod := range pods {
+		rows[i] = []string{pod.Metadata.Namespace, pod.Metadata.Name, pod.Status.Phase, pod.Spec.NodeName}
+	}
+	i, err := pickRow("Pod", []string{"NAMESPACE", "NAME", "STATUS", "NODE"}, rows, strings.Join(config.Pods, ","))
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+	if i < 0 {
+		report.note("Keeping target pod: %s", strings.Join(config.Pods, ","))
+		return report
+	}
+	pod := pods[i]
+	config.Pods = []string{pod.Metadata.Name}
+	if config.ServiceName != "" && netmon.KubeNamespace != pod.Metadata.Namespace {
+		report.note("Target service %s is now looked up in namespace %s too; select it again if it is elsewhere",
+			config.ServiceName, pod.Metadata.Namespace)
+	}
+	netmon.KubeNamespace = pod.Metadata.Namespace
+	podNamespace = pod.Metadata.Namespace
+	report.note("Target pod set to: %s (namespace %s)", pod.Metadata.Name, pod.Metadata.Namespace)
+	return report
+}
+
+// runSelectService lists the services of every namespace, numbered, and
+// makes the one picked the -service of the rest of the menu session,
+// running kubectl in its namespace. After a pod was picked, only services
+// in the pod's namespace can be.
+func runSelectService() Report {
+	report := newReport("select-service")
+	services, err := netmon.ListAllServices(context.Background())
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+	rows := make([][]string, len(services))
+	for i, service := range services {
+		rows[i] = []string{service.Metadata.Namespace, service.Metadata.Name, service.Spec.Type,
+			service.Spec.ClusterIP, servicePorts(service)}
+	}
+	i, err := pickRow("Service", []string{"NAMESPACE", "NAME", "TYPE", "CLUSTER-IP", "PORTS"}, rows, config.ServiceName)
+	if err != nil {
+		report.fail(err)
+		return report
+	}
+	if i < 0 {
+		report.note("Keeping target service: %s", config.ServiceName)
+		return report
+	}
+	service := services[i]
+	if podNamespace != "" && len(config.Pods) > 0 && service.Metadata.Namespace != podNamespace {
+		report.fail(configError("service %s is in namespace %s but target pod %s is in %s; select a pod in %s first",
+			service.Metadata.Name, service.Metadata.Namespace, strings.Join(config.Pods, ","), podNamespace, service.Metadata.Namespace))
+		return report
+	}
+	config.ServiceName = service.Metadata.Name
+	netmon.KubeNamespace = service.Metadata.Namespace
+	report.note("Target service set to: %s (namespace %s)", service.Metadata.Name, service.Metadata.Namespace)
+	return report
+}
+
+// servicePorts formats the ports of a service like kubectl get services,
+// e.g. "2055:32055/UDP" with the nodePort after the port
+func servicePorts(service netmon.Service) string {
+	ports := make([]string, 0, len(service.Spec.Ports))
+	for _, port := range service.Spec.Ports {
+		p := strconv.Itoa(port.Port)
+		if port.NodePort != 0 {
+			p += ":" + strconv.Itoa(port.NodePort)
+		}
+		ports = append(ports, p+"/"+port.Protocol)
+	}
+	return strings.Join(ports, ",")
+}
+
+// pickRow shows rows as a numbered table and prompts for one, returning its
+// index, or -1 on empty input to keep current. Typing anything but a number
+// narrows the table to the rows containing it, ignoring case.
+func pickRow(what string, header []string, rows [][]string, current string) (int, error) {
+	shown := make([]int, len(rows))
+	for i := range rows {
+		shown[i] = i
+	}
+	for {
+		if len(shown) == 0 {
+			fmt.Printf("%sNo %ss match.%s\n", colorYellow, strings.ToLower(what), colorReset)
+			return -1, nil
+		}
+		printRows(os.Stdout, header, rows, shown)
+		fmt.Printf("%s%s number, text to filter by, or Enter to keep %s:%s ", colorYellow, what, current, colorReset)
+		input, err := readLine()
+		if err != nil && err != io.EOF {
+			return -1, err
+		}
+		input = strings.TrimSpace(input)
+		if input == "" {
+			return -1, nil
+		}
+		if n, convErr := strconv.Atoi(input); convErr == nil {
+			if n >= 1 && n <= len(shown) {
+				return shown[n-1], nil
+			}
+			fmt.Printf("%sInvalid choice. Please select a number between 1 and %d.%s\n", colorYellow, len(shown), colorReset)
+		} else {
+			filter := strings.ToLower(input)
+			var matched []int
+			for _, i := range shown {
+				if strings.Contains(strings.ToLower(strings.Join(rows[i], "\x00")), filter) {
+					matched = append(matched, i)
+				}
+			}
+			shown = matched
+		}
+		if err == io.EOF {
+			return -1, nil
+		}
+	}
+}
+
+// printRows writes the rows of indexes shown as a table numbered from 1
+func printRows(w io.Writer, header []string, rows [][]string, shown []int) {
+	widths := make([]int, len(header))
+	for col, title := range header {
+		widths[col] = len(title)
+		for _, i := range shown {
+			if len(rows[i][col]) > widths[col] {
+				widths[col] = len(rows[i][col])
+			}
+		}
+	}
+	numWidth := len(strconv.Itoa(len(shown)))
+	line := func(num string, cells []string) {
+		fmt.Fprintf(w, "  %*s", numWidth, num)
+		for col, cell := range cells {
+			if col == len(cells)-1 {
+				fmt.Fprintf(w, "  %s\n", cell)
+			} else {
+				fmt.Fprintf(w, "  %-*s", widths[col], cell)
+			}
+		}
+	}
+	line("#", header)
+	for n, i := range shown {
+		line(strconv.Itoa(n+1), rows[i])
+	}
+}
+
+// runChangeFilter prompts for a new tcpdump filter, keeping the current one
+// on empty input, and uses it for the rest of the menu session once tcpdump
+// accepts it
+func runChangeFilter() Report {
+	report := newReport("filter")
+	cni := netmon.DetectCNI(context.Background(), flannelBackend())
+	if filter := cni.OverlayFilter(); filter != "" {
+		fmt.Printf("Overlay traffic of %s: %s\n", cni, filter)
+	}
+	fmt.Printf("%sNew capture filter [%s]:%s ", colorYellow, config.TcpdumpFilter, colorReset)
+	filter, err := readLine()
+	if err != nil && err != io.EOF {
+		report.fail(err)
+		return report
+	}
+	if filter == "" {
+		report.note("Keeping capture filter: %s", config.TcpdumpFilter)
+		return report
+	}
+	if err := netmon.ValidateFilter(context.Background(), filter); err != nil {
+		report.fail(err)
+		report.note("Keeping capture filter: %s", config.TcpdumpFilter)
+		return report
+	}
+	config.TcpdumpFilter = filter
+	report.note("Capture filter set to: %s", filter)
+	for _, warning := range netmon.FilterWarnings(filter) {
+		report.warn("Capture filter: %s", warning)
+	}
+	return report
+}
+
+// exitMenuOnInputError ends the menu when stdin is closed or unreadable,
+// e.g. when run without a TTY, instead of looping on empty input
+func exitMenuOnInputError(err error) {
+	fmt.Println()
+	if err == io.EOF {
+		fmt.Printf("%sNo more input on stdin, exiting. Use a subcommand or -action to run non-interactively.%s\n",
+			colorYellow, colorReset)
+		return
+	}
+	fmt.Printf("%sError reading input: %v%s\n", colorRed, err, colorReset)
+}
+
+// webhookPayload is what -webhook-url receives when an action finishes
+type webhookPayload struct {
+	Action    string   `json:"action"`
+	Success   bool     `json:"success"`
+	Artifacts []string `json:"artifacts"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// webhookAttempts is how often a webhook is tried before giving up, pausing
+// webhookRetryPause longer after each failure
+const webhookAttempts = 3
+
+var webhookRetryPause = time.Second
+
+// webhookBody encodes the notification for a finished action, in Slack's
+// incoming webhook format with -webhook-format=slack
+func webhookBody(r Report, format string) ([]byte, error) {
+	payload := webhookPayload{Action: r.Action, Success: r.Success, Artifacts: r.Files,
+		Error: strings.Join(r.Errors, "; ")}
+	if payload.Artifacts == nil {
+		payload.Artifacts = []string{}
+	}
+	if format != "slack" {
+		return json.Marshal(payload)
+	}
+
+	text := fmt.Sprintf(":white_check_mark: %s succeeded", r.Action)
+	if !r.Success {
+		text = fmt.Sprintf(":x: %s failed", r.Action)
+		if payload.Error != "" {
+			text += ": " + payload.Error
+		}
+	}
+	if host, err := os.Hostname(); err == nil {
+		text += " on " + host
+	}
+	for _, file := range r.Files {
+		text += "\n• " + file
+	}
+	return json.Marshal(map[string]string{"text": text})
+}
+
+// notifyWebhook posts the report summary to -webhook-url, if set. A failed
+// notification is only a warning, the action itself is done.
+func notifyWebhook(r Report) {
+	if config.WebhookURL == "" {
+		return
+	}
+	if err := postWebhook(r); err != nil {
+		fmt.Fprintf(os.Stderr, "%sWarning: %v%s\n", colorYellow, err, colorReset)
+	}
+}
+
+// postWebhook posts the report summary to -webhook-url, retrying failed
+// attempts with a growing pause
+func postWebhook(r Report) error {
+	body, err := webhookBody(r, config.WebhookFormat)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: config.WebhookTimeout}
+	for attempt := 1; ; attempt++ {
+		var resp *http.Response
+		resp, err = client.Post(config.WebhookURL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+		if attempt == webhookAttempts {
+			return fmt.Errorf("webhook %s failed after %d attempts: %v", config.WebhookURL, attempt, err)
+		}
+		time.Sleep(time.Duration(attempt) * webhookRetryPause)
+	}
+}
+
+func main() {
+	cmd := parseCommand(os.Args[1:])
+	if cmd.name == "install-completion" {
+		// set here: its script lists the commands, which cannot refer to it
+		cmd.run = runInstallCompletion
+	}
+	if cmd.run == nil {
+		runMenu()
+		return
+	}
+
+	report := cmd.run()
+	render(report, config.Output, os.Stdout)
+	notifyWebhook(report)
+	if !report.Success {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,79 @@
+package netmon
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Allowlist is a set of networks discovered IPs are expected to be in
+type Allowlist []*net.IPNet
+
+// LoadAllowlist reads an allowlist file of IPs and CIDRs, one per line.
+// Blank lines and # comments are ignored.
+func LoadAllowlist(path string) (Allowlist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var allowlist Allowlist
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if i := strings.IndexByte(entry, '#'); i >= 0 {
+			entry = entry[:i]
+		}
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("line %d: invalid IP %q", line, entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		allowlist = append(allowlist, network)
+	}
+	return allowlist, scanner.Err()
+}
+
+// Contains reports whether ip is in one of the allowed networks
+func (a Allowlist) Contains(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range a {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkUnknown flags the IPs not covered by the allowlist as Unknown and
+// returns how many there are
+func (a Allowlist) MarkUnknown(ips []IPCount) int {
+	unknown := 0
+	for i := range ips {
+		ips[i].Unknown = !a.Contains(ips[i].IP)
+		if ips[i].Unknown {
+			unknown++
+		}
+	}
+	return unknown
+}
@@ -0,0 +1,575 @@
+package netmon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Capture is one tcpdump run capturing one interface to one file
+type Capture struct {
+	Interface string
+	// Port is the filter port the capture was limited to with SplitByPort
+	Port    int
+	File    string
+	Packets int
+	// Direction is the direction the capture was limited to, "" when the
+	// interface does not support direction qualifiers
+	Direction string
+	// Err is how tcpdump exited. It also exits nonzero when stopped by a
+	// signal, so only a Stderr without its statistics means it failed.
+	Err    error
+	Stderr string
+	// Received is the packets tcpdump reported as received by its filter,
+	// which counts packets it did not get to capture as well
+	Received int
+	// Dropped is the packets tcpdump reported as dropped by the kernel
+	// because its buffer was full
+	Dropped int
+	// PeakPPS is the packet rate of the busiest second in the file
+	PeakPPS int
+	// Flows is the number of flows first seen in this file with
+	// Config.FirstPacketPerFlow
+	Flows int
+}
+
+// CaptureResult is what CapturePackets captured. Interrupted is set when the
+// context was canceled before the capture ended.
+type CaptureResult struct {
+	Captures    []Capture
+	Interrupted bool
+}
+
+// captureJob is a running tcpdump process
+type captureJob struct {
+	Capture
+	cmd    *Cmd
+	stderr bytes.Buffer
+	// filtered is closed once the first packets of the job's stream are
+	// written, with first packet per flow
+	filtered chan struct{}
+	flowErr  error
+}
+
+// captureTarget is what one tcpdump captures: an interface with its filter
+// and, with SplitByPort, one of the filter's ports
+type captureTarget struct {
+	iface  string
+	port   int
+	filter string
+	// direction is c.Direction when the filter was limited to it
+	direction string
+}
+
+// captureTargets pairs every interface with its filter, or with one filter
+// per port of the filter when c.SplitByPort is set
+func (c Config) captureTargets(ctx context.Context, interfaces []string) ([]captureTarget, error) {
+	var ports []int
+	if c.SplitByPort {
+		if ports = FilterPorts(c.TcpdumpFilter); len(ports) == 0 {
+			return nil, configError("the filter %q names no ports to split the capture by", c.TcpdumpFilter)
+		}
+	}
+	filters := c.captureFilters(ctx, interfaces)
+	var targets []captureTarget
+	for _, iface := range interfaces {
+		target := captureTarget{iface: iface, filter: filters[iface]}
+		if filters[iface] != c.TcpdumpFilter {
+			target.direction = c.Direction
+		}
+		if !c.SplitByPort {
+			targets = append(targets, target)
+			continue
+		}
+		for _, port := range ports {
+			split := target
+			split.port = port
+			split.filter = fmt.Sprintf("(%s) and port %d", target.filter, port)
+			targets = append(targets, split)
+		}
+	}
+	return targets, nil
+}
+
+// filterPortRegex matches the port primitives of a filter
+var filterPortRegex = regexp.MustCompile(`\bport\s+(\d+)\b`)
+
+// FilterPorts returns the ports a filter names in port primitives, e.g.
+// 4729 and 9996 for "udp port 4729 or udp port 9996", in order of appearance
+func FilterPorts(filter string) []int {
+	var ports []int
+	seen := map[int]bool{}
+	for _, m := range filterPortRegex.FindAllStringSubmatch(strings.ToLower(filter), -1) {
+		port, err := strconv.Atoi(m[1])
+		if err == nil && !seen[port] {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+var packetsCapturedRegex = regexp.MustCompile(`(\d+) packets? captured`)
+
+// bufferArgs returns the tcpdump option setting c.CaptureBuffer, if any
+func (c Config) bufferArgs() []string {
+	if c.CaptureBuffer <= 0 {
+		return nil
+	}
+	return []string{"-B", strconv.Itoa(c.CaptureBuffer)}
+}
+
+// captureInterfaces returns the interfaces to capture on, c.Interfaces with
+// their patterns expanded or any when empty
+func (c Config) captureInterfaces() ([]string, error) {
+	interfaces, err := c.ExpandInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	if len(interfaces) == 0 {
+		return []string{"any"}, nil
+	}
+	for _, iface := range c.Interfaces {
+		if isInterfacePattern(iface) {
+			fmt.Fprintf(c.Output, "Interfaces matching %s: %s\n", strings.Join(c.Interfaces, ","), strings.Join(interfaces, ", "))
+			break
+		}
+	}
+	return interfaces, nil
+}
+
+// captureFileFor returns the output file for target. With several
+// interfaces each gets its own file, e.g. packets.pcap becomes
+// packets-eth0.pcap, and with SplitByPort each port, e.g. packets-4729.pcap.
+func (c Config) captureFileFor(target captureTarget, multiple bool) string {
+	if c.streaming() {
+		return c.CaptureFile
+	}
+	ext := filepath.Ext(c.CaptureFile)
+	file := strings.TrimSuffix(c.CaptureFile, ext)
+	if multiple {
+		file += "-" + target.iface
+	}
+	if target.port > 0 {
+		file += "-" + strconv.Itoa(target.port)
+	}
+	return file + ext
+}
+
+// streaming reports whether the capture goes to CaptureWriter, not a file
+func (c Config) streaming() bool {
+	return c.CaptureFile == "-"
+}
+
+// timestampedFile inserts t into a capture file name before its extension,
+// e.g. packets.pcap becomes packets-20240102T150405.pcap
+func timestampedFile(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + t.Format("20060102T150405") + ext
+}
+
+// tcpdumpSupportsPrecision reports whether tcpdump was built with libpcap
+// timestamp precision support, which it lists in its usage text
+func tcpdumpSupportsPrecision() bool {
+	out, _ := Command(context.Background(), "tcpdump", "--help").CombinedOutput()
+	return strings.Contains(string(out), "time-stamp-precision")
+}
+
+// CapturePackets runs one tcpdump per configured interface, all sharing the
+// same filter, for one minute, until c.CaptureCount packets were captured
+// or, with c.CaptureRotate, in rotating windows until ctx is canceled. Canceling ctx stops every capture early; the
+// captures are returned either way so partial captures can still be reported.
+func CapturePackets(ctx context.Context, c Config) (CaptureResult, error) {
+	c = c.withDefaults()
+	if err := c.checkDirection(); err != nil {
+		return CaptureResult{}, err
+	}
+	if c.CaptureCount > 0 && c.CaptureRotate > 0 {
+		return CaptureResult{}, configError("a capture count cannot be combined with rotation")
+	}
+	if err := CheckCapturePrivileges(); err != nil {
+		return CaptureResult{}, err
+	}
+
+	interfaces, err := c.captureInterfaces()
+	if err != nil {
+		return CaptureResult{}, err
+	}
+	if c.streaming() && (len(interfaces) > 1 || c.CaptureRotate > 0 || c.SplitByPort) {
+		return CaptureResult{}, configError("a capture to stdout needs a single interface, no rotation and no split by port")
+	}
+	if c.streaming() && c.FirstPacketPerFlow {
+		return CaptureResult{}, configError("keeping the first packet per flow needs a capture file")
+	}
+	targets, err := c.captureTargets(ctx, interfaces)
+	if err != nil {
+		return CaptureResult{}, err
+	}
+
+	p := c.colors()
+	if c.TimePrecision != "" && !tcpdumpSupportsPrecision() {
+		fmt.Fprintf(c.Output, "%sWarning: this tcpdump does not list --time-stamp-precision; %s timestamps are probably not supported%s\n",
+			p.yellow, c.TimePrecision, p.reset)
+	}
+
+	if c.SplitByPort {
+		var ports []string
+		for _, port := range FilterPorts(c.TcpdumpFilter) {
+			ports = append(ports, strconv.Itoa(port))
+		}
+		fmt.Fprintf(c.Output, "Capturing each port to its own file: %s\n", strings.Join(ports, ", "))
+	}
+
+	var flows *firstPackets
+	if c.FirstPacketPerFlow {
+		flows = newFirstPackets()
+	}
+	var jobs []*captureJob
+	var interrupted bool
+	if c.CaptureRotate > 0 {
+		jobs, interrupted, err = c.captureRotating(ctx, interfaces, targets, flows)
+	} else if c.CaptureCount > 0 {
+		fmt.Fprintf(c.Output, "%sStarting packet capture on %s until %d packets are captured...%s\n", p.cyan,
+			strings.Join(interfaces, ", "), c.CaptureCount, p.reset)
+		jobs, interrupted, err = c.captureWindow(ctx, targets, len(interfaces) > 1, 0, time.Time{}, flows)
+	} else {
+		fmt.Fprintf(c.Output, "%sStarting packet capture on %s for 1 minute...%s\n", p.cyan,
+			strings.Join(interfaces, ", "), p.reset)
+		jobs, interrupted, err = c.captureWindow(ctx, targets, len(interfaces) > 1, time.Minute, time.Time{}, flows)
+	}
+
+	result := CaptureResult{Interrupted: interrupted}
+	for _, job := range jobs {
+		job.Stderr = job.stderr.String()
+		result.Captures = append(result.Captures, job.Capture)
+	}
+	return result, err
+}
+
+// captureRotating restarts the captures into new timestamped files every
+// c.CaptureRotate until ctx is canceled. With c.CaptureKeep only that many
+// files per target are kept, the oldest being deleted as new ones roll over.
+func (c Config) captureRotating(ctx context.Context, interfaces []string, targets []captureTarget, flows *firstPackets) ([]*captureJob, bool, error) {
+	p := c.colors()
+	fmt.Fprintf(c.Output, "%sCapturing on %s in %s files until interrupted...%s\n", p.cyan,
+		strings.Join(interfaces, ", "), c.CaptureRotate, p.reset)
+
+	var kept []*captureJob
+	for {
+		jobs, interrupted, err := c.captureWindow(ctx, targets, len(interfaces) > 1, c.CaptureRotate, time.Now(), flows)
+		kept = c.pruneCaptures(append(kept, jobs...), len(targets))
+		if err != nil || interrupted {
+			return kept, interrupted, err
+		}
+		for _, job := range jobs {
+			fmt.Fprintf(c.Output, "%sRolled over %s (%d packets)%s\n", p.green, job.File, job.Packets, p.reset)
+		}
+	}
+}
+
+// pruneCaptures deletes the oldest capture files beyond c.CaptureKeep per
+// target and returns the jobs whose files remain. jobs are in the order
+// they were captured.
+func (c Config) pruneCaptures(jobs []*captureJob, targets int) []*captureJob {
+	if c.CaptureKeep <= 0 || len(jobs) <= c.CaptureKeep*targets {
+		return jobs
+	}
+	p := c.colors()
+	excess := len(jobs) - c.CaptureKeep*targets
+	for _, job := range jobs[:excess] {
+		if err := os.Remove(job.File); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(c.Output, "%sCould not remove %s: %v%s\n", p.yellow, job.File, err, p.reset)
+			continue
+		}
+		fmt.Fprintf(c.Output, "Removed oldest capture %s\n", job.File)
+	}
+	return jobs[excess:]
+}
+
+// ErrLowDiskSpace stops a capture when free space drops below c.MinFreeSpace
+var ErrLowDiskSpace = captureError(errors.New("free disk space is low"))
+
+// captureBytes returns the combined size of the jobs' capture files
+func captureBytes(jobs []*captureJob) uint64 {
+	var total uint64
+	for _, job := range jobs {
+		if info, err := os.Stat(job.File); err == nil {
+			total += uint64(info.Size())
+		}
+	}
+	return total
+}
+
+// capturedAll reports whether every exited tcpdump of a counted capture
+// finished cleanly, having captured its packets
+func capturedAll(jobs []*captureJob) bool {
+	for _, job := range jobs {
+		if job.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// captureWindow runs one tcpdump per target for duration, or with
+// c.CaptureCount until every tcpdump has captured that many packets. multiple
+// tells whether several interfaces are captured, which then name their files.
+// When stamp is set it is added to the file names. With flows set, tcpdump
+// writes to a pipe and only the first packet of each flow reaches the files.
+func (c Config) captureWindow(ctx context.Context, targets []captureTarget, multiple bool, duration time.Duration,
+	stamp time.Time, flows *firstPackets) ([]*captureJob, bool, error) {
+	var jobs []*captureJob
+	var wg sync.WaitGroup
+	stopAll := func() {
+		for _, job := range jobs {
+			job.cmd.Process.Signal(os.Interrupt)
+		}
+		wg.Wait()
+	}
+
+	for _, target := range targets {
+		iface := target.iface
+		job := &captureJob{Capture: Capture{Interface: iface, Port: target.port, File: c.captureFileFor(target, multiple),
+			Direction: target.direction}}
+		if !stamp.IsZero() {
+			job.File = timestampedFile(job.File, stamp)
+		}
+		args := append([]string{"-i", iface, "-nn", "-s", strconv.Itoa(c.Snaplen)}, c.bufferArgs()...)
+		if c.TimePrecision != "" {
+			args = append(args, "--time-stamp-precision", c.TimePrecision)
+		}
+		if c.CaptureCount > 0 {
+			args = append(args, "-c", strconv.Itoa(c.CaptureCount))
+		}
+		if c.CaptureCount > 0 || c.streaming() || flows != nil {
+			// -U writes every packet at once, so progress can count them
+			// and a reader of the stream sees them live
+			args = append(args, "-U")
+		}
+		filter, output := target.filter, job.File
+		if flows != nil {
+			filter, output = firstPacketFilter(filter), "-"
+		}
+		job.cmd = c.tcpdump(context.Background(), append(args, "-w", output, filter)...)
+		job.cmd.Stderr = &job.stderr
+		if c.streaming() {
+			job.cmd.Stdout = c.CaptureWriter
+		}
+		var stream, pipe *os.File
+		if flows != nil {
+			var err error
+			if stream, pipe, err = os.Pipe(); err != nil {
+				stopAll()
+				return jobs, false, captureError(err)
+			}
+			job.cmd.Stdout = pipe
+		}
+		err := job.cmd.Start()
+		if pipe != nil {
+			// only tcpdump may hold the write end, so that its exit ends
+			// the stream
+			pipe.Close()
+		}
+		if err != nil {
+			if stream != nil {
+				stream.Close()
+			}
+			stopAll()
+			return jobs, false, captureError(fmt.Errorf("starting on %s: %v", iface, err))
+		}
+		jobs = append(jobs, job)
+		if stream != nil {
+			job.filtered = make(chan struct{})
+			go func() {
+				defer close(job.filtered)
+				defer stream.Close()
+				job.Flows, job.PeakPPS, job.flowErr = flows.write(stream, job.File)
+			}()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job.Err = job.cmd.Wait()
+		}()
+	}
+
+	dir := filepath.Dir(jobs[0].File)
+	if free, err := freeSpace(dir); err == nil && !c.streaming() {
+		fmt.Fprintf(c.Output, "Free space in %s: %s\n", dir, FormatBytes(free))
+	}
+
+	startTime := time.Now()
+	endTime := startTime.Add(duration)
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	// stop waiting early if every tcpdump exits on its own, e.g. because it
+	// rejected an option
+	exited := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(exited)
+	}()
+
+	p := c.colors()
+	var err error
+	interrupted, estimated := false, false
+	counted, target := false, c.CaptureCount*len(jobs)
+	for !interrupted && !counted && err == nil && (c.CaptureCount > 0 || time.Now().Before(endTime)) {
+		elapsed := time.Since(startTime)
+		// a stream cannot be counted, nor a file with only the first packet
+		// of each flow; tcpdump reports its count at the end
+		switch {
+		case c.CaptureCount > 0 && !c.streaming() && flows == nil:
+			captured := 0
+			for _, job := range jobs {
+				if n := filePackets(job.File); n < c.CaptureCount {
+					captured += n
+				} else {
+					captured += c.CaptureCount
+				}
+			}
+			c.CountProgress(captured, target, "Capturing packets: ")
+		case c.CaptureCount == 0:
+			c.Progress(int(elapsed*100/duration), 100, "Capturing packets: ")
+		}
+		select {
+		case <-ctx.Done():
+			interrupted = true
+			fmt.Fprintf(c.Output, "\n%sInterrupted, stopping all captures...%s\n", p.yellow, p.reset)
+		case <-exited:
+			if c.CaptureCount > 0 && capturedAll(jobs) {
+				counted = true
+				continue
+			}
+			err = captureError(errors.New("exited before the capture ended"))
+			c.ClearStatusLine()
+		case <-ticker.C:
+			free, statErr := freeSpace(dir)
+			if statErr != nil || c.streaming() {
+				continue
+			}
+			if free < c.MinFreeSpace {
+				err = ErrLowDiskSpace
+				fmt.Fprintf(c.Output, "\n%sOnly %s free in %s (below -min-free-space %s), stopping all captures...%s\n",
+					p.yellow, FormatBytes(free), dir, FormatBytes(c.MinFreeSpace), p.reset)
+				continue
+			}
+			// estimate once the rate has had a few seconds to settle
+			if !estimated && elapsed >= 10*time.Second {
+				estimated = true
+				rate := float64(captureBytes(jobs)) / elapsed.Seconds()
+				if rate > 0 && free > c.MinFreeSpace {
+					remaining := time.Duration(float64(free-c.MinFreeSpace)/rate) * time.Second
+					c.ClearStatusLine()
+					fmt.Fprintf(c.Output, "Writing %s/s; free space lasts about %s at this rate\n",
+						FormatBytes(uint64(rate)), remaining.Round(time.Minute))
+				}
+			}
+		}
+	}
+	if !interrupted && err == nil && c.CaptureCount > 0 {
+		c.CountProgress(target, target, "Capturing packets: ")
+	} else if !interrupted && err == nil {
+		c.Progress(100, 100, "Capturing packets: ")
+	}
+
+	// SIGINT lets tcpdump flush its buffer and print its statistics
+	stopAll()
+	for _, job := range jobs {
+		if m := packetsCapturedRegex.FindStringSubmatch(job.stderr.String()); m != nil {
+			job.Packets, _ = strconv.Atoi(m[1])
+		}
+		job.Received = receivedPackets(job.stderr.String())
+		job.Dropped = droppedPackets(job.stderr.String())
+		if job.filtered != nil {
+			<-job.filtered
+			if job.flowErr != nil && err == nil {
+				err = captureError(fmt.Errorf("keeping the first packet per flow: %v", job.flowErr))
+			}
+		} else if !c.streaming() {
+			job.PeakPPS = filePeakRate(job.File)
+		}
+	}
+	return jobs, interrupted, err
+}
+
+// MergeCaptures combines the per-interface captures into one file next to
+// c.CaptureFile, using mergecap when it is installed and the built-in
+// merger otherwise. It returns the merged file.
+func MergeCaptures(c Config, captures []Capture) (string, error) {
+	c = c.withDefaults()
+	ext := filepath.Ext(c.CaptureFile)
+	output := strings.TrimSuffix(c.CaptureFile, ext) + "-merged" + ext
+
+	var files, interfaces []string
+	for _, capture := range captures {
+		if _, err := os.Stat(capture.File); err == nil {
+			files = append(files, capture.File)
+			interfaces = append(interfaces, capture.Interface)
+		}
+	}
+	if len(files) < 2 {
+		return "", errors.New("fewer than two capture files to merge")
+	}
+
+	if _, err := exec.LookPath("mergecap"); err == nil {
+		out, err := Command(context.Background(), "mergecap", append([]string{"-w", output}, files...)...).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("mergecap: %s", firstLine(strings.TrimSpace(string(out))))
+		}
+		return output, nil
+	}
+
+	if err := mergePcaps(files, interfaces, output); err != nil {
+		os.Remove(output)
+		return "", err
+	}
+	return output, nil
+}
+
+// hasRawSocketAccess reports whether this process may open raw sockets,
+// which is what tcpdump needs to capture
+func hasRawSocketAccess() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_UDP)
+	if err != nil {
+		return false
+	}
+	syscall.Close(fd)
+	return true
+}
+
+// TcpdumpCanCapture runs a short capture attempt, which also covers a tcpdump
+// binary that was granted capabilities with setcap
+func TcpdumpCanCapture() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	out, _ := Command(ctx, "tcpdump", "-i", "any", "-c", "1", "-w", os.DevNull).CombinedOutput()
+	lower := strings.ToLower(string(out))
+	return !strings.Contains(lower, "permission") && !strings.Contains(lower, "not permitted")
+}
+
+// CheckCapturePrivileges is run before any tcpdump so a missing privilege is
+// reported upfront instead of producing an empty capture
+func CheckCapturePrivileges() error {
+	if hasRawSocketAccess() || TcpdumpCanCapture() {
+		return nil
+	}
+	return &ActionError{Kind: ErrCapture, Err: errors.New("insufficient privileges to capture packets with tcpdump; " +
+		"run this tool with sudo, or grant tcpdump the capability: " +
+		"sudo setcap cap_net_raw,cap_net_admin+ep $(which tcpdump)")}
+}
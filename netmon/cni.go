@@ -0,0 +1,185 @@
+package netmon
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CNIConfDirs are searched for CNI network configurations, the standard
+// directory first and then the one of k3s's embedded flannel
+var CNIConfDirs = []string{"/etc/cni/net.d", "/var/lib/rancher/k3s/agent/etc/cni/net.d"}
+
+// cniPodPrefixes maps the name prefixes of CNI agent pods to their plugin
+var cniPodPrefixes = map[string]string{
+	"calico-node":  "calico",
+	"canal":        "canal",
+	"cilium":       "cilium",
+	"kube-flannel": "flannel",
+	"weave-net":    "weave",
+}
+
+// CNI is the CNI plugin found by DetectCNI
+type CNI struct {
+	// Name is the plugin, e.g. flannel, calico or cilium; "" when unknown
+	Name string `json:"name"`
+	// Backend is the flannel backend, e.g. vxlan or wireguard-native
+	Backend string `json:"backend,omitempty"`
+	// Evidence lists where the plugin was seen
+	Evidence []string `json:"evidence"`
+}
+
+func (c CNI) String() string {
+	if c.Name == "" {
+		return "unknown"
+	}
+	if c.Backend != "" {
+		return c.Name + " (" + c.Backend + ")"
+	}
+	return c.Name
+}
+
+// OverlayFilter returns a tcpdump filter for the traffic the plugin
+// encapsulates pod traffic in, or "" when it does not encapsulate or is
+// unknown
+func (c CNI) OverlayFilter() string {
+	switch c.Name {
+	case "flannel", "canal":
+		switch c.Backend {
+		case "wireguard-native":
+			return "udp port 51820 or udp port 51821"
+		case "host-gw", "none":
+			return ""
+		}
+		return "udp port 8472"
+	case "calico":
+		// VXLAN, IP-in-IP or WireGuard, depending on the IP pool
+		return "udp port 4789 or ip proto 4 or udp port 51820"
+	case "cilium":
+		// VXLAN, Geneve or WireGuard, depending on the tunnel mode
+		return "udp port 8472 or udp port 6081 or udp port 51871"
+	case "weave":
+		return "udp port 6784 or udp port 6783"
+	}
+	return ""
+}
+
+// DetectCNI determines the active CNI plugin from the network configuration
+// kubelet loads, the CNI agent pods running in the cluster and, for k3s's
+// embedded flannel which has neither, flannelBackend, the value of k3s's
+// --flannel-backend ("" when unset, i.e. vxlan)
+func DetectCNI(ctx context.Context, flannelBackend string) CNI {
+	var cni CNI
+	if name, file := cniConfPlugin(); name != "" {
+		cni.Name = name
+		cni.Evidence = append(cni.Evidence, file)
+	}
+
+	args := []string{"get", "pods", "--all-namespaces", "-o", "jsonpath={.items[*].metadata.name}"}
+	if out, err := runKubectl(ctx, args...); err == nil {
+		for _, pod := range strings.Fields(string(out)) {
+			name := cniPodPlugin(pod)
+			if name == "" || (cni.Name != "" && name != cni.Name) {
+				continue
+			}
+			cni.Name = name
+			cni.Evidence = append(cni.Evidence, "pod "+pod)
+			break
+		}
+	}
+
+	if flannelBackend != "" {
+		cni.Evidence = append(cni.Evidence, "k3s --flannel-backend="+flannelBackend)
+	}
+	// with flannel-backend=none k3s runs without flannel, and its
+	// replacement was not found if the name is still unknown
+	if cni.Name == "" && flannelBackend != "" && flannelBackend != "none" {
+		cni.Name = "flannel"
+	}
+	if cni.Name == "flannel" {
+		cni.Backend = flannelBackend
+		if cni.Backend == "" {
+			cni.Backend = "vxlan"
+		}
+	}
+	return cni
+}
+
+// cniConfPlugin returns the plugin of the network configuration kubelet
+// uses, the lexically first file of the first CNIConfDirs directory that has
+// one, and the file
+func cniConfPlugin() (string, string) {
+	for _, dir := range CNIConfDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		var files []string
+		for _, entry := range entries {
+			switch filepath.Ext(entry.Name()) {
+			case ".conf", ".conflist", ".json":
+				files = append(files, filepath.Join(dir, entry.Name()))
+			}
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			if name := confPlugin(file); name != "" {
+				return name, file
+			}
+		}
+	}
+	return "", ""
+}
+
+// confPlugin returns the plugin named by the first plugin type of a CNI
+// .conf or .conflist file
+func confPlugin(file string) string {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	var conf struct {
+		Name    string `json:"name"`
+		Type    string `json:"type"`
+		Plugins []struct {
+			Type string `json:"type"`
+		} `json:"plugins"`
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return ""
+	}
+	types := []string{conf.Type}
+	for _, plugin := range conf.Plugins {
+		types = append(types, plugin.Type)
+	}
+	for _, t := range types {
+		switch {
+		case t == "":
+			continue
+		case strings.HasPrefix(t, "cilium"):
+			return "cilium"
+		case t == "calico" && strings.Contains(conf.Name, "canal"):
+			return "canal"
+		case t == "calico" || t == "flannel":
+			return t
+		case strings.HasPrefix(t, "weave"):
+			return "weave"
+		default:
+			return t
+		}
+	}
+	return ""
+}
+
+// cniPodPlugin returns the plugin whose agent runs in pod, or ""
+func cniPodPlugin(pod string) string {
+	for prefix, name := range cniPodPrefixes {
+		if strings.HasPrefix(pod, prefix+"-") {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+package netmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandLog, when set, receives a line for every command run through
+// Command with its start time, duration, exit status and the command line
+// quoted for a shell, as an audit trail and a way to repeat the steps by hand
+var CommandLog io.Writer
+
+var commandLogMu sync.Mutex
+
+// Cmd is an exec.Cmd that records itself in CommandLog when it finishes
+type Cmd struct {
+	*exec.Cmd
+	started time.Time
+}
+
+// Command returns a command like exec.CommandContext that is logged to
+// CommandLog
+func Command(ctx context.Context, name string, args ...string) *Cmd {
+	return &Cmd{Cmd: exec.CommandContext(ctx, name, args...)}
+}
+
+// Start starts the command; Wait logs it
+func (c *Cmd) Start() error {
+	c.started = time.Now()
+	err := c.Cmd.Start()
+	if err != nil {
+		c.log(err)
+	}
+	return err
+}
+
+// Wait waits for a started command and logs it
+func (c *Cmd) Wait() error {
+	err := c.Cmd.Wait()
+	c.log(err)
+	return err
+}
+
+// Run starts the command, waits for it and logs it
+func (c *Cmd) Run() error {
+	c.started = time.Now()
+	err := c.Cmd.Run()
+	c.log(err)
+	return err
+}
+
+// Output runs the command, logs it and returns its standard output
+func (c *Cmd) Output() ([]byte, error) {
+	c.started = time.Now()
+	out, err := c.Cmd.Output()
+	c.log(err)
+	return out, err
+}
+
+// CombinedOutput runs the command, logs it and returns its standard output
+// and standard error
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	c.started = time.Now()
+	out, err := c.Cmd.CombinedOutput()
+	c.log(err)
+	return out, err
+}
+
+func (c *Cmd) log(err error) {
+	if CommandLog == nil {
+		return
+	}
+	status := "exit=0"
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr) && exitErr.ExitCode() >= 0:
+		status = fmt.Sprintf("exit=%d", exitErr.ExitCode())
+	case errors.As(err, &exitErr):
+		// killed, e.g. a capture stopped at its duration
+		status = "signal=" + strings.TrimPrefix(exitErr.String(), "signal: ")
+	case err != nil:
+		status = "error=" + ShellQuote(err.Error())
+	}
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = ShellQuote(arg)
+	}
+	commandLogMu.Lock()
+	defer commandLogMu.Unlock()
+	fmt.Fprintf(CommandLog, "%s %s %s %s\n", c.started.Format(time.RFC3339), time.Since(c.started).Round(time.Millisecond),
+		status, strings.Join(args, " "))
+}
+
+// ShellQuote quotes s for a POSIX shell when it contains anything but
+// characters that are safe unquoted
+func ShellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+:,./@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,68 @@
+package netmon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Directions understood by Config.Direction. An empty direction captures
+// both directions without telling them apart.
+const (
+	DirectionIn   = "in"
+	DirectionOut  = "out"
+	DirectionBoth = "both"
+)
+
+// directionQualifiers maps a direction to its pcap-filter qualifier
+var directionQualifiers = map[string]string{DirectionIn: "inbound", DirectionOut: "outbound"}
+
+// checkDirection rejects an unknown c.Direction
+func (c Config) checkDirection() error {
+	switch c.Direction {
+	case "", DirectionIn, DirectionOut, DirectionBoth:
+		return nil
+	}
+	return configError("unknown direction %q (want in, out or both)", c.Direction)
+}
+
+// directionFilter restricts filter to the packets received (in) or sent
+// (out) by this host; any other direction leaves it unchanged
+func directionFilter(filter, direction string) string {
+	qualifier, ok := directionQualifiers[direction]
+	if !ok {
+		return filter
+	}
+	return qualifier + " and (" + filter + ")"
+}
+
+// supportsDirection reports whether the inbound and outbound qualifiers can be
+// used on iface, which libpcap only allows for some link types. Failures
+// other than an unsupported qualifier are left for the capture to report.
+func (c Config) supportsDirection(ctx context.Context, iface string) bool {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	out, err := c.tcpdump(ctx, "-d", "-i", iface, "inbound").CombinedOutput()
+	return err == nil || !strings.Contains(string(out), "not supported")
+}
+
+// captureFilters returns the filter of each interface, restricted to
+// c.Direction on the interfaces that support direction qualifiers
+func (c Config) captureFilters(ctx context.Context, interfaces []string) map[string]string {
+	p := c.colors()
+	filters := make(map[string]string, len(interfaces))
+	for _, iface := range interfaces {
+		filters[iface] = c.TcpdumpFilter
+		if _, ok := directionQualifiers[c.Direction]; !ok {
+			continue
+		}
+		if !c.supportsDirection(ctx, iface) {
+			fmt.Fprintf(c.Output, "%sWarning: %s does not support direction qualifiers, capturing both directions%s\n",
+				p.yellow, iface, p.reset)
+			continue
+		}
+		filters[iface] = directionFilter(c.TcpdumpFilter, c.Direction)
+	}
+	return filters
+}
@@ -0,0 +1,98 @@
+package netmon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Endpoints are the addresses behind a service, each an IP followed by the
+// pod it belongs to, e.g. "10.42.0.12 (flow-collector-7d9f8b6c4-x2kqp)"
+type Endpoints struct {
+	Ready []string `json:"ready"`
+	// NotReady are the addresses of pods failing their readiness probe,
+	// which the service does not route to
+	NotReady []string `json:"notReady,omitempty"`
+}
+
+// EndpointChange is a change of the ready endpoints of a service
+type EndpointChange struct {
+	Time     time.Time `json:"time"`
+	Added    []string  `json:"added,omitempty"`
+	Removed  []string  `json:"removed,omitempty"`
+	Ready    int       `json:"ready"`
+	NotReady []string  `json:"notReady,omitempty"`
+}
+
+// ServiceEndpoints returns the current endpoints of service
+func ServiceEndpoints(ctx context.Context, service string) (Endpoints, error) {
+	args := []string{"get", "endpoints", service, "-o", "json"}
+	out, err := runKubectl(ctx, args...)
+	if err != nil {
+		return Endpoints{}, kubectlError(args, err)
+	}
+	type address struct {
+		IP        string `json:"ip"`
+		TargetRef struct {
+			Name string `json:"name"`
+		} `json:"targetRef"`
+	}
+	var endpoints struct {
+		Subsets []struct {
+			Addresses         []address `json:"addresses"`
+			NotReadyAddresses []address `json:"notReadyAddresses"`
+		} `json:"subsets"`
+	}
+	if err := json.Unmarshal(out, &endpoints); err != nil {
+		return Endpoints{}, kubectlError(args, fmt.Errorf("parsing endpoints: %v", err))
+	}
+
+	// subsets split the addresses by port set, so one may appear in several
+	name := func(a address) string {
+		if a.TargetRef.Name == "" {
+			return a.IP
+		}
+		return a.IP + " (" + a.TargetRef.Name + ")"
+	}
+	ready, notReady := map[string]bool{}, map[string]bool{}
+	for _, subset := range endpoints.Subsets {
+		for _, a := range subset.Addresses {
+			ready[name(a)] = true
+		}
+		for _, a := range subset.NotReadyAddresses {
+			notReady[name(a)] = true
+		}
+	}
+	return Endpoints{Ready: sortedKeys(ready), NotReady: sortedKeys(notReady)}, nil
+}
+
+// Diff returns the ready addresses added and removed since previous
+func (e Endpoints) Diff(previous Endpoints) (added, removed []string) {
+	before, after := map[string]bool{}, map[string]bool{}
+	for _, a := range previous.Ready {
+		before[a] = true
+	}
+	for _, a := range e.Ready {
+		after[a] = true
+		if !before[a] {
+			added = append(added, a)
+		}
+	}
+	for _, a := range previous.Ready {
+		if !after[a] {
+			removed = append(removed, a)
+		}
+	}
+	return added, removed
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,66 @@
+package netmon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// EventWarning is the type of events reporting a problem, e.g. OOMKilling,
+// FailedScheduling or an Unhealthy probe
+const EventWarning = "Warning"
+
+// Event is a Kubernetes event about a pod
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Reason  string    `json:"reason"`
+	Pod     string    `json:"pod"`
+	Message string    `json:"message"`
+	// Count is how often the event occurred, 1 for a single occurrence
+	Count int `json:"count"`
+}
+
+// PodEvents returns the events of pod, oldest first
+func PodEvents(ctx context.Context, pod string) ([]Event, error) {
+	args := []string{"get", "events", "--field-selector", "involvedObject.name=" + pod, "--sort-by=.lastTimestamp", "-o", "json"}
+	out, err := runKubectl(ctx, args...)
+	if err != nil {
+		return nil, kubectlError(args, err)
+	}
+	var list struct {
+		Items []struct {
+			Type           string `json:"type"`
+			Reason         string `json:"reason"`
+			Message        string `json:"message"`
+			Count          int    `json:"count"`
+			InvolvedObject struct {
+				Name string `json:"name"`
+			} `json:"involvedObject"`
+			FirstTimestamp time.Time `json:"firstTimestamp"`
+			LastTimestamp  time.Time `json:"lastTimestamp"`
+			EventTime      time.Time `json:"eventTime"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, kubectlError(args, fmt.Errorf("parsing events: %v", err))
+	}
+
+	events := make([]Event, 0, len(list.Items))
+	for _, item := range list.Items {
+		event := Event{Time: item.LastTimestamp, Type: item.Type, Reason: item.Reason, Pod: item.InvolvedObject.Name,
+			Message: item.Message, Count: item.Count}
+		// events.k8s.io/v1 events only set eventTime
+		for _, t := range []time.Time{item.EventTime, item.FirstTimestamp} {
+			if event.Time.IsZero() {
+				event.Time = t
+			}
+		}
+		if event.Count == 0 {
+			event.Count = 1
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
@@ -0,0 +1,129 @@
+package netmon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// LoadFilterFile reads a tcpdump filter from a file. Everything after a # on
+// a line is a comment, and the remaining words are joined with single spaces
+// so the expression can be spread over several lines.
+func LoadFilterFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", configError("reading filter file: %v", err)
+	}
+
+	var words []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		words = append(words, strings.Fields(line)...)
+	}
+	if len(words) == 0 {
+		return "", configError("filter file %s contains no filter", path)
+	}
+	return strings.Join(words, " "), nil
+}
+
+// ValidateFilter compiles filter with tcpdump -d, which prints the BPF
+// program without capturing anything, so that a syntax error is reported
+// before a capture starts. Failures unrelated to the filter, such as a
+// missing tcpdump, are left for the capture itself to report.
+func ValidateFilter(ctx context.Context, filter string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	out, err := Command(ctx, "tcpdump", "-d", filter).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.Contains(line, "syntax error") || strings.Contains(line, "filter expression") {
+			return &ActionError{Kind: ErrConfig, Command: "tcpdump -d",
+				Err: fmt.Errorf("invalid filter %q: %s", filter, strings.TrimSpace(line))}
+		}
+	}
+	return nil
+}
+
+// filterTerm is a primitive of a tcpdump filter: a bare transport such as
+// udp, or a port optionally qualified by transport and direction
+type filterTerm struct {
+	transport string
+	port      string
+}
+
+// filterTransports are the protocols a bare filter term can select
+var filterTransports = map[string]bool{"udp": true, "tcp": true, "sctp": true, "icmp": true}
+
+// parseFilterTerm classifies a primitive such as "udp", "port 4729" or
+// "udp dst port 4729"; ok is false for anything else
+func parseFilterTerm(s string) (filterTerm, bool) {
+	words := strings.Fields(s)
+	var term filterTerm
+	if len(words) > 0 && filterTransports[words[0]] {
+		term.transport, words = words[0], words[1:]
+	}
+	if len(words) > 0 && (words[0] == "src" || words[0] == "dst") {
+		return filterTerm{}, false // direction makes it narrower than "port"
+	}
+	switch {
+	case len(words) == 0 && term.transport != "":
+		return term, true
+	case len(words) == 2 && words[0] == "port":
+		term.port = words[1]
+		return term, true
+	}
+	return filterTerm{}, false
+}
+
+// FilterWarnings points out redundant and contradictory parts of a filter:
+// alternatives listed twice, ports already matched by a bare transport
+// alternative such as "udp or udp port 4729", and conjunctions of different
+// transports that can never match. Filters with parentheses or negations are
+// not analyzed.
+func FilterWarnings(filter string) []string {
+	normalized := strings.ToLower(strings.Join(strings.Fields(filter), " "))
+	normalized = strings.NewReplacer(" || ", " or ", " && ", " and ").Replace(normalized)
+	if strings.ContainsAny(normalized, "()!") || strings.Contains(" "+normalized+" ", " not ") {
+		return nil
+	}
+
+	var warnings []string
+	seen := map[string]bool{}
+	broad := map[string]bool{}
+	alternatives := strings.Split(normalized, " or ")
+	for _, alternative := range alternatives {
+		if seen[alternative] {
+			warnings = append(warnings, fmt.Sprintf("%q is listed more than once", alternative))
+		}
+		seen[alternative] = true
+		if term, ok := parseFilterTerm(alternative); ok && term.port == "" {
+			broad[term.transport] = true
+		}
+
+		transports := map[string]bool{}
+		for _, part := range strings.Split(alternative, " and ") {
+			if term, ok := parseFilterTerm(part); ok && term.transport != "" {
+				transports[term.transport] = true
+			}
+		}
+		if len(transports) > 1 {
+			warnings = append(warnings, fmt.Sprintf("%q can never match: a packet has only one transport", alternative))
+		}
+	}
+
+	redundant := map[string]bool{}
+	for _, alternative := range alternatives {
+		if term, ok := parseFilterTerm(alternative); ok && term.port != "" && broad[term.transport] && !redundant[alternative] {
+			redundant[alternative] = true
+			warnings = append(warnings, fmt.Sprintf("%q is redundant: %q already matches all %s traffic",
+				alternative, term.transport, strings.ToUpper(term.transport)))
+		}
+	}
+	return warnings
+}
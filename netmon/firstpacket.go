@@ -0,0 +1,101 @@
+package netmon
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// firstPacketFilter limits filter to the TCP packets opening a connection,
+// SYN and SYN-ACK, leaving the other protocols to firstPackets
+func firstPacketFilter(filter string) string {
+	const syn = "(not tcp or tcp[tcpflags] & tcp-syn != 0)"
+	if filter == "" {
+		return syn
+	}
+	return fmt.Sprintf("(%s) and %s", filter, syn)
+}
+
+// firstPackets keeps the first packet of each flow out of the tcpdump
+// streams of a capture. The flows seen are shared by every interface and
+// rotated window, so a flow is kept once, in the file it was first seen in.
+type firstPackets struct {
+	mu   sync.Mutex
+	seen map[Flow]bool
+}
+
+func newFirstPackets() *firstPackets {
+	return &firstPackets{seen: map[Flow]bool{}}
+}
+
+// add records flow and reports whether it is new
+func (f *firstPackets) add(flow Flow) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.seen[flow] {
+		return false
+	}
+	f.seen[flow] = true
+	return true
+}
+
+// flowKey is the flow of a packet regardless of its direction: the 5-tuple
+// of a TCP or UDP packet, or the address pair of other IPv4 packets, with
+// the lower endpoint first, so that a reply belongs to its request's flow
+func flowKey(src, dst string, flow Flow) Flow {
+	if flow.Proto == "" {
+		flow = Flow{SrcIP: src, DstIP: dst}
+	}
+	if flow.DstIP < flow.SrcIP || flow.DstIP == flow.SrcIP && flow.DstPort < flow.SrcPort {
+		flow.SrcIP, flow.DstIP = flow.DstIP, flow.SrcIP
+		flow.SrcPort, flow.DstPort = flow.DstPort, flow.SrcPort
+	}
+	return flow
+}
+
+// write reads the pcap stream of tcpdump -w - from r and writes the packets
+// of flows not seen before to the file at path, along with the packets that
+// are not IPv4. It returns the number of those flows and the packet rate of
+// the busiest second of the whole stream, since the file only holds a few
+// of its packets. The file is only created once tcpdump wrote its header.
+func (f *firstPackets) write(r io.Reader, path string) (flows, peak int, err error) {
+	// whatever goes wrong, tcpdump must not block on a full pipe
+	defer io.Copy(io.Discard, r)
+	reader, err := newPcapReader(r)
+	if err != nil {
+		// tcpdump failed before writing anything; its stderr tells why
+		return 0, 0, nil
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer out.Close()
+	if err := reader.writeHeader(out); err != nil {
+		return 0, 0, err
+	}
+
+	bins := map[int64]int{}
+	for {
+		packet, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return flows, peakRate(bins), fmt.Errorf("%s: %v", path, err)
+		}
+		bins[packet.timestamp/1e9]++
+		if src, dst, flow, ok := decodeIPv4(packet.linkType, packet.data); ok {
+			if !f.add(flowKey(src, dst, flow)) {
+				continue
+			}
+			flows++
+		}
+		// kept packets are few, so each is written at once
+		if err := reader.writeRecord(out, packet); err != nil {
+			return flows, peakRate(bins), err
+		}
+	}
+	return flows, peakRate(bins), out.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || dragonfly || freebsd)
+
+package netmon
+
+import "errors"
+
+// freeSpace is not available where statfs is not, so the free space guard
+// of captures is skipped
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("free space is not available on this platform")
+}
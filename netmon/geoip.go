@@ -0,0 +1,305 @@
+package netmon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind DB file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// GeoIPDB is a MaxMind DB file (.mmdb), such as GeoLite2-Country or
+// GeoLite2-ASN, read into memory and looked up locally
+type GeoIPDB struct {
+	path       string
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+}
+
+// OpenGeoIPDB reads a MaxMind DB file
+func OpenGeoIPDB(path string) (*GeoIPDB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+	meta, _, err := decodeMMDB(buf[i+len(mmdbMetadataMarker):], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: metadata: %v", path, err)
+	}
+	fields, _ := meta.(map[string]interface{})
+	db := &GeoIPDB{
+		path:       path,
+		nodeCount:  uint(mmdbUint(fields["node_count"])),
+		recordSize: uint(mmdbUint(fields["record_size"])),
+		ipVersion:  uint(mmdbUint(fields["ip_version"])),
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, db.recordSize)
+	}
+	// the data section follows the tree and 16 zero bytes
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("%s: truncated search tree", path)
+	}
+	db.tree = buf[:treeSize]
+	db.data = buf[treeSize+16 : i]
+	return db, nil
+}
+
+// Lookup returns the record of ip, nil when the database has none
+func (db *GeoIPDB) Lookup(ip net.IP) (map[string]interface{}, error) {
+	var key []byte
+	switch {
+	case ip.To4() != nil && db.ipVersion == 6:
+		// IPv4 lives in ::/96 of IPv6 databases
+		key = append(make([]byte, 12), ip.To4()...)
+	case ip.To4() != nil:
+		key = ip.To4()
+	case db.ipVersion == 6:
+		key = ip.To16()
+	default:
+		return nil, nil
+	}
+
+	node := uint(0)
+	for bit := 0; bit < len(key)*8 && node < db.nodeCount; bit++ {
+		right := key[bit/8]>>(7-uint(bit%8))&1 == 1
+		node = db.record(node, right)
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	offset := node - db.nodeCount - 16
+	if offset >= uint(len(db.data)) {
+		return nil, fmt.Errorf("%s: bad data pointer", db.path)
+	}
+	value, _, err := decodeMMDB(db.data, offset, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", db.path, err)
+	}
+	record, _ := value.(map[string]interface{})
+	return record, nil
+}
+
+// record returns the left or right record of a search tree node
+func (db *GeoIPDB) record(node uint, right bool) uint {
+	b := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		if right {
+			b = b[3:]
+		}
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if right {
+			return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+		}
+		return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	default:
+		if right {
+			b = b[4:]
+		}
+		return uint(binary.BigEndian.Uint32(b))
+	}
+}
+
+var errMMDBTruncated = errors.New("truncated data")
+
+// mmdbMaxDepth bounds the nesting of maps, arrays and pointers, so that a
+// corrupt database, e.g. a pointer to itself, fails instead of recursing
+// without end
+const mmdbMaxDepth = 64
+
+// decodeMMDB decodes the value at offset of a MaxMind DB data section and
+// returns it with the offset after it. depth is the nesting of the value,
+// 0 at the top.
+func decodeMMDB(data []byte, offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	if offset >= uint(len(data)) {
+		return nil, 0, errMMDBTruncated
+	}
+	ctrl := data[offset]
+	offset++
+	kind := uint(ctrl >> 5)
+	if kind == 1 {
+		// pointer: its size bits extend the pointer itself
+		size := uint(ctrl>>3) & 3
+		if offset+size+1 > uint(len(data)) {
+			return nil, 0, errMMDBTruncated
+		}
+		target := uint(0)
+		if size < 3 {
+			target = uint(ctrl & 7)
+		}
+		for _, b := range data[offset : offset+size+1] {
+			target = target<<8 | uint(b)
+		}
+		target += [...]uint{0, 2048, 526336, 0}[size]
+		value, _, err := decodeMMDB(data, target, depth+1)
+		return value, offset + size + 1, err
+	}
+	if kind == 0 {
+		if offset >= uint(len(data)) {
+			return nil, 0, errMMDBTruncated
+		}
+		kind = 7 + uint(data[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(data)) {
+			return nil, 0, errMMDBTruncated
+		}
+		extra := uint(0)
+		for _, b := range data[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		size = [...]uint{29, 285, 65821}[n-1] + extra
+		offset += n
+	}
+
+	switch kind {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := decodeMMDB(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, after, err := decodeMMDB(data, next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, _ := key.(string)
+			m[name], offset = value, after
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := decodeMMDB(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, offset = append(a, value), next
+		}
+		return a, offset, nil
+	case 14: // boolean, the size is the value
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(data)) {
+		return nil, 0, errMMDBTruncated
+	}
+	b := data[offset : offset+size]
+	offset += size
+	switch kind {
+	case 2: // string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("bad double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("bad float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 5, 6, 8, 9, 10: // unsigned and signed integers, uint128 truncated
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	default: // bytes and the containers not used by GeoIP data
+		return b, offset, nil
+	}
+}
+
+// mmdbUint returns a decoded integer, 0 for anything else
+func mmdbUint(v interface{}) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
+
+// GeoIP looks IPs up in one or more MaxMind databases, e.g. a country and
+// an ASN database
+type GeoIP []*GeoIPDB
+
+// OpenGeoIP opens the MaxMind databases at paths
+func OpenGeoIP(paths []string) (GeoIP, error) {
+	var geo GeoIP
+	for _, path := range paths {
+		db, err := OpenGeoIPDB(path)
+		if err != nil {
+			return nil, err
+		}
+		geo = append(geo, db)
+	}
+	return geo, nil
+}
+
+// NoGeoIPData annotates public IPs none of the databases know
+const NoGeoIPData = "(no geoip data)"
+
+// Annotate returns the country and ASN of ip, e.g. "US, AS15169 Google LLC",
+// NoGeoIPData when no database has it, or "" for private, loopback and
+// link-local addresses, which no database covers
+func (g GeoIP) Annotate(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.IsPrivate() || parsed.IsLoopback() || parsed.IsLinkLocalUnicast() || parsed.IsUnspecified() {
+		return ""
+	}
+	var country, asn string
+	for _, db := range g {
+		record, err := db.Lookup(parsed)
+		if err != nil || record == nil {
+			continue
+		}
+		for _, key := range []string{"country", "registered_country"} {
+			if c, ok := record[key].(map[string]interface{}); ok && country == "" {
+				country, _ = c["iso_code"].(string)
+			}
+		}
+		if number := mmdbUint(record["autonomous_system_number"]); number > 0 && asn == "" {
+			asn = fmt.Sprintf("AS%d", number)
+			if org, ok := record["autonomous_system_organization"].(string); ok {
+				asn += " " + org
+			}
+		}
+	}
+	var parts []string
+	for _, part := range []string{country, asn} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return NoGeoIPData
+	}
+	return strings.Join(parts, ", ")
+}
+
+// AnnotateIPs sets the GeoIP annotation of every IP
+func (g GeoIP) AnnotateIPs(ips []IPCount) {
+	for i := range ips {
+		ips[i].GeoIP = g.Annotate(ips[i].IP)
+	}
+}
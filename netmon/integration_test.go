@@ -0,0 +1,122 @@
+//go:build integration
+
+package netmon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// kindCluster is the throwaway cluster created when NETMON_KUBECONTEXT does
+// not name an existing one
+const kindCluster = "netmon-integration"
+
+func TestMain(m *testing.M) {
+	cleanup, err := setupCluster()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "setting up the integration cluster: %v\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	cleanup()
+	os.Exit(code)
+}
+
+// setupCluster creates a kind cluster, or uses the context in
+// NETMON_KUBECONTEXT, and deploys the test pod and service into it
+func setupCluster() (func(), error) {
+	cleanup := func() {}
+	if kubeContext := os.Getenv("NETMON_KUBECONTEXT"); kubeContext != "" {
+		if err := kubectl("config", "use-context", kubeContext); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := exec.LookPath("kind"); err != nil {
+			return nil, fmt.Errorf("kind is not installed and NETMON_KUBECONTEXT is not set")
+		}
+		out, err := exec.Command("kind", "create", "cluster", "--name", kindCluster, "--wait", "3m").CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("kind create cluster: %v\n%s", err, out)
+		}
+		cleanup = func() {
+			exec.Command("kind", "delete", "cluster", "--name", kindCluster).Run()
+		}
+	}
+
+	manifest := filepath.Join("testdata", "integration.yaml")
+	if err := kubectl("apply", "-f", manifest); err != nil {
+		cleanup()
+		return nil, err
+	}
+	if err := kubectl("wait", "--for=condition=Ready", "pod/netmon-echo", "--timeout=3m"); err != nil {
+		cleanup()
+		return nil, err
+	}
+	return func() {
+		kubectl("delete", "-f", manifest, "--wait=false")
+		cleanup()
+	}, nil
+}
+
+func kubectl(args ...string) error {
+	out, err := exec.Command("kubectl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("kubectl %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+func TestIntegrationCheckPod(t *testing.T) {
+	if entry := CheckPod(context.Background(), Config{}, "netmon-echo"); entry.Status != "Running" || !entry.Healthy {
+		t.Errorf("CheckPod(netmon-echo) = %+v, want Running", entry)
+	}
+
+	entry := CheckPod(context.Background(), Config{}, "netmon-ecko")
+	if entry.Status != "not found" || !strings.Contains(entry.Detail, "netmon-echo") {
+		t.Errorf("CheckPod(netmon-ecko) = %+v, want not found suggesting netmon-echo", entry)
+	}
+}
+
+func TestIntegrationWaitForPod(t *testing.T) {
+	if entry := CheckPod(context.Background(), Config{Wait: true, WaitTimeout: 30 * time.Second}, "netmon-echo"); entry.Status != "Running" || !entry.Healthy {
+		t.Errorf("CheckPod(netmon-echo) with Wait = %+v, want Running", entry)
+	}
+}
+
+func TestIntegrationCheckService(t *testing.T) {
+	if entry := CheckService(context.Background(), Config{}, "netmon-echo"); entry.Status != "running" || !entry.Healthy {
+		t.Errorf("CheckService(netmon-echo) = %+v, want running", entry)
+	}
+	if entry := CheckService(context.Background(), Config{}, "netmon-missing"); entry.Status != "not found" {
+		t.Errorf("CheckService(netmon-missing) = %+v, want not found", entry)
+	}
+}
+
+func TestIntegrationGetPodName(t *testing.T) {
+	if got := GetPodName(context.Background(), "netmon-"); got != "netmon-echo" {
+		t.Errorf("GetPodName(netmon-) = %q, want netmon-echo", got)
+	}
+}
+
+func TestIntegrationListPods(t *testing.T) {
+	pods, err := ListPods(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod, ok := FindPod(pods, "netmon-echo")
+	if !ok {
+		t.Fatal("netmon-echo not listed")
+	}
+	if !pod.isReady() || pod.Status.PodIP == "" {
+		t.Errorf("netmon-echo status = %+v, want ready with a pod IP", pod.Status)
+	}
+	if ports := pod.Spec.Containers[0].Ports; len(ports) != 1 || ports[0].ContainerPort != 8080 {
+		t.Errorf("netmon-echo ports = %+v, want 8080", ports)
+	}
+}
@@ -0,0 +1,113 @@
+package netmon
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SysClassNet lists the network interfaces of the host
+var SysClassNet = "/sys/class/net"
+
+// isInterfacePattern reports whether an -interface value is a glob such as
+// veth* or a regular expression between slashes such as /^cni[0-9]+$/
+// rather than an interface name
+func isInterfacePattern(name string) bool {
+	return strings.ContainsAny(name, "*?[") || len(name) > 2 && strings.HasPrefix(name, "/") && strings.HasSuffix(name, "/")
+}
+
+// ListInterfaces returns the names of the network interfaces, those of the
+// network namespace of c.NetnsPID when it is set
+func (c Config) ListInterfaces() ([]string, error) {
+	if c.NetnsPID > 0 {
+		// sysfs shows the namespace it was mounted in, /proc the process's
+		return netDevInterfaces(fmt.Sprintf("/proc/%d/net/dev", c.NetnsPID))
+	}
+	entries, err := os.ReadDir(SysClassNet)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// netDevInterfaces returns the interfaces of a /proc/PID/net/dev file
+func netDevInterfaces(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// "  eth0: 1234 ..." after two header lines without a colon
+		if i := strings.IndexByte(scanner.Text(), ':'); i >= 0 {
+			names = append(names, strings.TrimSpace(scanner.Text()[:i]))
+		}
+	}
+	sort.Strings(names)
+	return names, scanner.Err()
+}
+
+// ExpandInterfaces replaces the patterns among c.Interfaces, globs such as
+// veth* and regular expressions between slashes such as /^cni[0-9]+$/, with
+// the interfaces they match, so the ephemeral veth names of pods need not be
+// looked up. Plain names are kept as they are. A pattern matching nothing is
+// an error.
+func (c Config) ExpandInterfaces() ([]string, error) {
+	var names []string
+	var expanded []string
+	seen := map[string]bool{}
+	for _, pattern := range c.Interfaces {
+		if !isInterfacePattern(pattern) {
+			if !seen[pattern] {
+				seen[pattern] = true
+				expanded = append(expanded, pattern)
+			}
+			continue
+		}
+
+		match := func(name string) bool {
+			ok, _ := filepath.Match(pattern, name)
+			return ok
+		}
+		if pattern[0] == '/' {
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, configError("interface pattern %s: %v", pattern, err)
+			}
+			match = re.MatchString
+		} else if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, configError("interface pattern %s: %v", pattern, err)
+		}
+
+		if names == nil {
+			var err error
+			if names, err = c.ListInterfaces(); err != nil {
+				return nil, configError("listing interfaces for %s: %v", pattern, err)
+			}
+		}
+		matched := 0
+		for _, name := range names {
+			if match(name) {
+				matched++
+				if !seen[name] {
+					seen[name] = true
+					expanded = append(expanded, name)
+				}
+			}
+		}
+		if matched == 0 {
+			return nil, configError("no interface matches %s", pattern)
+		}
+	}
+	return expanded, nil
+}
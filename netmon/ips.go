@@ -0,0 +1,416 @@
+package netmon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IPCount is a discovered IP address and the number of packets it was seen in
+type IPCount struct {
+	IP    string `json:"ip"`
+	Count int    `json:"count"`
+	// Direction is "in", "out" or "both" when sampled per direction
+	Direction string `json:"direction,omitempty"`
+	// Unknown is set for IPs outside of the allowlist checked against
+	Unknown bool `json:"unknown,omitempty"`
+	// GeoIP is the country and ASN of a public IP, see GeoIP.Annotate
+	GeoIP string `json:"geoip,omitempty"`
+}
+
+// IPDelta is an IP present in both samples whose packet count changed
+type IPDelta struct {
+	IP    string `json:"ip"`
+	Old   int    `json:"old"`
+	New   int    `json:"new"`
+	Delta int    `json:"delta"`
+}
+
+// IPDiff compares an IP sample against a baseline sample
+type IPDiff struct {
+	Baseline string    `json:"baseline"`
+	Added    []IPCount `json:"added,omitempty"`
+	Removed  []IPCount `json:"removed,omitempty"`
+	Changed  []IPDelta `json:"changed,omitempty"`
+}
+
+// IPSample is the number of packets each IP address appeared in
+type IPSample map[string]int
+
+// Flow is a conversation identified by its 5-tuple
+type Flow struct {
+	SrcIP   string `json:"srcIP"`
+	SrcPort int    `json:"srcPort"`
+	DstIP   string `json:"dstIP"`
+	DstPort int    `json:"dstPort"`
+	// Proto is tcp or udp
+	Proto string `json:"proto"`
+}
+
+func (f Flow) String() string {
+	return fmt.Sprintf("%s:%d > %s:%d/%s", f.SrcIP, f.SrcPort, f.DstIP, f.DstPort, f.Proto)
+}
+
+// FlowCount is a flow and the number of packets seen in it
+type FlowCount struct {
+	Flow
+	Count int `json:"count"`
+}
+
+// sampleDuration is how long SampleIPs listens
+const sampleDuration = 10 * time.Second
+
+// Sample is the result of SampleIPs
+type Sample struct {
+	Counts IPSample
+	// Flows counts the packets of each TCP or UDP flow
+	Flows map[Flow]int
+	// PeakPPS is the packet rate of the busiest second
+	PeakPPS int
+	// Dropped is the packets tcpdump reported as dropped by the kernel
+	// because its buffer was full
+	Dropped int
+	// Directions maps each IP to the direction it was seen in, "in", "out"
+	// or "both". It is nil unless Config.Direction was set and direction
+	// qualifiers are supported.
+	Directions map[string]string
+
+	// bins counts the packets per second of day
+	bins map[int64]int
+}
+
+// SampleIPs samples the traffic matching c.TcpdumpFilter on all interfaces
+// for 10 seconds and counts the packets each IP address appeared in. With
+// c.Direction set, inbound and outbound traffic are sampled separately to
+// tag each IP. Its progress is only reported to c.ProgressFunc; there is no
+// terminal bar.
+func SampleIPs(ctx context.Context, c Config) (Sample, error) {
+	c = c.withDefaults()
+	if err := c.checkDirection(); err != nil {
+		return Sample{}, err
+	}
+	if err := CheckCapturePrivileges(); err != nil {
+		return Sample{}, err
+	}
+	if c.ProgressFunc != nil {
+		stop := c.reportSampleProgress()
+		defer stop()
+	}
+
+	if c.Direction == "" {
+		return c.sampleFilter(ctx, c.TcpdumpFilter)
+	}
+	if !c.supportsDirection(ctx, "any") {
+		p := c.colors()
+		fmt.Fprintf(c.Output, "%sWarning: direction qualifiers are not supported, sampling without direction tags%s\n",
+			p.yellow, p.reset)
+		return c.sampleFilter(ctx, c.TcpdumpFilter)
+	}
+
+	directions := []string{DirectionIn, DirectionOut}
+	if c.Direction != DirectionBoth {
+		directions = []string{c.Direction}
+	}
+	samples := make([]Sample, len(directions))
+	errs := make([]error, len(directions))
+	var wg sync.WaitGroup
+	for i, direction := range directions {
+		wg.Add(1)
+		go func(i int, direction string) {
+			defer wg.Done()
+			samples[i], errs[i] = c.sampleFilter(ctx, directionFilter(c.TcpdumpFilter, direction))
+		}(i, direction)
+	}
+	wg.Wait()
+
+	result := Sample{Counts: IPSample{}, Flows: map[Flow]int{}, Directions: map[string]string{}}
+	bins := map[int64]int{}
+	for i, direction := range directions {
+		if errs[i] != nil {
+			return Sample{}, errs[i]
+		}
+		for second, count := range samples[i].bins {
+			bins[second] += count
+		}
+		result.Dropped += samples[i].Dropped
+		for flow, count := range samples[i].Flows {
+			result.Flows[flow] += count
+		}
+		for ip, count := range samples[i].Counts {
+			result.Counts[ip] += count
+			if seen, ok := result.Directions[ip]; ok && seen != direction {
+				result.Directions[ip] = DirectionBoth
+			} else {
+				result.Directions[ip] = direction
+			}
+		}
+	}
+	result.PeakPPS = peakRate(bins)
+	return result, nil
+}
+
+// Sorted orders the sample by packet count, busiest first, with the
+// direction of each IP when it is known
+func (s Sample) Sorted() []IPCount {
+	ips := s.Counts.Sorted()
+	for i := range ips {
+		ips[i].Direction = s.Directions[ips[i].IP]
+	}
+	return ips
+}
+
+// TopFlows returns the n busiest flows, all of them when n is 0
+func (s Sample) TopFlows(n int) []FlowCount {
+	flows := make([]FlowCount, 0, len(s.Flows))
+	for flow, count := range s.Flows {
+		flows = append(flows, FlowCount{Flow: flow, Count: count})
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		if flows[i].Count != flows[j].Count {
+			return flows[i].Count > flows[j].Count
+		}
+		return flows[i].String() < flows[j].String()
+	})
+	if n > 0 && len(flows) > n {
+		flows = flows[:n]
+	}
+	return flows
+}
+
+// Asymmetry lists the IPs seen on only one side of the sampled flows, a
+// hint of asymmetric routing where the reverse traffic takes another path
+type Asymmetry struct {
+	// SourcesOnly sent packets but never received any
+	SourcesOnly []string `json:"sourcesOnly,omitempty"`
+	// DestinationsOnly received packets but never sent any
+	DestinationsOnly []string `json:"destinationsOnly,omitempty"`
+}
+
+// Asymmetric compares the source and destination IPs of the sample's flows
+func (s Sample) Asymmetric() Asymmetry {
+	sources, destinations := map[string]bool{}, map[string]bool{}
+	for flow := range s.Flows {
+		sources[flow.SrcIP] = true
+		destinations[flow.DstIP] = true
+	}
+	var a Asymmetry
+	for ip := range sources {
+		if !destinations[ip] {
+			a.SourcesOnly = append(a.SourcesOnly, ip)
+		}
+	}
+	for ip := range destinations {
+		if !sources[ip] {
+			a.DestinationsOnly = append(a.DestinationsOnly, ip)
+		}
+	}
+	sort.Strings(a.SourcesOnly)
+	sort.Strings(a.DestinationsOnly)
+	return a
+}
+
+// flowRegex matches the addresses of a tcpdump -nn line with ports, e.g.
+// "IP 10.42.0.7.9996 > 10.42.0.12.40000: UDP, length 120"
+var flowRegex = regexp.MustCompile(`(\d{1,3}(?:\.\d{1,3}){3})\.(\d+) > (\d{1,3}(?:\.\d{1,3}){3})\.(\d+): (.*)`)
+
+// parseFlow returns the flow of a tcpdump -nn line. Lines without ports, such
+// as ICMP, have none. TCP is recognized by its flags, anything else with
+// ports is counted as UDP.
+func parseFlow(line string) (Flow, bool) {
+	m := flowRegex.FindStringSubmatch(line)
+	if m == nil {
+		return Flow{}, false
+	}
+	srcPort, _ := strconv.Atoi(m[2])
+	dstPort, _ := strconv.Atoi(m[4])
+	flow := Flow{SrcIP: m[1], SrcPort: srcPort, DstIP: m[3], DstPort: dstPort, Proto: "udp"}
+	if strings.HasPrefix(m[5], "Flags [") {
+		flow.Proto = "tcp"
+	}
+	return flow, true
+}
+
+// sampleFilter runs tcpdump with filter on all interfaces for 10 seconds
+// and counts the packets each IP address and each flow appeared in
+func (c Config) sampleFilter(ctx context.Context, filter string) (Sample, error) {
+	ctx, cancel := context.WithTimeout(ctx, sampleDuration)
+	defer cancel()
+	args := append([]string{"-i", "any", "-nn"}, c.bufferArgs()...)
+	cmd := c.tcpdump(context.Background(), append(args, filter)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return Sample{}, captureError(fmt.Errorf("creating stdout pipe: %v", err))
+	}
+
+	if err := cmd.Start(); err != nil {
+		return Sample{}, captureError(fmt.Errorf("starting: %v", err))
+	}
+	// SIGINT rather than a kill makes tcpdump print its drop statistics
+	go func() {
+		<-ctx.Done()
+		cmd.Process.Signal(os.Interrupt)
+	}()
+
+	ipRegex := regexp.MustCompile(`(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})`)
+	uniqueIPs := make(IPSample)
+	flows := make(map[Flow]int)
+	bins := make(map[int64]int)
+	scanner := bufio.NewScanner(stdout)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if second, ok := lineSecond(line); ok {
+			bins[second]++
+		}
+		if flow, ok := parseFlow(line); ok {
+			flows[flow]++
+		}
+		matches := ipRegex.FindAllString(line, -1)
+		seen := make(map[string]bool)
+		for _, ip := range matches {
+			if !seen[ip] {
+				seen[ip] = true
+				uniqueIPs[ip]++
+			}
+		}
+	}
+
+	cmd.Wait()
+
+	return Sample{Counts: uniqueIPs, Flows: flows, PeakPPS: peakRate(bins), Dropped: droppedPackets(stderr.String()), bins: bins}, nil
+}
+
+// Sorted orders the sample by packet count, busiest first
+func (s IPSample) Sorted() []IPCount {
+	ips := make([]IPCount, 0, len(s))
+	for ip, count := range s {
+		ips = append(ips, IPCount{IP: ip, Count: count})
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		if ips[i].Count != ips[j].Count {
+			return ips[i].Count > ips[j].Count
+		}
+		return ips[i].IP < ips[j].IP
+	})
+	return ips
+}
+
+// LoadIPSample reads a saved IP sample, either a JSON report with an "ips"
+// list as written by "ips -output json", a JSON list of IPCount or CSV lines
+// of ip,count
+func LoadIPSample(path string) (IPSample, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sample := make(IPSample)
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		var ips []IPCount
+		if trimmed[0] == '{' {
+			var report struct {
+				IPs []IPCount `json:"ips"`
+			}
+			if err := json.Unmarshal(trimmed, &report); err != nil {
+				return nil, err
+			}
+			ips = report.IPs
+		} else if err := json.Unmarshal(trimmed, &ips); err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			sample[ip.IP] += ip.Count
+		}
+		return sample, nil
+	}
+
+	reader := csv.NewReader(bytes.NewReader(trimmed))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for i, record := range records {
+		if net.ParseIP(record[0]) == nil {
+			if i == 0 {
+				continue // header
+			}
+			return nil, fmt.Errorf("line %d: invalid IP %q", i+1, record[0])
+		}
+		count := 1
+		if len(record) > 1 {
+			if count, err = strconv.Atoi(strings.TrimSpace(record[1])); err != nil {
+				return nil, fmt.Errorf("line %d: invalid count %q", i+1, record[1])
+			}
+		}
+		sample[record[0]] += count
+	}
+	return sample, nil
+}
+
+// DiffIPSamples reports which IPs are new in current, which disappeared
+// since old, and how the packet counts of the remaining ones changed
+func DiffIPSamples(old, current IPSample) IPDiff {
+	var diff IPDiff
+	for ip, count := range current {
+		oldCount, ok := old[ip]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, IPCount{IP: ip, Count: count})
+		case oldCount != count:
+			diff.Changed = append(diff.Changed, IPDelta{IP: ip, Old: oldCount, New: count, Delta: count - oldCount})
+		}
+	}
+	for ip, count := range old {
+		if _, ok := current[ip]; !ok {
+			diff.Removed = append(diff.Removed, IPCount{IP: ip, Count: count})
+		}
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].IP < diff.Added[j].IP })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].IP < diff.Removed[j].IP })
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].IP < diff.Changed[j].IP })
+	return diff
+}
+
+// reportSampleProgress calls c.ProgressFunc every second while SampleIPs
+// listens. The returned function stops it and reports completion.
+func (c Config) reportSampleProgress() func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		startTime := time.Now()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if progress := int(time.Since(startTime) * 100 / sampleDuration); progress < 100 {
+					c.ProgressFunc(progress, 100, "Sampling traffic")
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		c.ProgressFunc(100, 100, "Sampling traffic")
+	}
+}
@@ -0,0 +1,517 @@
+package netmon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Pod struct {
+	Metadata struct {
+		Name            string           `json:"name"`
+		Namespace       string           `json:"namespace"`
+		UID             string           `json:"uid"`
+		GenerateName    string           `json:"generateName"`
+		OwnerReferences []ownerReference `json:"ownerReferences"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName   string `json:"nodeName"`
+		Containers []struct {
+			Name  string `json:"name"`
+			Ports []struct {
+				ContainerPort int    `json:"containerPort"`
+				Protocol      string `json:"protocol"`
+			} `json:"ports"`
+			Resources struct {
+				Limits map[string]string `json:"limits"`
+			} `json:"resources"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		PodIP             string `json:"podIP"`
+		Phase             string `json:"phase"`
+		ContainerStatuses []struct {
+			Name         string `json:"name"`
+			Ready        bool   `json:"ready"`
+			RestartCount int    `json:"restartCount"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// readyContainers returns how many of the pod's containers are ready
+func (p Pod) readyContainers() (ready, total int) {
+	for _, status := range p.Status.ContainerStatuses {
+		if status.Ready {
+			ready++
+		}
+	}
+	return ready, len(p.Status.ContainerStatuses)
+}
+
+// isReady reports whether the pod is Running with all containers ready
+func (p Pod) isReady() bool {
+	ready, total := p.readyContainers()
+	return p.Status.Phase == "Running" && total > 0 && ready == total
+}
+
+type Service struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		Type      string `json:"type"`
+		ClusterIP string `json:"clusterIP"`
+		Ports     []struct {
+			Port     int    `json:"port"`
+			Protocol string `json:"protocol"`
+			// NodePort is the port opened on every node for NodePort and
+			// LoadBalancer services
+			NodePort int `json:"nodePort"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+// StatusEntry is the result of checking a single resource
+type StatusEntry struct {
+	Resource string `json:"resource"`
+	Type     string `json:"type"`
+	Status   string `json:"status"`
+	Healthy  bool   `json:"healthy"`
+	Warning  bool   `json:"warning,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	// Ports are the ports of a service
+	Ports []int `json:"ports,omitempty"`
+}
+
+// GetPodName returns the first pod whose name starts with prefix, or ""
+func GetPodName(ctx context.Context, prefix string) string {
+	output, err := runKubectl(ctx, "get", "pods", "-o", "jsonpath={.items[*].metadata.name}")
+	if err != nil {
+		return ""
+	}
+
+	podNames := strings.Fields(string(output))
+	for _, name := range podNames {
+		if strings.HasPrefix(name, prefix) {
+			return name
+		}
+	}
+	return ""
+}
+
+// ownerReference names the controller of a resource
+type ownerReference struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// ListPods returns the pods visible to kubectl
+func ListPods(ctx context.Context) ([]Pod, error) {
+	return ListPodsMatching(ctx, "")
+}
+
+// ListPodsMatching returns the pods matching the label selector, or all
+// pods visible to kubectl when selector is empty
+func ListPodsMatching(ctx context.Context, selector string) ([]Pod, error) {
+	args := []string{"get", "pods", "-o", "json"}
+	if selector != "" {
+		args = append(args, "-l", selector)
+	}
+	out, err := runKubectl(ctx, args...)
+	if err != nil {
+		return nil, kubectlError(args, err)
+	}
+
+	var podList struct {
+		Items []Pod `json:"items"`
+	}
+	if err := json.Unmarshal(out, &podList); err != nil {
+		return nil, err
+	}
+	return podList.Items, nil
+}
+
+// ListAllPods returns the pods of every namespace, for picking a pod
+// outside the current one
+func ListAllPods(ctx context.Context) ([]Pod, error) {
+	args := []string{"get", "pods", "--all-namespaces", "-o", "json"}
+	out, err := runKubectl(ctx, args...)
+	if err != nil {
+		return nil, kubectlError(args, err)
+	}
+
+	var podList struct {
+		Items []Pod `json:"items"`
+	}
+	if err := json.Unmarshal(out, &podList); err != nil {
+		return nil, kubectlError(args, fmt.Errorf("parsing pods: %v", err))
+	}
+	return podList.Items, nil
+}
+
+// ListAllServices returns the services of every namespace, for picking a
+// service outside the current one
+func ListAllServices(ctx context.Context) ([]Service, error) {
+	args := []string{"get", "services", "--all-namespaces", "-o", "json"}
+	out, err := runKubectl(ctx, args...)
+	if err != nil {
+		return nil, kubectlError(args, err)
+	}
+
+	var serviceList struct {
+		Items []Service `json:"items"`
+	}
+	if err := json.Unmarshal(out, &serviceList); err != nil {
+		return nil, kubectlError(args, fmt.Errorf("parsing services: %v", err))
+	}
+	return serviceList.Items, nil
+}
+
+// Cluster is the kubeconfig context kubectl uses and the cluster it points at
+type Cluster struct {
+	Context string
+	Name    string
+	Server  string
+	// Namespace is the context's namespace, default when it sets none
+	Namespace string
+}
+
+// CurrentCluster returns the context, cluster and API server kubectl talks
+// to, following KubeContext and KubeNamespace
+func CurrentCluster(ctx context.Context) (Cluster, error) {
+	args := []string{"config", "view", "--minify", "-o",
+		"jsonpath={.contexts[0].name} {.clusters[0].name} {.clusters[0].cluster.server} {.contexts[0].context.namespace}"}
+	out, err := runKubectl(ctx, args...)
+	if err != nil {
+		return Cluster{}, kubectlError(args, err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 3 && len(fields) != 4 {
+		return Cluster{}, kubectlError(args, fmt.Errorf("unexpected output %q", strings.TrimSpace(string(out))))
+	}
+	cluster := Cluster{Context: fields[0], Name: fields[1], Server: fields[2], Namespace: "default"}
+	if len(fields) == 4 {
+		cluster.Namespace = fields[3]
+	}
+	if KubeNamespace != "" {
+		cluster.Namespace = KubeNamespace
+	}
+	return cluster, nil
+}
+
+// KubeContexts lists the contexts defined in the kubeconfig
+func KubeContexts(ctx context.Context) ([]string, error) {
+	args := []string{"config", "get-contexts", "-o", "name"}
+	out, err := RunCommand(ctx, "kubectl", args...)
+	if err != nil {
+		return nil, kubectlError(args, err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// FindPod returns the first pod whose name contains podName
+func FindPod(pods []Pod, podName string) (Pod, bool) {
+	for _, pod := range pods {
+		if strings.Contains(pod.Metadata.Name, podName) {
+			return pod, true
+		}
+	}
+	return Pod{}, false
+}
+
+// PodContainers returns the names of the pod's containers
+func PodContainers(ctx context.Context, podName string) ([]string, error) {
+	args := []string{"get", "pod", podName, "-o", "jsonpath={.spec.containers[*].name}"}
+	out, err := runKubectl(ctx, args...)
+	if err != nil {
+		return nil, kubectlError(args, err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// CheckPod reports the phase of the first pod whose name contains podName,
+// suggesting close names when there is none. With c.Wait it waits for the
+// pod to become ready instead.
+func CheckPod(ctx context.Context, c Config, podName string) StatusEntry {
+	c = c.withDefaults()
+	if c.Wait {
+		return c.waitForPod(ctx, podName, c.WaitTimeout)
+	}
+
+	pods, err := ListPods(ctx)
+	if err != nil {
+		return StatusEntry{Resource: podName, Type: "pod", Status: "error", Detail: fmt.Sprintf("getting pods: %v", err)}
+	}
+	return Snapshot{Pods: pods}.CheckPod(podName)
+}
+
+// Snapshot is the pods and services of the cluster at one point in time
+type Snapshot struct {
+	Pods     []Pod
+	Services []Service
+}
+
+// TakeSnapshot lists the pods and services with a single kubectl call
+func TakeSnapshot(ctx context.Context) (Snapshot, error) {
+	args := []string{"get", "pods,services", "-o", "json"}
+	out, err := runKubectl(ctx, args...)
+	if err != nil {
+		return Snapshot{}, kubectlError(args, err)
+	}
+
+	var list struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return Snapshot{}, err
+	}
+	var snapshot Snapshot
+	for _, item := range list.Items {
+		var kind struct {
+			Kind string `json:"kind"`
+		}
+		json.Unmarshal(item, &kind)
+		switch kind.Kind {
+		case "Pod":
+			var pod Pod
+			if err := json.Unmarshal(item, &pod); err != nil {
+				return Snapshot{}, err
+			}
+			snapshot.Pods = append(snapshot.Pods, pod)
+		case "Service":
+			var service Service
+			if err := json.Unmarshal(item, &service); err != nil {
+				return Snapshot{}, err
+			}
+			snapshot.Services = append(snapshot.Services, service)
+		}
+	}
+	return snapshot, nil
+}
+
+// CheckPod checks podName against the snapshot's pods, like the CheckPod
+// function does without Config.Wait
+func (s Snapshot) CheckPod(podName string) StatusEntry {
+	entry := StatusEntry{Resource: podName, Type: "pod"}
+	if pod, ok := FindPod(s.Pods, podName); ok {
+		entry.Status = pod.Status.Phase
+		// a pod that exists but does not run, e.g. Pending, only warns
+		entry.Healthy = entry.Status == "Running" || entry.Status == "Succeeded"
+		entry.Warning = !entry.Healthy
+		return entry
+	}
+
+	var names []string
+	for _, pod := range s.Pods {
+		names = append(names, pod.Metadata.Name)
+	}
+	entry.Status = "not found"
+	if suggestions := suggestNames(podName, names); len(suggestions) > 0 {
+		entry.Detail = "did you mean: " + strings.Join(suggestions, ", ")
+	}
+	return entry
+}
+
+// waitForPod polls until the pod is Running with all containers ready, the
+// timeout elapses or ctx is canceled, keeping a live status line updated
+// meanwhile
+func (c Config) waitForPod(ctx context.Context, podName string, timeout time.Duration) StatusEntry {
+	entry := StatusEntry{Resource: podName, Type: "pod", Status: "not found"}
+	lastLine := ""
+	startTime := time.Now()
+	deadline := startTime.Add(timeout)
+
+	for {
+		pods, err := ListPods(ctx)
+		if err != nil {
+			entry.Status = "error"
+			entry.Detail = err.Error()
+		} else if pod, ok := FindPod(pods, podName); ok {
+			ready, total := pod.readyContainers()
+			entry.Status = pod.Status.Phase
+			entry.Detail = fmt.Sprintf("%d/%d containers ready", ready, total)
+			if pod.isReady() {
+				c.ClearStatusLine()
+				entry.Healthy = true
+				entry.Detail += fmt.Sprintf(" after %s", time.Since(startTime).Round(time.Second))
+				return entry
+			}
+		}
+
+		if time.Now().After(deadline) {
+			c.ClearStatusLine()
+			entry.Detail = strings.TrimSpace(fmt.Sprintf("timed out after %s; %s", timeout, entry.Detail))
+			return entry
+		}
+		line := fmt.Sprintf("Waiting for pod %s: %s %s", podName, entry.Status, entry.Detail)
+		if c.Interactive {
+			fmt.Fprintf(c.Output, "\r\033[K%s [%s]", line, time.Since(startTime).Round(time.Second))
+		} else if line != lastLine && !c.Quiet {
+			fmt.Fprintln(c.Output, line)
+		}
+		lastLine = line
+
+		select {
+		case <-ctx.Done():
+			c.ClearStatusLine()
+			entry.Detail = strings.TrimSpace(fmt.Sprintf("%v; %s", ctx.Err(), entry.Detail))
+			return entry
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// suggestNames returns up to five candidates closest to target. Names sharing
+// a substring with target come first, then the rest by edit distance.
+func suggestNames(target string, candidates []string) []string {
+	type scored struct {
+		name     string
+		distance int
+	}
+	target = strings.ToLower(target)
+	maxDistance := len(target) / 2
+	if maxDistance < 3 {
+		maxDistance = 3
+	}
+
+	var matches []scored
+	for _, candidate := range candidates {
+		lower := strings.ToLower(candidate)
+		distance := levenshtein(target, lower)
+		if strings.Contains(lower, target) || strings.Contains(target, lower) {
+			distance = -1
+		} else if distance > maxDistance {
+			continue
+		}
+		matches = append(matches, scored{candidate, distance})
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].distance < matches[j].distance
+	})
+	if len(matches) > 5 {
+		matches = matches[:5]
+	}
+
+	suggestions := make([]string, len(matches))
+	for i, m := range matches {
+		suggestions[i] = m.name
+	}
+	return suggestions
+}
+
+// levenshtein returns the edit distance between a and b
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// CheckService reports whether a service named serviceName exists
+func CheckService(ctx context.Context, c Config, serviceName string) StatusEntry {
+	out, err := runKubectl(ctx, "get", "services", "-o", "json")
+	if err != nil {
+		return StatusEntry{Resource: serviceName, Type: "service", Status: "error", Detail: fmt.Sprintf("getting services: %v", err)}
+	}
+
+	var serviceList struct {
+		Items []Service `json:"items"`
+	}
+	json.Unmarshal(out, &serviceList)
+	return Snapshot{Services: serviceList.Items}.CheckService(serviceName)
+}
+
+// CheckService checks serviceName against the snapshot's services
+func (s Snapshot) CheckService(serviceName string) StatusEntry {
+	entry := StatusEntry{Resource: serviceName, Type: "service"}
+	for _, service := range s.Services {
+		if service.Metadata.Name == serviceName {
+			entry.Status = "running"
+			entry.Healthy = true
+			for _, port := range service.Spec.Ports {
+				entry.Ports = append(entry.Ports, port.Port)
+			}
+			return entry
+		}
+	}
+	entry.Status = "not found"
+	return entry
+}
+
+// EphemeralContainerState returns the state of the ephemeral container name
+// of pod: running, waiting or terminated, or "" when it is not found
+func EphemeralContainerState(ctx context.Context, pod, name string) (string, error) {
+	args := []string{"get", "pod", pod, "-o",
+		fmt.Sprintf(`jsonpath={.status.ephemeralContainerStatuses[?(@.name=="%s")].state}`, name)}
+	out, err := runKubectl(ctx, args...)
+	if err != nil {
+		return "", kubectlError(args, err)
+	}
+	if len(strings.TrimSpace(string(out))) == 0 {
+		return "", nil
+	}
+	var state map[string]json.RawMessage
+	if err := json.Unmarshal(out, &state); err != nil {
+		return "", &ActionError{Kind: ErrKubectl, Command: "kubectl " + strings.Join(args, " "), Err: err}
+	}
+	for _, s := range []string{"running", "waiting", "terminated"} {
+		if _, ok := state[s]; ok {
+			return s, nil
+		}
+	}
+	return "", nil
+}
+
+// ContainerStart returns when the running instance of container in pod
+// started and how many times the container restarted before it. A
+// container that is not running is an error, as it has no such instance.
+func ContainerStart(ctx context.Context, pod, container string) (time.Time, int, error) {
+	args := []string{"get", "pod", pod, "-o",
+		fmt.Sprintf(`jsonpath={.status.containerStatuses[?(@.name=="%s")]}`, container)}
+	out, err := runKubectl(ctx, args...)
+	if err != nil {
+		return time.Time{}, 0, kubectlError(args, err)
+	}
+	if len(strings.TrimSpace(string(out))) == 0 {
+		return time.Time{}, 0, fmt.Errorf("pod %s has no status for container %s", pod, container)
+	}
+	var status struct {
+		RestartCount int `json:"restartCount"`
+		State        struct {
+			Running *struct {
+				StartedAt time.Time `json:"startedAt"`
+			} `json:"running"`
+		} `json:"state"`
+	}
+	if err := json.Unmarshal(out, &status); err != nil {
+		return time.Time{}, 0, &ActionError{Kind: ErrKubectl, Command: "kubectl " + strings.Join(args, " "), Err: err}
+	}
+	if status.State.Running == nil {
+		return time.Time{}, status.RestartCount, fmt.Errorf("container %s in pod %s is not running", container, pod)
+	}
+	return status.State.Running.StartedAt, status.RestartCount, nil
+}
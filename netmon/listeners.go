@@ -0,0 +1,138 @@
+package netmon
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ProcNet lists the sockets of the host's network namespace
+var ProcNet = "/proc/net"
+
+// Listener is a UDP socket bound to a port or a listening TCP socket
+type Listener struct {
+	Transport string `json:"transport"`
+	Address   string `json:"address"`
+	Port      int    `json:"port"`
+	// Process is the command and PID owning the socket, e.g.
+	// "collector (pid 812)", or empty when it cannot be found, e.g. when
+	// not running as root
+	Process string `json:"process,omitempty"`
+	inode   string
+}
+
+// tcpListen is the st column of a listening TCP socket in /proc/net/tcp
+const tcpListen = "0A"
+
+// Listeners returns the bound UDP and listening TCP sockets, those of the
+// network namespace of c.NetnsPID when it is set. It reads /proc/net/udp,
+// udp6, tcp and tcp6, so it needs neither ss nor netstat.
+func (c Config) Listeners() ([]Listener, error) {
+	dir := ProcNet
+	if c.NetnsPID > 0 {
+		dir = fmt.Sprintf("/proc/%d/net", c.NetnsPID)
+	}
+	var listeners []Listener
+	var read int
+	var lastErr error
+	for _, file := range []string{"udp", "udp6", "tcp", "tcp6"} {
+		found, err := procNetListeners(filepath.Join(dir, file), strings.TrimSuffix(file, "6"))
+		if err != nil {
+			// a kernel without IPv6 has no udp6 and tcp6
+			lastErr = err
+			continue
+		}
+		read++
+		listeners = append(listeners, found...)
+	}
+	if read == 0 {
+		return nil, lastErr
+	}
+
+	if len(listeners) > 0 {
+		processes := socketProcesses()
+		for i := range listeners {
+			listeners[i].Process = processes[listeners[i].inode]
+		}
+	}
+	return listeners, nil
+}
+
+// procNetListeners parses a /proc/net/udp or tcp style file
+func procNetListeners(path, transport string) ([]Listener, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var listeners []Listener
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || transport == "tcp" && fields[3] != tcpListen {
+			continue
+		}
+		ip, port, ok := parseProcNetAddress(fields[1])
+		if !ok {
+			continue
+		}
+		listeners = append(listeners, Listener{Transport: transport, Address: net.JoinHostPort(ip.String(), strconv.Itoa(port)),
+			Port: port, inode: fields[9]})
+	}
+	return listeners, scanner.Err()
+}
+
+// parseProcNetAddress parses an address such as 0100007F:1279, an IP in
+// host byte order per 32-bit word followed by the port in hex
+func parseProcNetAddress(s string) (net.IP, int, bool) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, 0, false
+	}
+	raw, err := hex.DecodeString(s[:i])
+	if err != nil || len(raw) != net.IPv4len && len(raw) != net.IPv6len {
+		return nil, 0, false
+	}
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+	ip := make(net.IP, len(raw))
+	for word := 0; word < len(raw); word += 4 {
+		for b := 0; b < 4; b++ {
+			ip[word+b] = raw[word+3-b]
+		}
+	}
+	return ip, int(port), true
+}
+
+// socketProcesses maps socket inodes to the process owning them, e.g.
+// "collector (pid 812)". Processes whose file descriptors cannot be read are
+// skipped.
+func socketProcesses() map[string]string {
+	processes := map[string]string{}
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		target, err := os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(target, "socket:[") {
+			continue
+		}
+		inode := strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]")
+		if _, ok := processes[inode]; ok {
+			continue
+		}
+		pid := strings.Split(fd, "/")[2]
+		comm, _ := os.ReadFile(filepath.Join("/proc", pid, "comm"))
+		processes[inode] = fmt.Sprintf("%s (pid %s)", strings.TrimSpace(string(comm)), pid)
+	}
+	return processes
+}
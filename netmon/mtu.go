@@ -0,0 +1,124 @@
+package netmon
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// OverlayInterfaces maps the tunnel interfaces CNI plugins create to the
+// bytes their encapsulation adds to every packet
+var OverlayInterfaces = map[string]int{
+	"flannel.1":      50, // VXLAN
+	"flannel-wg":     80, // WireGuard, sized for IPv6 outer headers
+	"flannel-wg-v6":  80,
+	"vxlan.calico":   50,
+	"tunl0":          20, // IP-in-IP
+	"wireguard.cali": 60,
+	"cilium_vxlan":   50,
+	"cilium_geneve":  50,
+	"cilium_wg0":     80,
+	"weave":          50,
+}
+
+// mtuProbeSizes are the packet sizes PathMTU tries, covering the MTUs
+// overlays commonly leave after their overhead
+var mtuProbeSizes = []int{9000, 1500, 1480, 1472, 1460, 1450, 1440, 1420, 1400, 1380, 1350, 1280, 1000, 576}
+
+// InterfaceMTU is the MTU of a network interface
+type InterfaceMTU struct {
+	Name string
+	MTU  int
+	// Overhead is the encapsulation overhead of an overlay interface
+	Overhead int
+}
+
+// OverlayMTUs returns the MTUs of the OverlayInterfaces present on this host
+func OverlayMTUs() []InterfaceMTU {
+	var mtus []InterfaceMTU
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range interfaces {
+		if overhead, ok := OverlayInterfaces[iface.Name]; ok {
+			mtus = append(mtus, InterfaceMTU{Name: iface.Name, MTU: iface.MTU, Overhead: overhead})
+		}
+	}
+	return mtus
+}
+
+// LinkMTU returns the MTU of the named interface, or of the interface of
+// the default route for "" or any
+func LinkMTU(name string) (InterfaceMTU, error) {
+	if name == "" || name == "any" {
+		var err error
+		if name, err = defaultRouteInterface(); err != nil {
+			return InterfaceMTU{}, err
+		}
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return InterfaceMTU{}, configError("interface %s: %v", name, err)
+	}
+	return InterfaceMTU{Name: name, MTU: iface.MTU}, nil
+}
+
+// defaultRouteInterface returns the interface of the IPv4 default route
+func defaultRouteInterface() (string, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Iface Destination Gateway ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[1] == "00000000" {
+			return fields[0], nil
+		}
+	}
+	return "", errors.New("no default route")
+}
+
+// PathMTU probes target with pings that must not be fragmented, from the
+// network namespace of pid or from the host when pid is 0, at decreasing
+// sizes up to max. It returns the largest packet size that got through.
+func PathMTU(ctx context.Context, pid int, target string, max int) (int, error) {
+	var last string
+	for _, size := range mtuProbeSizes {
+		if size > max {
+			continue
+		}
+		// the payload leaves room for the IPv4 and ICMP headers
+		args := []string{"ping", "-c", "1", "-W", "1", "-M", "do", "-s", strconv.Itoa(size - 28), target}
+		if pid > 0 {
+			args = append([]string{"nsenter", "-t", strconv.Itoa(pid), "-n"}, args...)
+		}
+		out, err := Command(ctx, args[0], args[1:]...).CombinedOutput()
+		if err == nil {
+			return size, nil
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return 0, &ActionError{Kind: ErrCapture, Command: args[0], Err: err}
+		}
+		if strings.Contains(string(out), "invalid option") {
+			return 0, &ActionError{Kind: ErrCapture, Command: "ping", Err: errors.New("ping does not support -M do (busybox?); install iputils-ping")}
+		}
+		last = "no reply"
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.Contains(line, "error") || strings.Contains(line, "too long") {
+				last = strings.TrimSpace(line)
+			}
+		}
+	}
+	return 0, fmt.Errorf("no probe reached %s unfragmented: %s", target, last)
+}
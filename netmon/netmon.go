@@ -0,0 +1,199 @@
+// Package netmon checks the pods and services of a network monitoring
+// deployment and captures and samples its traffic with kubectl and tcpdump.
+// It is the library behind those parts of the k8s-netmon-debug command;
+// NodePort editing, log collection and the report rendering stay in the
+// command.
+package netmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Config holds the settings shared by the operations. Zero values fall back
+// to the defaults of the k8s-netmon-debug flags.
+type Config struct {
+	// Interfaces are captured in parallel by CapturePackets; empty means any
+	Interfaces []string
+	// TcpdumpFilter selects the captured and sampled traffic (default udp)
+	TcpdumpFilter string
+	// CaptureFile is the capture output; with several interfaces the
+	// interface name is added to it (default packets.pcap). "-" streams the
+	// capture of a single interface to CaptureWriter instead.
+	CaptureFile string
+	// CaptureWriter receives the pcap stream when CaptureFile is "-"
+	// (default os.Stdout)
+	CaptureWriter io.Writer
+	// CaptureRotate, when set, rotates the capture into new timestamped
+	// files at this interval until the context is canceled
+	CaptureRotate time.Duration
+	// CaptureKeep is the number of rotated files kept per interface, 0 keeps all
+	CaptureKeep int
+	// MinFreeSpace stops a capture early when the capture directory has
+	// less free space, 0 disables the check
+	MinFreeSpace uint64
+	// Snaplen is the bytes captured of each packet, 0 captures full packets
+	Snaplen int
+	// NetnsPID, when set, runs the captures and samples inside the network
+	// namespace of this process with nsenter, e.g. a pod's container as
+	// found by ContainerPID, instead of on the host
+	NetnsPID int
+	// CaptureCount, when set, ends each capture after this many packets,
+	// passed to tcpdump as -c, instead of after a minute
+	CaptureCount int
+	// SplitByPort runs one tcpdump per port named in TcpdumpFilter, each
+	// writing its own file, e.g. packets-4729.pcap, instead of one for all
+	SplitByPort bool
+	// FirstPacketPerFlow keeps only the first packet of each flow: tcpdump
+	// only captures TCP SYNs, and its output is filtered on the way to the
+	// capture files so that later packets of a flow are never written, see
+	// Capture.Flows
+	FirstPacketPerFlow bool
+	// CaptureBuffer is the kernel capture buffer in KiB, passed to tcpdump as
+	// -B, 0 keeps tcpdump's default
+	CaptureBuffer int
+	// Direction limits captures to the packets this host received (in) or
+	// sent (out). With in, out or both, SampleIPs also tags each IP with
+	// the direction it was seen in.
+	Direction string
+	// TimePrecision is the capture timestamp precision, micro or nano
+	// (default tcpdump's)
+	TimePrecision string
+	// Wait makes CheckPod wait up to WaitTimeout (default 5m) for the pod
+	// to become ready
+	Wait        bool
+	WaitTimeout time.Duration
+
+	// Output receives progress and status messages; nil discards them
+	Output io.Writer
+	// Color adds ANSI colors to the messages
+	Color bool
+	// Interactive animates progress in place with carriage returns
+	Interactive bool
+	// Quiet suppresses progress
+	Quiet bool
+	// ProgressWidth is the width of progress bars in characters; 0 fits them
+	// to the terminal of Output, or 40 characters when its size is unknown
+	ProgressWidth int
+	// ProgressStyle draws progress bars with ascii (=, the default) or
+	// unicode block characters
+	ProgressStyle string
+	// ProgressFunc, when set, receives the progress of long-running
+	// operations instead of the progress bar on Output. stage names the
+	// operation, e.g. "Capturing packets".
+	ProgressFunc func(current, total int, stage string)
+}
+
+// withDefaults fills in the defaults for unset fields
+func (c Config) withDefaults() Config {
+	if c.Output == nil {
+		c.Output = io.Discard
+	}
+	if c.TcpdumpFilter == "" {
+		c.TcpdumpFilter = "udp"
+	}
+	if c.CaptureFile == "" {
+		c.CaptureFile = "packets.pcap"
+	}
+	if c.CaptureWriter == nil {
+		c.CaptureWriter = os.Stdout
+	}
+	if c.WaitTimeout == 0 {
+		c.WaitTimeout = 5 * time.Minute
+	}
+	return c
+}
+
+// Failure causes that errors returned by the operations can be matched
+// against with errors.Is
+var (
+	ErrKubectl = errors.New("kubectl failed")
+	ErrCapture = errors.New("packet capture failed")
+	ErrConfig  = errors.New("invalid configuration")
+)
+
+// ActionError is an operation failure classified by Kind, one of the Err*
+// causes. Command is the external command that failed, if any.
+type ActionError struct {
+	Kind    error
+	Command string
+	Err     error
+}
+
+func (e *ActionError) Error() string {
+	if e.Command == "" {
+		return e.Err.Error()
+	}
+	return e.Command + ": " + e.Err.Error()
+}
+
+func (e *ActionError) Unwrap() error { return e.Err }
+
+func (e *ActionError) Is(target error) bool { return target == e.Kind }
+
+// configError reports an invalid setting
+func configError(format string, args ...interface{}) error {
+	return &ActionError{Kind: ErrConfig, Err: fmt.Errorf(format, args...)}
+}
+
+// kubectlError reports a failed kubectl invocation, adding the first line of
+// its stderr when the error carries it
+func kubectlError(args []string, err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		err = fmt.Errorf("%v: %s", err, firstLine(strings.TrimSpace(string(exitErr.Stderr))))
+	}
+	return &ActionError{Kind: ErrKubectl, Command: "kubectl " + strings.Join(args, " "), Err: err}
+}
+
+// captureError reports a tcpdump failure
+func captureError(err error) error {
+	return &ActionError{Kind: ErrCapture, Command: "tcpdump", Err: err}
+}
+
+// RunCommand runs a command and returns its standard output. The kubectl
+// queries go through it so tests can replace it with canned output.
+var RunCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return Command(ctx, name, args...).Output()
+}
+
+// KubeContext, when set, selects the kubeconfig context of every kubectl
+// command, like kubectl's --context flag
+var KubeContext string
+
+// KubeNamespace, when set, selects the namespace of every kubectl command,
+// like kubectl's --namespace flag
+var KubeNamespace string
+
+// KubectlArgs returns args prefixed with --context KubeContext and
+// --namespace KubeNamespace when they are set, for callers running kubectl
+// themselves
+func KubectlArgs(args ...string) []string {
+	var prefix []string
+	if KubeContext != "" {
+		prefix = append(prefix, "--context", KubeContext)
+	}
+	if KubeNamespace != "" {
+		prefix = append(prefix, "--namespace", KubeNamespace)
+	}
+	return append(prefix, args...)
+}
+
+// runKubectl runs a kubectl command through RunCommand in KubeContext and
+// KubeNamespace
+func runKubectl(ctx context.Context, args ...string) ([]byte, error) {
+	return RunCommand(ctx, "kubectl", KubectlArgs(args...)...)
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,1086 @@
+package netmon
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeKubectl replaces RunCommand with one answering kubectl get from the
+// testdata fixtures, restoring the real runner when the test ends
+func fakeKubectl(t *testing.T) {
+	t.Helper()
+	pods, err := os.ReadFile(filepath.Join("testdata", "pods.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := os.ReadFile(filepath.Join("testdata", "services.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := os.ReadFile(filepath.Join("testdata", "snapshot.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints, err := os.ReadFile(filepath.Join("testdata", "endpoints.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := os.ReadFile(filepath.Join("testdata", "events.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responses := map[string][]byte{
+		"kubectl get pods -o json":                                pods,
+		"kubectl get pods --all-namespaces -o json":               pods,
+		"kubectl get pods -o json -l app=flow":                    pods,
+		"kubectl get daemonset flow -o jsonpath={.spec.selector}": []byte(`{"matchLabels":{"app":"flow"}}`),
+		"kubectl get services -o json":                            services,
+		"kubectl get services --all-namespaces -o json":           services,
+		"kubectl get pods,services -o json":                       snapshot,
+		"kubectl get endpoints flow-collector -o json":            endpoints,
+		"kubectl get events --field-selector involvedObject.name=flow-exporter-5c6d7f8b9-m4n7r --sort-by=.lastTimestamp -o json": events,
+		"kubectl get pods -o jsonpath={.items[*].metadata.name}": []byte(
+			"flow-collector-7d9f8b6c4-x2kqp flow-exporter-5c6d7f8b9-m4n7r"),
+		`kubectl get replicaset flow-collector-7d9f8b6c4 -o jsonpath={.metadata.ownerReferences[?(@.kind=="Deployment")].name}`: []byte(
+			"flow-collector"),
+		"kubectl get pod flow-exporter-5c6d7f8b9-m4n7r -o jsonpath={.spec.containers[*].name}": []byte(
+			"exporter sidecar"),
+		`kubectl get pod flow-exporter-5c6d7f8b9-m4n7r -o jsonpath={.status.ephemeralContainerStatuses[?(@.name=="netshoot")].state}`: []byte(
+			`{"terminated":{"exitCode":0,"reason":"Completed"}}`),
+		`kubectl get pod flow-exporter-5c6d7f8b9-m4n7r -o jsonpath={.status.ephemeralContainerStatuses[?(@.name=="missing")].state}`: nil,
+		`kubectl get pod flow-exporter-5c6d7f8b9-m4n7r -o jsonpath={.status.containerStatuses[?(@.name=="sidecar")]}`: []byte(
+			`{"name":"sidecar","ready":true,"restartCount":2,"state":{"running":{"startedAt":"2024-05-01T14:03:40Z"}}}`),
+		`kubectl get pod flow-exporter-5c6d7f8b9-m4n7r -o jsonpath={.status.containerStatuses[?(@.name=="exporter")]}`: []byte(
+			`{"name":"exporter","ready":false,"restartCount":7,"state":{"waiting":{"reason":"CrashLoopBackOff"}}}`),
+	}
+	original := RunCommand
+	RunCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		key := strings.Join(append([]string{name}, args...), " ")
+		if out, ok := responses[key]; ok {
+			return out, nil
+		}
+		return nil, errors.New("unexpected command: " + key)
+	}
+	t.Cleanup(func() { RunCommand = original })
+}
+
+func TestCheckPod(t *testing.T) {
+	fakeKubectl(t)
+	tests := []struct {
+		name    string
+		status  string
+		healthy bool
+		warning bool
+		detail  string
+	}{
+		{name: "flow-collector", status: "Running", healthy: true},
+		{name: "flow-exporter", status: "Pending", warning: true},
+		{name: "flow-colector-7d9f8b6c4-x2kqp", status: "not found",
+			detail: "did you mean: flow-collector-7d9f8b6c4-x2kqp"},
+	}
+	for _, tt := range tests {
+		entry := CheckPod(context.Background(), Config{}, tt.name)
+		if entry.Status != tt.status || entry.Healthy != tt.healthy || entry.Warning != tt.warning || entry.Detail != tt.detail {
+			t.Errorf("CheckPod(%q) = %+v, want status %q healthy %v warning %v detail %q",
+				tt.name, entry, tt.status, tt.healthy, tt.warning, tt.detail)
+		}
+	}
+}
+
+func TestCheckService(t *testing.T) {
+	fakeKubectl(t)
+	if entry := CheckService(context.Background(), Config{}, "flow-collector"); entry.Status != "running" || !entry.Healthy {
+		t.Errorf("CheckService(flow-collector) = %+v, want running", entry)
+	}
+	if entry := CheckService(context.Background(), Config{}, "flow"); entry.Status != "not found" || entry.Healthy {
+		t.Errorf("CheckService(flow) = %+v, want not found", entry)
+	}
+}
+
+func TestServiceEndpoints(t *testing.T) {
+	fakeKubectl(t)
+	endpoints, err := ServiceEndpoints(context.Background(), "flow-collector")
+	want := Endpoints{
+		Ready:    []string{"10.42.0.12 (flow-collector-7d9f8b6c4-x2kqp)", "10.42.1.7 (flow-collector-7d9f8b6c4-q8w2e)"},
+		NotReady: []string{"10.42.2.3 (flow-collector-7d9f8b6c4-z5t1y)"},
+	}
+	if err != nil || !reflect.DeepEqual(endpoints, want) {
+		t.Fatalf("ServiceEndpoints() = %+v, %v, want %+v", endpoints, err, want)
+	}
+	if _, err := ServiceEndpoints(context.Background(), "missing"); !errors.Is(err, ErrKubectl) {
+		t.Errorf("ServiceEndpoints(missing) error = %v, want ErrKubectl", err)
+	}
+
+	previous := Endpoints{Ready: []string{"10.42.0.12 (flow-collector-7d9f8b6c4-x2kqp)", "10.42.2.3 (flow-collector-7d9f8b6c4-z5t1y)"}}
+	added, removed := endpoints.Diff(previous)
+	if !reflect.DeepEqual(added, []string{"10.42.1.7 (flow-collector-7d9f8b6c4-q8w2e)"}) ||
+		!reflect.DeepEqual(removed, []string{"10.42.2.3 (flow-collector-7d9f8b6c4-z5t1y)"}) {
+		t.Errorf("Diff() = %q, %q", added, removed)
+	}
+}
+
+func TestPodEvents(t *testing.T) {
+	fakeKubectl(t)
+	events, err := PodEvents(context.Background(), "flow-exporter-5c6d7f8b9-m4n7r")
+	if err != nil || len(events) != 2 {
+		t.Fatalf("PodEvents() = %+v, %v, want 2 events", events, err)
+	}
+	if events[0].Reason != "Scheduled" || events[0].Count != 1 || events[0].Time.IsZero() {
+		t.Errorf("events[0] = %+v, want Scheduled once with its eventTime", events[0])
+	}
+	if want := time.Date(2024, 5, 1, 14, 3, 40, 0, time.UTC); events[1].Type != EventWarning || events[1].Count != 7 || !events[1].Time.Equal(want) {
+		t.Errorf("events[1] = %+v, want a Warning seen 7 times, last at %s", events[1], want)
+	}
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	fakeKubectl(t)
+	snapshot, err := TakeSnapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Pods) != 1 || len(snapshot.Services) != 1 {
+		t.Fatalf("TakeSnapshot() = %d pods, %d services, want 1 and 1", len(snapshot.Pods), len(snapshot.Services))
+	}
+	if entry := snapshot.CheckPod("flow-collector"); entry.Status != "Running" || !entry.Healthy {
+		t.Errorf("CheckPod(flow-collector) = %+v, want Running", entry)
+	}
+	entry := snapshot.CheckService("flow-collector")
+	if !entry.Healthy || !reflect.DeepEqual(entry.Ports, []int{4729, 9996}) {
+		t.Errorf("CheckService(flow-collector) = %+v, want ports 4729 and 9996", entry)
+	}
+}
+
+func TestFindRestartTarget(t *testing.T) {
+	fakeKubectl(t)
+	pods, err := ListPods(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := FindRestartTarget(context.Background(), pods[0])
+	if err != nil || target.String() != "deployment/flow-collector" {
+		t.Errorf("FindRestartTarget(flow-collector) = %v, %v, want deployment/flow-collector", target, err)
+	}
+	if _, err := FindRestartTarget(context.Background(), pods[1]); !errors.Is(err, ErrConfig) {
+		t.Errorf("FindRestartTarget(flow-exporter) error = %v, want ErrConfig for a pod without controller", err)
+	}
+
+	var stan Pod
+	stan.Metadata.Name = "stan-0"
+	stan.Metadata.OwnerReferences = []ownerReference{{Kind: "StatefulSet", Name: "stan"}}
+	target, err = FindRestartTarget(context.Background(), stan)
+	if err != nil || target.String() != "pod/stan-0" || !target.matches(stan) {
+		t.Errorf("FindRestartTarget(stan-0) = %v, %v, want pod/stan-0", target, err)
+	}
+}
+
+func TestRestartTargetMatches(t *testing.T) {
+	pod := func(kind, owner string) Pod {
+		var p Pod
+		p.Metadata.OwnerReferences = []ownerReference{{Kind: kind, Name: owner}}
+		return p
+	}
+	flow := RestartTarget{Kind: "deployment", Name: "flow"}
+	stan := RestartTarget{Kind: "pod", Name: "stan-0", owner: ownerReference{Kind: "StatefulSet", Name: "stan"}}
+	tests := []struct {
+		target RestartTarget
+		pod    Pod
+		want   bool
+	}{
+		{flow, pod("ReplicaSet", "flow-6b8f9c7d5"), true},
+		{flow, pod("ReplicaSet", "flow-collector-7d9f8b6c4"), false},
+		{flow, pod("ReplicaSet", "flow"), false},
+		{flow, pod("StatefulSet", "flow-0"), false},
+		{stan, pod("StatefulSet", "stan"), true},
+		{stan, pod("StatefulSet", "stan-cluster"), false},
+	}
+	for _, tt := range tests {
+		if got := tt.target.matches(tt.pod); got != tt.want {
+			t.Errorf("%v.matches(owner %v) = %v, want %v", tt.target, tt.pod.Metadata.OwnerReferences, got, tt.want)
+		}
+	}
+}
+
+func TestGetPodName(t *testing.T) {
+	fakeKubectl(t)
+	if got := GetPodName(context.Background(), "flow-exporter"); got != "flow-exporter-5c6d7f8b9-m4n7r" {
+		t.Errorf("GetPodName(flow-exporter) = %q", got)
+	}
+	if got := GetPodName(context.Background(), "collector"); got != "" {
+		t.Errorf("GetPodName(collector) = %q, want no match", got)
+	}
+}
+
+func TestPodReadiness(t *testing.T) {
+	fakeKubectl(t)
+	pods, err := ListPods(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods) != 2 {
+		t.Fatalf("ListPods returned %d pods, want 2", len(pods))
+	}
+	if !pods[0].isReady() || pods[0].Status.PodIP != "10.42.0.12" {
+		t.Errorf("collector pod = %+v, want ready with IP 10.42.0.12", pods[0].Status)
+	}
+	if ready, total := pods[1].readyContainers(); pods[1].isReady() || ready != 1 || total != 2 {
+		t.Errorf("exporter pod readiness = %d/%d ready %v, want 1/2 not ready", ready, total, pods[1].isReady())
+	}
+}
+
+func TestPodContainersError(t *testing.T) {
+	fakeKubectl(t)
+	_, err := PodContainers(context.Background(), "gone")
+	var actionErr *ActionError
+	if !errors.Is(err, ErrKubectl) || !errors.As(err, &actionErr) || !strings.HasPrefix(actionErr.Command, "kubectl get pod gone") {
+		t.Errorf("PodContainers(gone) error = %v, want an ErrKubectl naming the command", err)
+	}
+}
+
+func TestProgressFunc(t *testing.T) {
+	var stages []string
+	c := Config{ProgressFunc: func(current, total int, stage string) {
+		stages = append(stages, fmt.Sprintf("%s %d/%d", stage, current, total))
+	}}
+	c.Progress(5, 10, "Capturing packets: ")
+	c.Progress(10, 10, "Capturing packets: ")
+	if want := []string{"Capturing packets 5/10", "Capturing packets 10/10"}; !reflect.DeepEqual(stages, want) {
+		t.Errorf("progress reported %q, want %q", stages, want)
+	}
+}
+
+func TestCountProgress(t *testing.T) {
+	var out strings.Builder
+	c := Config{Output: &out}
+	c.CountProgress(3, 20, "Capturing packets: ")
+	c.CountProgress(20, 20, "Capturing packets: ")
+	if want := "Capturing packets: 3/20\nCapturing packets: 20/20\n"; out.String() != want {
+		t.Errorf("count progress wrote %q, want %q", out.String(), want)
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	tests := []struct {
+		style string
+		width int
+		want  string
+	}{
+		{"ascii", 8, "[===     ]"},
+		{"unicode", 8, "[███▎    ]"},
+		{"unicode", 4, "[█▋  ]"},
+	}
+	for _, test := range tests {
+		var out strings.Builder
+		c := Config{Output: &out, Interactive: true, ProgressWidth: test.width, ProgressStyle: test.style}
+		c.Progress(5, 12, "Capturing: ")
+		if !strings.Contains(out.String(), test.want) {
+			t.Errorf("%s bar of width %d = %q, want %s", test.style, test.width, out.String(), test.want)
+		}
+	}
+
+	// output that is not a terminal has no size to fit
+	if width := (Config{Output: &strings.Builder{}}).barWidth("Capturing: ", "41.7%"); width != defaultBarWidth {
+		t.Errorf("bar width without a terminal = %d, want %d", width, defaultBarWidth)
+	}
+}
+
+func TestProgressETA(t *testing.T) {
+	prefix := "Capturing packets: "
+	if eta := progressETA(0, 100, prefix); eta != "" {
+		t.Errorf("ETA at the start = %q, want none", eta)
+	}
+	// a quarter done after 30s leaves 90s at that rate
+	progressStarts[progressStage(prefix)] = progressStart{at: time.Now().Add(-30 * time.Second)}
+	if eta, want := progressETA(25, 100, prefix), "~01:30 remaining"; eta != want {
+		t.Errorf("ETA at 25/100 = %q, want %q", eta, want)
+	}
+	if eta := progressETA(100, 100, prefix); eta != "" {
+		t.Errorf("ETA when done = %q, want none", eta)
+	}
+	if _, ok := progressStarts[progressStage(prefix)]; ok {
+		t.Error("progress start kept after completion")
+	}
+
+	if stage := progressStage("Collecting logs (3 of 10 lines match): "); stage != "Collecting logs" {
+		t.Errorf("progressStage = %q, want Collecting logs", stage)
+	}
+}
+
+func TestCommandLog(t *testing.T) {
+	var log strings.Builder
+	CommandLog = &log
+	defer func() { CommandLog = nil }()
+
+	Command(context.Background(), "sh", "-c", "exit 3").Run()
+	Command(context.Background(), "echo", "it's").Output()
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("command log has %d lines, want 2:\n%s", len(lines), log.String())
+	}
+	for i, want := range []string{` exit=3 sh -c 'exit 3'`, ` exit=0 echo 'it'\''s'`} {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Errorf("command log line %q, want it to end with %q", lines[i], want)
+		}
+		if _, err := time.Parse(time.RFC3339, strings.Fields(lines[i])[0]); err != nil {
+			t.Errorf("command log line %q does not start with the start time: %v", lines[i], err)
+		}
+	}
+}
+
+func TestLoadFilterFile(t *testing.T) {
+	filter, err := LoadFilterFile(filepath.Join("testdata", "filter.bpf"))
+	if want := "udp port 4729 or udp port 9996"; err != nil || filter != want {
+		t.Errorf("LoadFilterFile = %q, %v, want %q", filter, err, want)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.bpf")
+	os.WriteFile(empty, []byte("# nothing yet\n\n"), 0644)
+	if _, err := LoadFilterFile(empty); !errors.Is(err, ErrConfig) {
+		t.Errorf("LoadFilterFile(comments only) error = %v, want ErrConfig", err)
+	}
+}
+
+func TestFilterWarnings(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   int
+	}{
+		{"udp port 4729 or udp port 9996", 0},
+		{"udp or udp port 4729 or tcp port 4739", 1},
+		{"udp port 4729 or udp port 4729", 1},
+		{"udp and tcp port 4739", 1},
+		{"udp or (udp port 4729)", 0},
+		{"udp or not udp port 4729", 0},
+		{"udp or udp dst port 4729", 0},
+	}
+	for _, tt := range tests {
+		if got := FilterWarnings(tt.filter); len(got) != tt.want {
+			t.Errorf("FilterWarnings(%q) = %q, want %d warnings", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestDirectionFilter(t *testing.T) {
+	tests := map[string]string{
+		DirectionIn:   "inbound and (udp port 4729 or udp port 9996)",
+		DirectionOut:  "outbound and (udp port 4729 or udp port 9996)",
+		DirectionBoth: "udp port 4729 or udp port 9996",
+		"":            "udp port 4729 or udp port 9996",
+	}
+	for direction, want := range tests {
+		if got := directionFilter("udp port 4729 or udp port 9996", direction); got != want {
+			t.Errorf("directionFilter(%q) = %q, want %q", direction, got, want)
+		}
+	}
+	if err := (Config{Direction: "sideways"}).checkDirection(); !errors.Is(err, ErrConfig) {
+		t.Errorf("checkDirection(sideways) = %v, want ErrConfig", err)
+	}
+}
+
+func TestParseFlow(t *testing.T) {
+	tests := []struct {
+		line string
+		want Flow
+		ok   bool
+	}{
+		{line: "12:00:00.000000 eth0 In  IP 10.42.0.7.9996 > 10.42.0.12.40000: UDP, length 120",
+			want: Flow{SrcIP: "10.42.0.7", SrcPort: 9996, DstIP: "10.42.0.12", DstPort: 40000, Proto: "udp"}, ok: true},
+		{line: "IP 10.42.0.12.6443 > 10.42.0.1.51234: Flags [P.], seq 1:100, ack 1, win 502, length 99",
+			want: Flow{SrcIP: "10.42.0.12", SrcPort: 6443, DstIP: "10.42.0.1", DstPort: 51234, Proto: "tcp"}, ok: true},
+		{line: "IP 10.42.0.1 > 10.42.0.12: ICMP echo request, id 1, seq 1, length 64"},
+	}
+	for _, tt := range tests {
+		if got, ok := parseFlow(tt.line); got != tt.want || ok != tt.ok {
+			t.Errorf("parseFlow(%q) = %v, %v, want %v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTopFlows(t *testing.T) {
+	a := Flow{SrcIP: "10.0.0.1", SrcPort: 9996, DstIP: "10.0.0.9", DstPort: 2055, Proto: "udp"}
+	b := Flow{SrcIP: "10.0.0.2", SrcPort: 9996, DstIP: "10.0.0.9", DstPort: 2055, Proto: "udp"}
+	c := Flow{SrcIP: "10.0.0.3", SrcPort: 4729, DstIP: "10.0.0.9", DstPort: 4729, Proto: "udp"}
+	sample := Sample{Flows: map[Flow]int{a: 5, b: 20, c: 5}}
+	want := []FlowCount{{b, 20}, {a, 5}}
+	if got := sample.TopFlows(2); !reflect.DeepEqual(got, want) {
+		t.Errorf("TopFlows(2) = %v, want %v", got, want)
+	}
+}
+
+func TestDroppedPackets(t *testing.T) {
+	stderr := "120 packets captured\n130 packets received by filter\n10 packets dropped by kernel\n"
+	if got := droppedPackets(stderr); got != 10 {
+		t.Errorf("droppedPackets() = %d, want 10", got)
+	}
+	if got := receivedPackets(stderr); got != 130 {
+		t.Errorf("receivedPackets() = %d, want 130", got)
+	}
+	if got := droppedPackets("tcpdump: eth9: No such device exists"); got != 0 {
+		t.Errorf("droppedPackets() = %d, want 0 without statistics", got)
+	}
+}
+
+func TestFilePeakRate(t *testing.T) {
+	// a little-endian microsecond pcap with two packets in second 100 and
+	// one in second 101
+	header := []byte{0xd4, 0xc3, 0xb2, 0xa1, 2, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0, 0, 1, 0, 0, 0}
+	data := append([]byte{}, header...)
+	for _, second := range []byte{100, 100, 101} {
+		data = append(data, second, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0xaa)
+	}
+	path := filepath.Join(t.TempDir(), "rate.pcap")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := filePeakRate(path); got != 2 {
+		t.Errorf("filePeakRate() = %d, want 2", got)
+	}
+	if second, ok := lineSecond("01:02:03.456789 eth0 In IP 10.0.0.1.53 > 10.0.0.2.5353: UDP"); !ok || second != 3723 {
+		t.Errorf("lineSecond() = %d, %v, want 3723", second, ok)
+	}
+}
+
+func TestReplayPcap(t *testing.T) {
+	sample, err := ReplayPcap(filepath.Join("testdata", "replay.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCounts := IPSample{"10.42.0.12": 5, "10.42.0.1": 2, "10.42.0.7": 2, "10.42.0.8": 1}
+	if !reflect.DeepEqual(sample.Counts, wantCounts) {
+		t.Errorf("Counts = %v, want %v", sample.Counts, wantCounts)
+	}
+	top := sample.TopFlows(1)
+	want := Flow{SrcIP: "10.42.0.7", SrcPort: 9996, DstIP: "10.42.0.12", DstPort: 40000, Proto: "udp"}
+	if len(top) != 1 || top[0].Flow != want || top[0].Count != 2 {
+		t.Errorf("TopFlows(1) = %v, want %v with 2 packets", top, want)
+	}
+	if len(sample.Flows) != 3 || sample.PeakPPS != 2 {
+		t.Errorf("got %d flows and peak %d pps, want 3 flows (ICMP has none) and 2 pps", len(sample.Flows), sample.PeakPPS)
+	}
+}
+
+func TestReplayPcapng(t *testing.T) {
+	merged := filepath.Join(t.TempDir(), "merged.pcapng")
+	pcap := filepath.Join("testdata", "replay.pcap")
+	if err := mergePcaps([]string{pcap}, []string{"eth0"}, merged); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ReplayPcap(pcap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReplayPcap(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReplayPcap(pcapng) = %+v, want %+v as from the pcap", got, want)
+	}
+
+	micros := pcapngInterface{units: 1e6}
+	if got := micros.nanoseconds(1714572220912004); got != 1714572220912004000 {
+		t.Errorf("nanoseconds() = %d, want 1714572220912004000", got)
+	}
+}
+
+func TestReplayPcapBogusLength(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "replay.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first record claims 4 GiB of packet data
+	binary.LittleEndian.PutUint32(data[24+8:], 0xffffffff)
+	path := filepath.Join(t.TempDir(), "bogus.pcap")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReplayPcap(path); err == nil || !strings.Contains(err.Error(), "invalid pcap record length") {
+		t.Errorf("ReplayPcap() of a bogus record length = %v, want an invalid length error", err)
+	}
+}
+
+func TestAsymmetric(t *testing.T) {
+	sample, err := ReplayPcap(filepath.Join("testdata", "replay.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Asymmetry{SourcesOnly: []string{"10.42.0.7", "10.42.0.8"}, DestinationsOnly: []string{"10.42.0.1"}}
+	if got := sample.Asymmetric(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Asymmetric() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseLogTime(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"2024-05-01T14:03:40.123456789Z GET /healthz", "2024-05-01T14:03:40.123456789Z"},
+		{"2024-05-01 14:03:40,123 INFO flow decoded", "2024-05-01T14:03:40.123Z"},
+		{"[2024/05/01 14:03:40] listening", "2024-05-01T14:03:40Z"},
+		{"I0501 14:03:40.250000    1 server.go:42] ready", "2024-05-01T14:03:40.25Z"},
+		{"2024-05-01T16:03:40+02:00 converted", "2024-05-01T14:03:40Z"},
+		{"    at decoder.go:42", ""},
+	}
+	for _, test := range tests {
+		got, ok := ParseLogTime(test.line, 2024)
+		if test.want == "" {
+			if ok {
+				t.Errorf("ParseLogTime(%q) = %v, want no timestamp", test.line, got)
+			}
+			continue
+		}
+		if !ok || got.Format(time.RFC3339Nano) != test.want {
+			t.Errorf("ParseLogTime(%q) = %v, %v, want %s", test.line, got.Format(time.RFC3339Nano), ok, test.want)
+		}
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	packets, err := PcapEvents(filepath.Join("testdata", "replay.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, err := LogEvents(filepath.Join("testdata", "timeline.log"), 1970)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 5 || len(logs) != 4 {
+		t.Fatalf("got %d packets and %d log lines, want 5 and 4", len(packets), len(logs))
+	}
+
+	var got []string
+	for _, event := range Timeline(packets, logs, regexp.MustCompile("ERROR"), time.Second) {
+		got = append(got, fmt.Sprintf("%s %s %s", event.Time.Format("05.000"), event.Source, strings.Fields(event.Text)[0]))
+	}
+	// only the second around the error is kept; its stack trace line takes its time
+	want := []string{
+		"41.000 packet 10.42.0.8:4729",
+		"41.000 packet 10.42.0.12:6443",
+		"41.500 log 1970-01-01T00:01:41.500Z",
+		"41.500 log at",
+		"42.000 packet 10.42.0.1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Timeline() = %q, want %q", got, want)
+	}
+}
+
+func TestKubeContext(t *testing.T) {
+	var got []string
+	original := RunCommand
+	RunCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		got = args
+		return []byte("staging staging-cluster https://10.0.0.1:6443"), nil
+	}
+	defer func() { RunCommand, KubeContext = original, "" }()
+
+	KubeContext = "staging"
+	cluster, err := CurrentCluster(context.Background())
+	if err != nil || cluster != (Cluster{Context: "staging", Name: "staging-cluster", Server: "https://10.0.0.1:6443", Namespace: "default"}) {
+		t.Errorf("CurrentCluster() = %+v, %v", cluster, err)
+	}
+	if len(got) < 2 || got[0] != "--context" || got[1] != "staging" {
+		t.Errorf("kubectl args = %q, want --context staging first", got)
+	}
+
+	KubeNamespace = "monitoring"
+	defer func() { KubeNamespace = "" }()
+	cluster, err = CurrentCluster(context.Background())
+	if err != nil || cluster.Namespace != "monitoring" {
+		t.Errorf("CurrentCluster() in namespace monitoring = %+v, %v", cluster, err)
+	}
+	if want := []string{"--context", "staging", "--namespace", "monitoring"}; !reflect.DeepEqual(got[:4], want) {
+		t.Errorf("kubectl args = %q, want %q first", got, want)
+	}
+}
+
+func TestListAllServices(t *testing.T) {
+	fakeKubectl(t)
+	services, err := ListAllServices(context.Background())
+	if err != nil || len(services) != 2 {
+		t.Fatalf("ListAllServices() = %d services, %v", len(services), err)
+	}
+	if service := services[0]; service.Spec.Type != "NodePort" || service.Spec.Ports[0].NodePort != 32055 {
+		t.Errorf("services[0] = %+v, want NodePort 32055", service)
+	}
+}
+
+func TestListAllPods(t *testing.T) {
+	fakeKubectl(t)
+	pods, err := ListAllPods(context.Background())
+	if err != nil || len(pods) != 2 {
+		t.Fatalf("ListAllPods() = %d pods, %v", len(pods), err)
+	}
+	if pod := pods[0]; pod.Metadata.Namespace != "monitoring" || pod.Spec.NodeName != "node-1" {
+		t.Errorf("pods[0] namespace %q node %q, want monitoring on node-1", pod.Metadata.Namespace, pod.Spec.NodeName)
+	}
+}
+
+func TestTcpdumpNetns(t *testing.T) {
+	cmd := Config{}.tcpdump(context.Background(), "-i", "any")
+	if want := []string{"tcpdump", "-i", "any"}; !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("host args = %q, want %q", cmd.Args, want)
+	}
+	cmd = Config{NetnsPID: 4242}.tcpdump(context.Background(), "-i", "any")
+	if want := []string{"nsenter", "-t", "4242", "-n", "tcpdump", "-i", "any"}; !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("netns args = %q, want %q", cmd.Args, want)
+	}
+}
+
+func TestEphemeralContainerState(t *testing.T) {
+	fakeKubectl(t)
+	for name, want := range map[string]string{"netshoot": "terminated", "missing": ""} {
+		got, err := EphemeralContainerState(context.Background(), "flow-exporter-5c6d7f8b9-m4n7r", name)
+		if err != nil || got != want {
+			t.Errorf("EphemeralContainerState(%s) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestDetectCNI(t *testing.T) {
+	fakeKubectl(t)
+	dir := t.TempDir()
+	original := CNIConfDirs
+	CNIConfDirs = []string{filepath.Join(dir, "missing"), dir}
+	defer func() { CNIConfDirs = original }()
+
+	// no configuration and no CNI pods: only k3s's flags tell
+	if cni := DetectCNI(context.Background(), ""); cni.Name != "" {
+		t.Errorf("DetectCNI() without evidence = %+v, want unknown", cni)
+	}
+	cni := DetectCNI(context.Background(), "wireguard-native")
+	if cni.String() != "flannel (wireguard-native)" || cni.OverlayFilter() != "udp port 51820 or udp port 51821" {
+		t.Errorf("DetectCNI(wireguard-native) = %v, filter %q", cni, cni.OverlayFilter())
+	}
+
+	conf := `{"name":"k8s-pod-network","plugins":[{"type":"calico"},{"type":"portmap"}]}`
+	if err := os.WriteFile(filepath.Join(dir, "10-calico.conflist"), []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "99-loopback.conf"), []byte(`{"type":"loopback"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cni = DetectCNI(context.Background(), "none")
+	if cni.Name != "calico" || cni.Backend != "" || len(cni.Evidence) != 2 {
+		t.Errorf("DetectCNI() with calico conflist = %+v", cni)
+	}
+}
+
+func TestPathMTU(t *testing.T) {
+	// a ping that only gets 1450 byte packets through
+	dir := t.TempDir()
+	script := "#!/bin/sh\nwhile [ \"$1\" != -s ]; do shift; done\n[ \"$2\" -le 1422 ] || { echo 'ping: local error: message too long, mtu=1450'; exit 1; }\n"
+	if err := os.WriteFile(filepath.Join(dir, "ping"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	if mtu, err := PathMTU(context.Background(), 0, "10.0.0.1", 1500); err != nil || mtu != 1450 {
+		t.Errorf("PathMTU() = %d, %v, want 1450", mtu, err)
+	}
+	if _, err := PathMTU(context.Background(), 0, "10.0.0.1", 1000); err != nil {
+		t.Errorf("PathMTU(max 1000) = %v", err)
+	}
+}
+
+func TestExpandInterfaces(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"cni0", "eth0", "flannel.1", "lo", "veth1a2b3c4d", "veth5e6f7a8b"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	original := SysClassNet
+	SysClassNet = dir
+	defer func() { SysClassNet = original }()
+
+	tests := []struct {
+		interfaces []string
+		want       []string
+	}{
+		{nil, nil},
+		{[]string{"eth0", "any"}, []string{"eth0", "any"}},
+		{[]string{"veth*"}, []string{"veth1a2b3c4d", "veth5e6f7a8b"}},
+		{[]string{"cni0", "/^(cni|flannel)/"}, []string{"cni0", "flannel.1"}},
+	}
+	for _, tt := range tests {
+		got, err := Config{Interfaces: tt.interfaces}.ExpandInterfaces()
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ExpandInterfaces(%q) = %q, %v, want %q", tt.interfaces, got, err, tt.want)
+		}
+	}
+	for _, pattern := range []string{"tun*", "/[/", "veth[*"} {
+		if _, err := (Config{Interfaces: []string{pattern}}).ExpandInterfaces(); !errors.Is(err, ErrConfig) {
+			t.Errorf("ExpandInterfaces(%s) error = %v, want ErrConfig", pattern, err)
+		}
+	}
+}
+
+func TestCaptureTargets(t *testing.T) {
+	c := Config{TcpdumpFilter: "udp port 4729 or udp port 9996 or tcp port 4729", CaptureFile: "packets.pcap", SplitByPort: true}.withDefaults()
+	targets, err := c.captureTargets(context.Background(), []string{"eth0", "eth1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files, filters []string
+	for _, target := range targets {
+		files = append(files, c.captureFileFor(target, true))
+		filters = append(filters, target.filter)
+	}
+	wantFiles := []string{"packets-eth0-4729.pcap", "packets-eth0-9996.pcap", "packets-eth1-4729.pcap", "packets-eth1-9996.pcap"}
+	if !reflect.DeepEqual(files, wantFiles) {
+		t.Errorf("split capture files = %q, want %q", files, wantFiles)
+	}
+	if want := "(" + c.TcpdumpFilter + ") and port 9996"; filters[1] != want {
+		t.Errorf("split capture filter = %q, want %q", filters[1], want)
+	}
+	if file := c.captureFileFor(targets[0], false); file != "packets-4729.pcap" {
+		t.Errorf("split capture file of a single interface = %q, want packets-4729.pcap", file)
+	}
+
+	c.TcpdumpFilter = "udp"
+	if _, err := c.captureTargets(context.Background(), []string{"any"}); !errors.Is(err, ErrConfig) {
+		t.Errorf("splitting a filter without ports: err = %v, want ErrConfig", err)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	defer func(dir string) { ProcNet = dir }(ProcNet)
+	ProcNet = filepath.Join("testdata", "proc-net")
+	listeners, err := Config{}.Listeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, l := range listeners {
+		got = append(got, fmt.Sprintf("%s %s %d", l.Transport, l.Address, l.Port))
+	}
+	// the established TCP connection is not a listener
+	want := []string{"udp 0.0.0.0:4729 4729", "udp 127.0.0.1:53 53", "udp [::]:9996 9996", "tcp 0.0.0.0:4739 4739"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Listeners() = %q, want %q", got, want)
+	}
+}
+
+func TestPreviewPackets(t *testing.T) {
+	if CheckCapturePrivileges() != nil {
+		t.Skip("no capture privileges")
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\n[ \"$1\" = -d ] && exit 0\ncase \"$*\" in *bogus*) echo 'tcpdump: syntax error' >&2; exit 1;; esac\n" +
+		"echo '12:00:00.000001 IP 10.42.0.12.40000 > 10.43.0.5.4729: UDP, length 120'\necho '1 packet captured' >&2\n"
+	if err := os.WriteFile(filepath.Join(dir, "tcpdump"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	var out bytes.Buffer
+	packets, err := PreviewPackets(context.Background(), Config{TcpdumpFilter: "udp port 4729", Output: &out}, 5, time.Second)
+	if err != nil || len(packets) != 1 || !strings.Contains(out.String(), "10.43.0.5.4729") {
+		t.Errorf("PreviewPackets() = %q, %v, output %q", packets, err, out.String())
+	}
+	if _, err := PreviewPackets(context.Background(), Config{TcpdumpFilter: "bogus"}, 5, time.Second); !errors.Is(err, ErrCapture) {
+		t.Errorf("PreviewPackets(bogus) error = %v, want ErrCapture", err)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	allowlist, err := LoadAllowlist(filepath.Join("testdata", "allowlist.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips := []IPCount{{IP: "10.42.0.12"}, {IP: "10.42.0.17"}, {IP: "192.0.2.10"}, {IP: "192.0.2.11"}, {IP: "2001:db8::1"}}
+	if unknown := allowlist.MarkUnknown(ips); unknown != 2 || !ips[1].Unknown || !ips[3].Unknown || ips[4].Unknown {
+		t.Errorf("MarkUnknown() = %d, %+v, want 10.42.0.17 and 192.0.2.11 unknown", unknown, ips)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.txt")
+	os.WriteFile(bad, []byte("10.0.0.0/8\n10.0.0.300\n"), 0644)
+	if _, err := LoadAllowlist(bad); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("LoadAllowlist(bad) error = %v, want one naming line 2", err)
+	}
+}
+
+// mmdbValue encodes a string, uint32 or map for a test MaxMind DB
+func mmdbValue(v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		if len(v) >= 29 {
+			return append([]byte{2<<5 | 29, byte(len(v) - 29)}, v...)
+		}
+		return append([]byte{2<<5 | byte(len(v))}, v...)
+	case uint32:
+		return []byte{6<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b := []byte{7<<5 | byte(len(v))}
+		for _, key := range keys {
+			b = append(append(b, mmdbValue(key)...), mmdbValue(v[key])...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+// writeTestGeoIPDB writes an IPv4 MaxMind DB with one node: 0.0.0.0/1 has
+// record, 128.0.0.0/1 has nothing
+func writeTestGeoIPDB(t *testing.T, record map[string]interface{}) string {
+	const nodeCount = 1
+	data := mmdbValue(record)
+	tree := []byte{0, 0, nodeCount + 16, 0, 0, nodeCount}
+	file := append(append(tree, make([]byte, 16)...), data...)
+	file = append(append(file, mmdbMetadataMarker...), mmdbValue(map[string]interface{}{
+		"node_count": uint32(nodeCount), "record_size": uint32(24), "ip_version": uint32(4),
+	})...)
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoIP(t *testing.T) {
+	country := writeTestGeoIPDB(t, map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "US"},
+	})
+	asn := writeTestGeoIPDB(t, map[string]interface{}{
+		"autonomous_system_number": uint32(15169), "autonomous_system_organization": "Google LLC",
+	})
+	geo, err := OpenGeoIP([]string{country, asn})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips := []IPCount{{IP: "8.8.8.8"}, {IP: "192.0.2.1"}, {IP: "10.42.0.12"}, {IP: "127.0.0.1"}}
+	geo.AnnotateIPs(ips)
+	want := []string{"US, AS15169 Google LLC", NoGeoIPData, "", ""}
+	for i, ip := range ips {
+		if ip.GeoIP != want[i] {
+			t.Errorf("GeoIP of %s = %q, want %q", ip.IP, ip.GeoIP, want[i])
+		}
+	}
+
+	if _, err := OpenGeoIPDB(filepath.Join("testdata", "pods.json")); err == nil {
+		t.Error("OpenGeoIPDB(pods.json) succeeded, want not a MaxMind DB")
+	}
+}
+
+func TestParseWorkload(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Workload
+		wantErr bool
+	}{
+		{spec: "daemonset/collector", want: Workload{Kind: "daemonset", Name: "collector"}},
+		{spec: "DS/collector", want: Workload{Kind: "daemonset", Name: "collector"}},
+		{spec: "sts/kafka", want: Workload{Kind: "statefulset", Name: "kafka"}},
+		{spec: "deploy/flow-collector", want: Workload{Kind: "deployment", Name: "flow-collector"}},
+		{spec: "collector", wantErr: true},
+		{spec: "pod/collector", wantErr: true},
+		{spec: "ds/", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseWorkload(tt.spec)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseWorkload(%q) = %+v, %v", tt.spec, got, err)
+		}
+	}
+}
+
+func TestLabelSelector(t *testing.T) {
+	var selector labelSelector
+	err := json.Unmarshal([]byte(`{"matchLabels": {"tier": "edge", "app": "collector"},
+		"matchExpressions": [{"key": "zone", "operator": "In", "values": ["a", "b"]},
+			{"key": "canary", "operator": "DoesNotExist"}]}`), &selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := selector.String(), "app=collector,tier=edge,zone in (a,b),!canary"; got != want {
+		t.Errorf("selector = %q, want %q", got, want)
+	}
+}
+
+func TestCheckWorkload(t *testing.T) {
+	fakeKubectl(t)
+	entries := CheckWorkload(context.Background(), Workload{Kind: "daemonset", Name: "flow"})
+	if len(entries) != 3 {
+		t.Fatalf("CheckWorkload() = %+v, want the aggregate and 2 pods", entries)
+	}
+	if aggregate := entries[0]; aggregate.Status != "1/2 pods ready" || aggregate.Healthy || !aggregate.Warning {
+		t.Errorf("aggregate = %+v, want 1/2 pods ready as a warning", aggregate)
+	}
+	if pod := entries[1]; pod.Resource != "flow-collector-7d9f8b6c4-x2kqp" || !pod.Healthy || pod.Detail != "1/1 containers ready on node-1" {
+		t.Errorf("first pod = %+v", pod)
+	}
+	if pod := entries[2]; pod.Healthy || !pod.Warning || pod.Status != "Pending" {
+		t.Errorf("second pod = %+v, want Pending as a warning", pod)
+	}
+
+	entries = CheckWorkload(context.Background(), Workload{Kind: "statefulset", Name: "missing"})
+	if len(entries) != 1 || entries[0].Status != "error" || entries[0].Healthy {
+		t.Errorf("CheckWorkload(missing) = %+v, want an error", entries)
+	}
+}
+
+func TestResourceQuantities(t *testing.T) {
+	for in, want := range map[string]int64{"250m": 250, "0.5": 500, "2": 2000, "1500000n": 1, "1200u": 1} {
+		if got, err := parseCPUQuantity(in); got != want || err != nil {
+			t.Errorf("parseCPUQuantity(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for in, want := range map[string]int64{"128Mi": 128 << 20, "1Gi": 1 << 30, "500M": 500e6, "134217728": 134217728} {
+		if got, err := parseMemoryQuantity(in); got != want || err != nil {
+			t.Errorf("parseMemoryQuantity(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	if _, err := parseMemoryQuantity("lots"); err == nil {
+		t.Error("parseMemoryQuantity(lots) succeeded")
+	}
+}
+
+func TestPodUsage(t *testing.T) {
+	original := RunCommand
+	defer func() { RunCommand = original }()
+	RunCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		if args[2] == "missing" {
+			return nil, &exec.ExitError{Stderr: []byte("error: Metrics API not available\n")}
+		}
+		return []byte("flow-collector-7d9f8b6c4-x2kqp   collector   12m   34Mi\nflow-collector-7d9f8b6c4-x2kqp   sidecar   1m   5Mi\n"), nil
+	}
+
+	usage, err := PodUsage(context.Background(), "flow-collector-7d9f8b6c4-x2kqp")
+	want := []ContainerUsage{{Container: "collector", CPU: 12, Memory: 34 << 20}, {Container: "sidecar", CPU: 1, Memory: 5 << 20}}
+	if err != nil || !reflect.DeepEqual(usage, want) {
+		t.Errorf("PodUsage() = %+v, %v, want %+v", usage, err, want)
+	}
+	if _, err := PodUsage(context.Background(), "missing"); !errors.Is(err, ErrMetricsUnavailable) || !errors.Is(err, ErrKubectl) {
+		t.Errorf("PodUsage() without metrics-server error = %v, want ErrMetricsUnavailable", err)
+	}
+}
+
+func TestFirstPackets(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "replay.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "flows.pcap")
+	f := newFirstPackets()
+	flows, peak, err := f.write(bytes.NewReader(data), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample, err := ReplayPcap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flows != 4 || len(sample.Flows) != 3 || filePackets(path) != 4 || peak != 2 {
+		t.Errorf("got %d flows, %d TCP/UDP flows, %d packets and peak %d pps, want 4 flows (one ICMP), 3, 4 and 2 pps",
+			flows, len(sample.Flows), filePackets(path), peak)
+	}
+	for flow, count := range sample.Flows {
+		if count != 1 {
+			t.Errorf("flow %s has %d packets, want 1", flow, count)
+		}
+	}
+
+	// the same flows in the next rotated file, or on another interface, are
+	// not kept again
+	next := filepath.Join(dir, "next.pcap")
+	if flows, _, err := f.write(bytes.NewReader(data), next); err != nil || flows != 0 || filePackets(next) != 0 {
+		t.Errorf("second write() = %d flows, %d packets, %v, want none", flows, filePackets(next), err)
+	}
+
+	request := Flow{SrcIP: "10.42.0.7", SrcPort: 9996, DstIP: "10.42.0.12", DstPort: 40000, Proto: "udp"}
+	reply := Flow{SrcIP: "10.42.0.12", SrcPort: 40000, DstIP: "10.42.0.7", DstPort: 9996, Proto: "udp"}
+	if flowKey(request.SrcIP, request.DstIP, request) != flowKey(reply.SrcIP, reply.DstIP, reply) {
+		t.Errorf("flowKey() differs for a request %v and its reply %v", request, reply)
+	}
+
+	if got, want := firstPacketFilter("udp port 4729 or tcp port 443"),
+		"(udp port 4729 or tcp port 443) and (not tcp or tcp[tcpflags] & tcp-syn != 0)"; got != want {
+		t.Errorf("firstPacketFilter() = %q, want %q", got, want)
+	}
+}
+
+func TestContainerStart(t *testing.T) {
+	fakeKubectl(t)
+	started, restarts, err := ContainerStart(context.Background(), "flow-exporter-5c6d7f8b9-m4n7r", "sidecar")
+	if err != nil || !started.Equal(time.Date(2024, 5, 1, 14, 3, 40, 0, time.UTC)) || restarts != 2 {
+		t.Errorf("ContainerStart(sidecar) = %v, %d, %v, want 2024-05-01T14:03:40Z after 2 restarts", started, restarts, err)
+	}
+	if _, restarts, err := ContainerStart(context.Background(), "flow-exporter-5c6d7f8b9-m4n7r", "exporter"); err == nil || restarts != 7 {
+		t.Errorf("ContainerStart(exporter) = %d restarts, %v, want an error for a waiting container", restarts, err)
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"flow", "flow", 0},
+		{"flaw", "flow", 1},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if got := levenshtein(tt.a, tt.b); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSuggestNames(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		candidates []string
+		want       []string
+	}{
+		{"no candidates", "collector", nil, []string{}},
+		{"substring first", "stan", []string{"stun-0", "stan-0"}, []string{"stan-0", "stun-0"}},
+		{"ties keep their order", "collectr", []string{"collector-b", "collector-a"}, []string{"collector-b", "collector-a"}},
+		{"beyond the cutoff", "redis", []string{"nginx", "redis-0"}, []string{"redis-0"}},
+		{"longer names allow more edits", "flow-collector", []string{"flaw-colector-x"}, []string{"flaw-colector-x"}},
+		{"case-insensitive", "FLOW", []string{"Flow-Collector"}, []string{"Flow-Collector"}},
+		{"at most five", "app", []string{"app-1", "app-2", "app-3", "app-4", "app-5", "app-6"},
+			[]string{"app-1", "app-2", "app-3", "app-4", "app-5"}},
+	}
+	for _, tt := range tests {
+		if got := suggestNames(tt.target, tt.candidates); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: suggestNames(%q) = %q, want %q", tt.name, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeMMDBDepth(t *testing.T) {
+	// a pointer to itself
+	if _, _, err := decodeMMDB([]byte{0x20, 0x00}, 0, 0); err == nil {
+		t.Error("decodeMMDB() of a pointer loop succeeded, want an error")
+	}
+	if value, _, err := decodeMMDB([]byte{0x43, 'a', 'b', 'c'}, 0, 0); err != nil || value != "abc" {
+		t.Errorf("decodeMMDB(string) = %v, %v, want abc", value, err)
+	}
+}
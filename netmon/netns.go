@@ -0,0 +1,59 @@
+package netmon
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// tcpdump returns a tcpdump command, run in the network namespace of
+// c.NetnsPID with nsenter when it is set
+func (c Config) tcpdump(ctx context.Context, args ...string) *Cmd {
+	if c.NetnsPID > 0 {
+		return Command(ctx, "nsenter", append([]string{"-t", strconv.Itoa(c.NetnsPID), "-n", "tcpdump"}, args...)...)
+	}
+	return Command(ctx, "tcpdump", args...)
+}
+
+// ContainerPID returns the host PID of a container of pod, whose network
+// namespace is the pod's. It asks the node's container runtime with crictl,
+// so the pod must run on this node. With container empty the pod's first
+// container is used.
+func ContainerPID(ctx context.Context, pod, container string) (int, error) {
+	path := "{.status.containerStatuses[0].containerID}"
+	if container != "" {
+		path = fmt.Sprintf(`{.status.containerStatuses[?(@.name=="%s")].containerID}`, container)
+	}
+	args := []string{"get", "pod", pod, "-o", "jsonpath=" + path}
+	out, err := runKubectl(ctx, args...)
+	if err != nil {
+		return 0, kubectlError(args, err)
+	}
+	id := strings.TrimSpace(string(out))
+	if id == "" {
+		return 0, configError("pod %s has no running container %s", pod, container)
+	}
+	// containerd://0123abcd... -> 0123abcd...
+	if i := strings.Index(id, "://"); i >= 0 {
+		id = id[i+3:]
+	}
+
+	crictl := []string{"crictl"}
+	if _, err := exec.LookPath("crictl"); err != nil {
+		crictl = []string{"k3s", "crictl"}
+	}
+	crictlArgs := append(crictl[1:], "inspect", "--output", "go-template", "--template", "{{.info.pid}}", id)
+	out, err = Command(ctx, crictl[0], crictlArgs...).CombinedOutput()
+	if err != nil {
+		return 0, &ActionError{Kind: ErrCapture, Command: strings.Join(crictl, " ") + " inspect",
+			Err: fmt.Errorf("%v: %s (does pod %s run on this node?)", err, firstLine(strings.TrimSpace(string(out))), pod)}
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil || pid <= 0 {
+		return 0, &ActionError{Kind: ErrCapture, Command: strings.Join(crictl, " ") + " inspect",
+			Err: fmt.Errorf("no PID for container %s: %q", id, strings.TrimSpace(string(out)))}
+	}
+	return pid, nil
+}
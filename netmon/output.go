@@ -0,0 +1,202 @@
+package netmon
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// palette holds the ANSI color codes, all empty when colors are off
+type palette struct {
+	reset, red, green, yellow, cyan string
+}
+
+func (c Config) colors() palette {
+	if !c.Color {
+		return palette{}
+	}
+	return palette{reset: "\033[0m", red: "\033[31m", green: "\033[32m", yellow: "\033[33m", cyan: "\033[36m"}
+}
+
+// lastProgress remembers the last 10% step reported per progress prefix when
+// progress is written as plain lines, and progressStarts when and where each
+// progress stage started, to estimate the time remaining
+var (
+	lastProgress   = map[string]int{}
+	progressStarts = map[string]progressStart{}
+	lastProgressMu sync.Mutex
+)
+
+type progressStart struct {
+	at      time.Time
+	current int
+}
+
+// Progress reports progress to ProgressFunc when it is set. Otherwise it
+// writes a progress bar to Output, or a plain line every 10% when Interactive
+// is off.
+func (c Config) Progress(current, total int, prefix string) {
+	c.progress(current, total, prefix, fmt.Sprintf("%.1f%%", float64(current)*100/float64(total)))
+}
+
+// CountProgress is Progress labeled with current/total instead of a
+// percentage, for progress measured in items such as packets
+func (c Config) CountProgress(current, total int, prefix string) {
+	c.progress(current, total, prefix, fmt.Sprintf("%d/%d", current, total))
+}
+
+func (c Config) progress(current, total int, prefix, label string) {
+	if c.ProgressFunc != nil {
+		c.ProgressFunc(current, total, strings.TrimSuffix(prefix, ": "))
+		return
+	}
+	c = c.withDefaults()
+	if c.Quiet {
+		return
+	}
+	eta := progressETA(current, total, prefix)
+	if !c.Interactive {
+		lastProgressMu.Lock()
+		defer lastProgressMu.Unlock()
+		step := current * 10 / total
+		if last, ok := lastProgress[prefix]; !ok || step != last {
+			lastProgress[prefix] = step
+			if strings.HasSuffix(label, "%") {
+				label = fmt.Sprintf("%d%%", current*100/total)
+			}
+			if eta != "" {
+				label += " " + eta
+			}
+			fmt.Fprintf(c.Output, "%s%s\n", prefix, label)
+		}
+		if current >= total {
+			delete(lastProgress, prefix)
+		}
+		return
+	}
+
+	// the space of the estimate is kept while there is none yet, so the bar
+	// does not shift when it appears
+	if eta == "" {
+		eta = strings.Repeat(" ", len(formatETA(0)))
+	}
+	label += " " + eta
+	fmt.Fprintf(c.Output, "\r%s [%s] %s ", prefix, c.progressBar(current, total, c.barWidth(prefix, label)), label)
+
+	if current == total {
+		fmt.Fprintln(c.Output)
+	}
+}
+
+// progressETA estimates the time until current reaches total from the rate
+// observed since the progress stage of prefix started, e.g. "~02:30
+// remaining". It is empty until there is a rate to go by. Percentages of
+// timed actions and counts such as packets are estimated alike.
+func progressETA(current, total int, prefix string) string {
+	lastProgressMu.Lock()
+	defer lastProgressMu.Unlock()
+	stage := progressStage(prefix)
+	start, ok := progressStarts[stage]
+	if !ok || current < start.current {
+		progressStarts[stage] = progressStart{at: time.Now(), current: current}
+		return ""
+	}
+	if current >= total {
+		delete(progressStarts, stage)
+		return ""
+	}
+	done, elapsed := current-start.current, time.Since(start.at)
+	if done <= 0 || elapsed < time.Second {
+		return ""
+	}
+	return formatETA(time.Duration(float64(elapsed) * float64(total-current) / float64(done)))
+}
+
+// progressStage is prefix without the counts some progress lines include,
+// e.g. "Collecting logs" for "Collecting logs (3 of 10 lines match): "
+func progressStage(prefix string) string {
+	if i := strings.Index(prefix, " ("); i >= 0 {
+		return prefix[:i]
+	}
+	return strings.TrimSuffix(prefix, ": ")
+}
+
+func formatETA(d time.Duration) string {
+	seconds := int(d.Round(time.Second).Seconds())
+	return fmt.Sprintf("~%02d:%02d remaining", seconds/60, seconds%60)
+}
+
+// Progress bar widths: the default when the terminal size is unknown and the
+// bounds of a bar fitted to the terminal
+const (
+	defaultBarWidth = 40
+	minBarWidth     = 10
+	maxBarWidth     = 100
+)
+
+// barWidth returns c.ProgressWidth or the width that fills the terminal
+// line after prefix and label
+func (c Config) barWidth(prefix, label string) int {
+	if c.ProgressWidth > 0 {
+		return c.ProgressWidth
+	}
+	columns := terminalWidth(c.Output)
+	if columns <= 0 {
+		return defaultBarWidth
+	}
+	// "prefix [bar] label " must stay within the line, or the terminal wraps
+	// it and the carriage return no longer rewrites it in place
+	width := columns - utf8.RuneCountInString(prefix) - utf8.RuneCountInString(label) - 5
+	if width < minBarWidth {
+		return minBarWidth
+	}
+	if width > maxBarWidth {
+		return maxBarWidth
+	}
+	return width
+}
+
+// unicodeEighths are the block characters filling a cell by eighths
+var unicodeEighths = []string{"", "▏", "▎", "▍", "▌", "▋", "▊", "▉"}
+
+// progressBar draws the bar of a progress line, width characters wide
+func (c Config) progressBar(current, total, width int) string {
+	if current > total {
+		current = total
+	}
+	if c.ProgressStyle != "unicode" {
+		completed := width * current / total
+		return strings.Repeat("=", completed) + strings.Repeat(" ", width-completed)
+	}
+	eighths := width * 8 * current / total
+	bar := strings.Repeat("█", eighths/8)
+	cells := eighths / 8
+	if partial := unicodeEighths[eighths%8]; partial != "" {
+		bar += partial
+		cells++
+	}
+	return bar + strings.Repeat(" ", width-cells)
+}
+
+// ClearStatusLine erases an in-place status line before a result is printed
+func (c Config) ClearStatusLine() {
+	if c.Interactive && c.Output != nil {
+		fmt.Fprint(c.Output, "\r\033[K")
+	}
+}
+
+// FormatBytes returns n in the largest binary unit that keeps it above one
+func FormatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGT"[exp])
+}
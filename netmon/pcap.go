@@ -0,0 +1,382 @@
+package netmon
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// pcapngSectionHeader is the type of the block starting a pcapng section,
+// the same in either byte order
+const pcapngSectionHeader = 0x0a0d0d0a
+
+// pcapngMaxBlock bounds the blocks read from a pcapng file, well above the
+// largest packet tcpdump captures
+const pcapngMaxBlock = 16 << 20
+
+// pcapMaxSnapLen is the largest snapshot length tcpdump uses, which bounds
+// the records of a classic pcap file whose header claims less
+const pcapMaxSnapLen = 262144
+
+// pcapPacket is a packet record read from a capture file
+type pcapPacket struct {
+	timestamp int64 // nanoseconds since the epoch
+	origLen   uint32
+	linkType  uint32
+	data      []byte
+}
+
+// pcapReader reads packets from a classic libpcap file as written by
+// tcpdump -w, in either byte order and with micro or nanosecond timestamps,
+// or from a pcapng file such as the one -merge writes
+type pcapReader struct {
+	r        *bufio.Reader
+	header   []byte
+	order    binary.ByteOrder
+	nanos    bool
+	linkType uint32
+	snapLen  uint32
+	// ng is set for pcapng files, whose packets take their link type and
+	// timestamp resolution from the interfaces of the current section
+	ng         bool
+	interfaces []pcapngInterface
+}
+
+// pcapngInterface is an interface described in a pcapng section
+type pcapngInterface struct {
+	linkType uint32
+	// units is the number of timestamp units per second
+	units uint64
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	p := &pcapReader{r: bufio.NewReader(r)}
+	if magic, err := p.r.Peek(4); err == nil && binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		p.ng = true
+		return p, nil
+	}
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(p.r, header); err != nil {
+		return nil, fmt.Errorf("reading pcap header: %v", err)
+	}
+
+	p.header = header
+	switch binary.LittleEndian.Uint32(header) {
+	case 0xa1b2c3d4:
+		p.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		p.order, p.nanos = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		p.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		p.order, p.nanos = binary.BigEndian, true
+	default:
+		return nil, errors.New("not a pcap or pcapng file")
+	}
+	p.snapLen = p.order.Uint32(header[16:])
+	p.linkType = p.order.Uint32(header[20:])
+	return p, nil
+}
+
+// next returns the next packet, or io.EOF at the end of the file
+func (p *pcapReader) next() (*pcapPacket, error) {
+	if p.ng {
+		return p.nextBlock()
+	}
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(p.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// tcpdump was stopped mid-write; treat the partial record as the end
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	seconds := int64(p.order.Uint32(header[0:]))
+	fraction := int64(p.order.Uint32(header[4:]))
+	if !p.nanos {
+		fraction *= 1000
+	}
+	// a corrupt length must not allocate gigabytes
+	captured, limit := p.order.Uint32(header[8:]), p.snapLen
+	if limit < pcapMaxSnapLen {
+		limit = pcapMaxSnapLen
+	}
+	if captured > limit {
+		return nil, fmt.Errorf("invalid pcap record length %d", captured)
+	}
+	packet := &pcapPacket{
+		timestamp: seconds*1e9 + fraction,
+		origLen:   p.order.Uint32(header[12:]),
+		linkType:  p.linkType,
+		data:      make([]byte, captured),
+	}
+	if _, err := io.ReadFull(p.r, packet.data); err != nil {
+		return nil, io.EOF
+	}
+	return packet, nil
+}
+
+// nextBlock reads pcapng blocks up to the next enhanced packet block,
+// taking note of the section headers and interfaces on the way. Other
+// blocks, including simple packet blocks, which have no timestamp, are
+// skipped.
+func (p *pcapReader) nextBlock() (*pcapPacket, error) {
+	for {
+		header := make([]byte, 12)
+		if _, err := io.ReadFull(p.r, header[:8]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		headerLen := 8
+		if binary.LittleEndian.Uint32(header) == pcapngSectionHeader {
+			if _, err := io.ReadFull(p.r, header[8:]); err != nil {
+				return nil, io.EOF
+			}
+			headerLen = 12
+			switch binary.LittleEndian.Uint32(header[8:]) {
+			case 0x1a2b3c4d:
+				p.order = binary.LittleEndian
+			case 0x4d3c2b1a:
+				p.order = binary.BigEndian
+			default:
+				return nil, errors.New("pcapng section header has an unknown byte order")
+			}
+			p.interfaces = nil
+		}
+		if p.order == nil {
+			return nil, errors.New("pcapng file does not start with a section header")
+		}
+
+		length := p.order.Uint32(header[4:])
+		if length < 12 || length%4 != 0 || length > pcapngMaxBlock {
+			return nil, fmt.Errorf("invalid pcapng block length %d", length)
+		}
+		body := make([]byte, int(length)-headerLen)
+		if _, err := io.ReadFull(p.r, body); err != nil {
+			// a partial block is the end, like a partial pcap record
+			return nil, io.EOF
+		}
+		body = body[:len(body)-4] // the trailing copy of the length
+
+		switch p.order.Uint32(header) {
+		case 1: // interface description block
+			if len(body) < 8 {
+				return nil, errors.New("short pcapng interface description block")
+			}
+			p.interfaces = append(p.interfaces, pcapngInterface{
+				linkType: uint32(p.order.Uint16(body)),
+				units:    p.timestampUnits(body[8:]),
+			})
+		case 6: // enhanced packet block
+			if len(body) < 20 {
+				return nil, errors.New("short pcapng packet block")
+			}
+			id := p.order.Uint32(body)
+			if int(id) >= len(p.interfaces) {
+				return nil, fmt.Errorf("pcapng packet of undescribed interface %d", id)
+			}
+			iface := p.interfaces[id]
+			captured := p.order.Uint32(body[12:])
+			if uint64(captured) > uint64(len(body)-20) {
+				return nil, errors.New("pcapng packet longer than its block")
+			}
+			ts := uint64(p.order.Uint32(body[4:]))<<32 | uint64(p.order.Uint32(body[8:]))
+			return &pcapPacket{
+				timestamp: iface.nanoseconds(ts),
+				origLen:   p.order.Uint32(body[16:]),
+				linkType:  iface.linkType,
+				data:      body[20 : 20+captured],
+			}, nil
+		}
+	}
+}
+
+// timestampUnits reads the if_tsresol option of an interface description
+// block, defaulting to microseconds
+func (p *pcapReader) timestampUnits(options []byte) uint64 {
+	units := uint64(1e6)
+	for len(options) >= 4 {
+		code, n := p.order.Uint16(options), int(p.order.Uint16(options[2:]))
+		if code == 0 || 4+n > len(options) {
+			break
+		}
+		if code == 9 && n >= 1 {
+			if resolution := options[4]; resolution&0x80 != 0 && resolution&0x7f < 63 {
+				units = 1 << (resolution & 0x7f)
+			} else if resolution <= 18 {
+				units = 1
+				for i := byte(0); i < resolution; i++ {
+					units *= 10
+				}
+			}
+		}
+		step := 4 + (n+3)&^3
+		if step > len(options) {
+			break
+		}
+		options = options[step:]
+	}
+	return units
+}
+
+// nanoseconds converts a timestamp in the interface's units
+func (i pcapngInterface) nanoseconds(ts uint64) int64 {
+	fraction := ts % i.units
+	if i.units <= 1e9 {
+		fraction = fraction * 1e9 / i.units
+	} else {
+		fraction = uint64(float64(fraction) * 1e9 / float64(i.units))
+	}
+	return int64(ts/i.units)*1e9 + int64(fraction)
+}
+
+// writeHeader writes the file header p read, so that writeRecord can
+// write a copy of the file. Only classic pcap files can be copied.
+func (p *pcapReader) writeHeader(w io.Writer) error {
+	if p.ng {
+		return errors.New("copying pcapng files is not supported")
+	}
+	_, err := w.Write(p.header)
+	return err
+}
+
+// writeRecord writes packet as a record in the byte order and timestamp
+// precision of p's file
+func (p *pcapReader) writeRecord(w io.Writer, packet *pcapPacket) error {
+	header := make([]byte, 16)
+	fraction := packet.timestamp % 1e9
+	if !p.nanos {
+		fraction /= 1000
+	}
+	p.order.PutUint32(header[0:], uint32(packet.timestamp/1e9))
+	p.order.PutUint32(header[4:], uint32(fraction))
+	p.order.PutUint32(header[8:], uint32(len(packet.data)))
+	p.order.PutUint32(header[12:], packet.origLen)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(packet.data)
+	return err
+}
+
+// pcapngWriter writes a pcapng stream. Unlike classic pcap it can hold
+// several interfaces, each with its own name and link type.
+type pcapngWriter struct {
+	w *bufio.Writer
+}
+
+func (p *pcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	padded := (len(body) + 3) &^ 3
+	length := uint32(12 + padded)
+	block := make([]byte, length)
+	binary.LittleEndian.PutUint32(block[0:], blockType)
+	binary.LittleEndian.PutUint32(block[4:], length)
+	copy(block[8:], body)
+	binary.LittleEndian.PutUint32(block[length-4:], length)
+	_, err := p.w.Write(block)
+	return err
+}
+
+// pcapngOption encodes a block option, padded to 32 bits
+func pcapngOption(code uint16, value []byte) []byte {
+	option := make([]byte, 4+(len(value)+3)&^3)
+	binary.LittleEndian.PutUint16(option[0:], code)
+	binary.LittleEndian.PutUint16(option[2:], uint16(len(value)))
+	copy(option[4:], value)
+	return option
+}
+
+func (p *pcapngWriter) writeSectionHeader() error {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], 0x1a2b3c4d) // byte-order magic
+	binary.LittleEndian.PutUint16(body[4:], 1)          // major version
+	binary.LittleEndian.PutUint16(body[6:], 0)          // minor version
+	binary.LittleEndian.PutUint64(body[8:], ^uint64(0)) // section length unknown
+	return p.writeBlock(0x0a0d0d0a, body)
+}
+
+// writeInterface describes an interface whose packets use nanosecond timestamps
+func (p *pcapngWriter) writeInterface(name string, linkType, snapLen uint32) error {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:], uint16(linkType))
+	binary.LittleEndian.PutUint32(body[4:], snapLen)
+	body = append(body, pcapngOption(2, []byte(name))...) // if_name
+	body = append(body, pcapngOption(9, []byte{9})...)    // if_tsresol: 10^-9
+	body = append(body, pcapngOption(0, nil)...)          // opt_endofopt
+	return p.writeBlock(1, body)
+}
+
+func (p *pcapngWriter) writePacket(interfaceID int, packet *pcapPacket) error {
+	body := make([]byte, 20, 20+len(packet.data))
+	binary.LittleEndian.PutUint32(body[0:], uint32(interfaceID))
+	binary.LittleEndian.PutUint32(body[4:], uint32(uint64(packet.timestamp)>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(packet.timestamp))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(packet.data)))
+	binary.LittleEndian.PutUint32(body[16:], packet.origLen)
+	return p.writeBlock(6, append(body, packet.data...))
+}
+
+// mergePcaps merges classic pcap files into one time-ordered pcapng file,
+// keeping the original timestamps and recording which interface each packet
+// came from
+func mergePcaps(files, interfaces []string, output string) error {
+	readers := make([]*pcapReader, len(files))
+	heads := make([]*pcapPacket, len(files))
+	for i, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if readers[i], err = newPcapReader(file); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if readers[i].ng {
+			return fmt.Errorf("%s: already a pcapng file", name)
+		}
+		if heads[i], err = readers[i].next(); err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	writer := &pcapngWriter{w: bufio.NewWriter(out)}
+	if err := writer.writeSectionHeader(); err != nil {
+		return err
+	}
+	for i, reader := range readers {
+		if err := writer.writeInterface(interfaces[i], reader.linkType, reader.snapLen); err != nil {
+			return err
+		}
+	}
+
+	for {
+		oldest := -1
+		for i, head := range heads {
+			if head != nil && (oldest < 0 || head.timestamp < heads[oldest].timestamp) {
+				oldest = i
+			}
+		}
+		if oldest < 0 {
+			break
+		}
+		if err := writer.writePacket(oldest, heads[oldest]); err != nil {
+			return err
+		}
+		if heads[oldest], err = readers[oldest].next(); err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %v", files[oldest], err)
+		}
+	}
+	return writer.w.Flush()
+}
@@ -0,0 +1,69 @@
+package netmon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PreviewPackets shows the first count packets matching c.TcpdumpFilter as
+// tcpdump prints them, without writing a file, to check the filter before a
+// capture. The packets are written to c.Output as they arrive and returned.
+// It gives up after window, so a filter matching nothing returns no packets
+// and no error. Several interfaces, or an interface pattern matching several,
+// are previewed together on any.
+func PreviewPackets(ctx context.Context, c Config, count int, window time.Duration) ([]string, error) {
+	c = c.withDefaults()
+	if err := c.checkDirection(); err != nil {
+		return nil, err
+	}
+	if err := CheckCapturePrivileges(); err != nil {
+		return nil, err
+	}
+	interfaces, err := c.captureInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	iface := "any"
+	if len(interfaces) == 1 {
+		iface = interfaces[0]
+	}
+	filter := c.captureFilters(ctx, []string{iface})[iface]
+
+	ctx, cancel := context.WithTimeout(ctx, window)
+	defer cancel()
+	args := append([]string{"-i", iface, "-nn", "-l", "-c", strconv.Itoa(count)}, c.bufferArgs()...)
+	cmd := c.tcpdump(context.Background(), append(args, filter)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, captureError(fmt.Errorf("creating stdout pipe: %v", err))
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, captureError(fmt.Errorf("starting: %v", err))
+	}
+	go func() {
+		<-ctx.Done()
+		cmd.Process.Signal(os.Interrupt)
+	}()
+
+	var packets []string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		packets = append(packets, scanner.Text())
+		fmt.Fprintf(c.Output, "  %s\n", scanner.Text())
+	}
+	err = cmd.Wait()
+	// tcpdump exits nonzero when interrupted, so only its own complaints
+	// without statistics count as a failure
+	if err != nil && !strings.Contains(stderr.String(), "packets captured") {
+		return packets, captureError(fmt.Errorf("%v: %s", err, firstLine(strings.TrimSpace(stderr.String()))))
+	}
+	return packets, nil
+}
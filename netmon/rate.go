@@ -0,0 +1,108 @@
+package netmon
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+)
+
+var (
+	packetsDroppedRegex  = regexp.MustCompile(`(\d+) packets? dropped by kernel`)
+	packetsReceivedRegex = regexp.MustCompile(`(\d+) packets? received by filter`)
+)
+
+// droppedPackets returns the packets tcpdump reported as dropped by the
+// kernel in its closing statistics, which it only prints when stopped with
+// SIGINT or SIGTERM
+func droppedPackets(stderr string) int {
+	return statisticsCount(packetsDroppedRegex, stderr)
+}
+
+// receivedPackets returns the packets tcpdump reported as received by its
+// filter in its closing statistics
+func receivedPackets(stderr string) int {
+	return statisticsCount(packetsReceivedRegex, stderr)
+}
+
+// statisticsCount returns the count of a closing statistics line, 0 when
+// tcpdump did not print it
+func statisticsCount(re *regexp.Regexp, stderr string) int {
+	m := re.FindStringSubmatch(stderr)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+// peakRate returns the highest packet count of the per-second bins
+func peakRate(bins map[int64]int) int {
+	peak := 0
+	for _, count := range bins {
+		if count > peak {
+			peak = count
+		}
+	}
+	return peak
+}
+
+// filePeakRate returns the busiest second of a capture file in packets per
+// second, or 0 when the file cannot be read
+func filePeakRate(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	reader, err := newPcapReader(file)
+	if err != nil {
+		return 0
+	}
+	bins := map[int64]int{}
+	for {
+		packet, err := reader.next()
+		if err != nil {
+			break
+		}
+		bins[packet.timestamp/1e9]++
+	}
+	return peakRate(bins)
+}
+
+// filePackets returns the number of complete packets in a capture file,
+// which may still be written
+func filePackets(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	reader, err := newPcapReader(file)
+	if err != nil {
+		return 0
+	}
+	packets := 0
+	for {
+		if _, err := reader.next(); err != nil {
+			return packets
+		}
+		packets++
+	}
+}
+
+// lineSecond returns the second of day of a tcpdump line from its leading
+// HH:MM:SS timestamp
+func lineSecond(line string) (int64, bool) {
+	if len(line) < 8 || line[2] != ':' || line[5] != ':' {
+		return 0, false
+	}
+	var second int64
+	for _, part := range []string{line[0:2], line[3:5], line[6:8]} {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, false
+		}
+		second = second*60 + int64(n)
+	}
+	return second, true
+}
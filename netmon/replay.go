@@ -0,0 +1,114 @@
+package netmon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// Link types of the capture files written by tcpdump that ReplayPcap decodes
+const (
+	linkTypeEthernet  = 1
+	linkTypeRaw       = 101
+	linkTypeLinuxSLL  = 113
+	linkTypeLinuxSLL2 = 276
+)
+
+// ReplayPcap runs the IP and flow analysis of SampleIPs over a saved capture
+// file instead of live traffic. Only IPv4 packets are counted, like in the
+// live sample; the file is classic pcap as written by tcpdump -w, or pcapng
+// such as the merged capture of -merge.
+func ReplayPcap(path string) (Sample, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Sample{}, err
+	}
+	defer file.Close()
+	reader, err := newPcapReader(file)
+	if err != nil {
+		return Sample{}, fmt.Errorf("%s: %v", path, err)
+	}
+
+	sample := Sample{Counts: IPSample{}, Flows: map[Flow]int{}, bins: map[int64]int{}}
+	for {
+		packet, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Sample{}, fmt.Errorf("%s: %v", path, err)
+		}
+		src, dst, flow, ok := decodeIPv4(packet.linkType, packet.data)
+		if !ok {
+			continue
+		}
+		sample.bins[packet.timestamp/1e9]++
+		sample.Counts[src]++
+		if dst != src {
+			sample.Counts[dst]++
+		}
+		if flow.Proto != "" {
+			sample.Flows[flow]++
+		}
+	}
+	sample.PeakPPS = peakRate(sample.bins)
+	return sample, nil
+}
+
+// decodeIPv4 returns the addresses of an IPv4 packet and, for TCP and UDP,
+// its flow. Proto is empty for other protocols and for fragments without
+// the transport header.
+func decodeIPv4(linkType uint32, data []byte) (src, dst string, flow Flow, ok bool) {
+	offset := 0
+	switch linkType {
+	case linkTypeEthernet:
+		offset = 14
+		for offset <= len(data) && binary.BigEndian.Uint16(data[offset-2:]) == 0x8100 {
+			offset += 4 // VLAN tag
+		}
+		if offset > len(data) || binary.BigEndian.Uint16(data[offset-2:]) != 0x0800 {
+			return "", "", Flow{}, false
+		}
+	case linkTypeLinuxSLL:
+		offset = 16
+		if len(data) < offset || binary.BigEndian.Uint16(data[14:]) != 0x0800 {
+			return "", "", Flow{}, false
+		}
+	case linkTypeLinuxSLL2:
+		offset = 20
+		if len(data) < offset || binary.BigEndian.Uint16(data[0:]) != 0x0800 {
+			return "", "", Flow{}, false
+		}
+	case linkTypeRaw:
+	default:
+		return "", "", Flow{}, false
+	}
+
+	ip := data[offset:]
+	if len(ip) < 20 || ip[0]>>4 != 4 {
+		return "", "", Flow{}, false
+	}
+	headerLen := int(ip[0]&0x0f) * 4
+	src, dst = net.IP(ip[12:16]).String(), net.IP(ip[16:20]).String()
+	fragmentOffset := binary.BigEndian.Uint16(ip[6:]) & 0x1fff
+	if headerLen < 20 || len(ip) < headerLen+4 || fragmentOffset != 0 {
+		return src, dst, Flow{}, true
+	}
+	transport := ip[headerLen:]
+
+	flow = Flow{
+		SrcIP: src, SrcPort: int(binary.BigEndian.Uint16(transport[0:])),
+		DstIP: dst, DstPort: int(binary.BigEndian.Uint16(transport[2:])),
+	}
+	switch ip[9] {
+	case 6:
+		flow.Proto = "tcp"
+	case 17:
+		flow.Proto = "udp"
+	default:
+		return src, dst, Flow{}, true
+	}
+	return src, dst, flow, true
+}
@@ -0,0 +1,140 @@
+package netmon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ErrMetricsUnavailable is the cause of PodUsage failing because the
+// cluster has no metrics API, which metrics-server provides
+var ErrMetricsUnavailable = errors.New("metrics API not available, is metrics-server installed? (k3s bundles it unless started with --disable metrics-server)")
+
+// ContainerUsage is the resource usage of a container as kubectl top reports
+// it, or its limits, 0 meaning unlimited
+type ContainerUsage struct {
+	Container string `json:"container"`
+	// CPU is in millicores
+	CPU int64 `json:"cpu"`
+	// Memory is in bytes
+	Memory int64 `json:"memory"`
+}
+
+// PodUsage returns the current CPU and memory usage of each container of pod
+func PodUsage(ctx context.Context, pod string) ([]ContainerUsage, error) {
+	args := []string{"top", "pod", pod, "--containers", "--no-headers"}
+	out, err := runKubectl(ctx, args...)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && strings.Contains(string(exitErr.Stderr), "Metrics API not available") {
+		return nil, kubectlError(args, ErrMetricsUnavailable)
+	}
+	if err != nil {
+		return nil, kubectlError(args, err)
+	}
+	return parseTopContainers(string(out))
+}
+
+// parseTopContainers parses kubectl top pod --containers --no-headers
+// output, "POD CONTAINER CPU MEMORY" per line, e.g.
+// "collector-x2kqp collector 12m 34Mi"
+func parseTopContainers(out string) ([]ContainerUsage, error) {
+	var usage []ContainerUsage
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected kubectl top line %q", line)
+		}
+		cpu, err := parseCPUQuantity(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		memory, err := parseMemoryQuantity(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, ContainerUsage{Container: fields[1], CPU: cpu, Memory: memory})
+	}
+	return usage, nil
+}
+
+// PodLimits returns the CPU and memory limits of each container of pod
+func PodLimits(ctx context.Context, pod string) ([]ContainerUsage, error) {
+	args := []string{"get", "pod", pod, "-o", "json"}
+	out, err := runKubectl(ctx, args...)
+	if err != nil {
+		return nil, kubectlError(args, err)
+	}
+	var p Pod
+	if err := json.Unmarshal(out, &p); err != nil {
+		return nil, kubectlError(args, fmt.Errorf("parsing pod: %v", err))
+	}
+	var limits []ContainerUsage
+	for _, container := range p.Spec.Containers {
+		limit := ContainerUsage{Container: container.Name}
+		if cpu, ok := container.Resources.Limits["cpu"]; ok {
+			if limit.CPU, err = parseCPUQuantity(cpu); err != nil {
+				return nil, err
+			}
+		}
+		if memory, ok := container.Resources.Limits["memory"]; ok {
+			if limit.Memory, err = parseMemoryQuantity(memory); err != nil {
+				return nil, err
+			}
+		}
+		limits = append(limits, limit)
+	}
+	return limits, nil
+}
+
+// parseCPUQuantity converts a Kubernetes CPU quantity such as 250m, 0.5 or
+// 2 to millicores
+func parseCPUQuantity(s string) (int64, error) {
+	for suffix, perMilli := range map[string]float64{"n": 1e6, "u": 1e3, "m": 1} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid CPU quantity %q", s)
+			}
+			return int64(n / perMilli), nil
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid CPU quantity %q", s)
+	}
+	return int64(n * 1000), nil
+}
+
+// memorySuffixes are the multipliers of Kubernetes memory quantities
+var memorySuffixes = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+	{"k", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+}
+
+// parseMemoryQuantity converts a Kubernetes memory quantity such as 128Mi,
+// 1G or 134217728 to bytes
+func parseMemoryQuantity(s string) (int64, error) {
+	multiplier := 1.0
+	number := s
+	for _, m := range memorySuffixes {
+		if strings.HasSuffix(s, m.suffix) {
+			multiplier, number = m.multiplier, strings.TrimSuffix(s, m.suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory quantity %q", s)
+	}
+	return int64(n * multiplier), nil
+}
@@ -0,0 +1,121 @@
+package netmon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RestartTarget is what gets restarted to replace a pod
+type RestartTarget struct {
+	// Kind is "deployment" for pods managed by a deployment, which are
+	// replaced with a rollout restart, or "pod" for pods of other
+	// controllers, which are deleted so that their controller recreates them
+	Kind string
+	Name string
+	// owner is the controller of the replacement pods: the pod's own for
+	// Kind "pod", unset for deployments, whose pods come from a new
+	// ReplicaSet
+	owner ownerReference
+}
+
+func (t RestartTarget) String() string {
+	return t.Kind + "/" + t.Name
+}
+
+// FindRestartTarget decides how pod is restarted. Pods without a controller
+// are rejected since deleting them would not bring them back.
+func FindRestartTarget(ctx context.Context, pod Pod) (RestartTarget, error) {
+	if len(pod.Metadata.OwnerReferences) == 0 {
+		return RestartTarget{}, configError("pod %s has no controller, deleting it would not reschedule it", pod.Metadata.Name)
+	}
+	owner := pod.Metadata.OwnerReferences[0]
+	target := RestartTarget{Kind: "pod", Name: pod.Metadata.Name, owner: owner}
+	if owner.Kind != "ReplicaSet" {
+		return target, nil
+	}
+
+	args := []string{"get", "replicaset", owner.Name, "-o", `jsonpath={.metadata.ownerReferences[?(@.kind=="Deployment")].name}`}
+	out, err := runKubectl(ctx, args...)
+	if err != nil {
+		return RestartTarget{}, kubectlError(args, err)
+	}
+	if deployment := strings.TrimSpace(string(out)); deployment != "" {
+		return RestartTarget{Kind: "deployment", Name: deployment}, nil
+	}
+	return target, nil
+}
+
+// Restart rolls out a deployment again or deletes a pod
+func (t RestartTarget) Restart(ctx context.Context) error {
+	args := []string{"delete", "pod", t.Name, "--wait=false"}
+	if t.Kind == "deployment" {
+		args = []string{"rollout", "restart", "deployment/" + t.Name}
+	}
+	if _, err := runKubectl(ctx, args...); err != nil {
+		return kubectlError(args, err)
+	}
+	return nil
+}
+
+// matches reports whether pod is one of the pods the target manages. The
+// pods of a deployment belong to a ReplicaSet named <deployment>-<hash>, so
+// deployment "flow" does not match the pods of "flow-collector".
+func (t RestartTarget) matches(pod Pod) bool {
+	for _, owner := range pod.Metadata.OwnerReferences {
+		if t.Kind != "deployment" {
+			if owner == t.owner {
+				return true
+			}
+			continue
+		}
+		hash := strings.TrimPrefix(owner.Name, t.Name+"-")
+		if owner.Kind == "ReplicaSet" && hash != owner.Name && hash != "" && !strings.Contains(hash, "-") {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitForReplacement polls until a pod of the target that is not one of old
+// is Running with all containers ready, and returns its name. It gives up
+// after c.WaitTimeout (default 5m) or when ctx is canceled.
+func WaitForReplacement(ctx context.Context, c Config, t RestartTarget, old []Pod) (string, error) {
+	c = c.withDefaults()
+	oldUIDs := map[string]bool{}
+	for _, pod := range old {
+		oldUIDs[pod.Metadata.UID] = true
+	}
+	deadline := time.Now().Add(c.WaitTimeout)
+	startTime := time.Now()
+
+	for {
+		pods, err := ListPods(ctx)
+		if err != nil {
+			c.ClearStatusLine()
+			return "", err
+		}
+		for _, pod := range pods {
+			if t.matches(pod) && !oldUIDs[pod.Metadata.UID] && pod.isReady() {
+				c.ClearStatusLine()
+				return pod.Metadata.Name, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			c.ClearStatusLine()
+			return "", fmt.Errorf("no new pod of %s became ready within %s", t, c.WaitTimeout)
+		}
+		if c.Interactive {
+			fmt.Fprintf(c.Output, "\r\033[KWaiting for a new pod of %s [%s]", t, time.Since(startTime).Round(time.Second))
+		}
+
+		select {
+		case <-ctx.Done():
+			c.ClearStatusLine()
+			return "", ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package netmon
+
+import "io"
+
+// terminalWidth reports no terminal where TIOCGWINSZ is not available, so
+// progress bars keep their default width
+func terminalWidth(w io.Writer) int {
+	return 0
+}
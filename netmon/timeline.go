@@ -0,0 +1,162 @@
+package netmon
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Timeline event sources
+const (
+	SourcePacket = "packet"
+	SourceLog    = "log"
+)
+
+// TimelineEvent is a packet or a log line placed on a timeline
+type TimelineEvent struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Text   string    `json:"text"`
+	// Match marks the log lines the timeline was built around
+	Match bool `json:"match,omitempty"`
+}
+
+// PcapEvents returns the packets of a capture file as timeline events, each
+// described by its flow or, for other IPv4 protocols, its addresses
+func PcapEvents(path string) ([]TimelineEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := newPcapReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	var events []TimelineEvent
+	for {
+		packet, err := reader.next()
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		text := fmt.Sprintf("%d bytes", packet.origLen)
+		if src, dst, flow, ok := decodeIPv4(packet.linkType, packet.data); ok && flow.Proto != "" {
+			text = fmt.Sprintf("%s, %s", flow, text)
+		} else if ok {
+			text = fmt.Sprintf("%s > %s, %s", src, dst, text)
+		}
+		events = append(events, TimelineEvent{Time: time.Unix(0, packet.timestamp).UTC(), Source: SourcePacket, Text: text})
+	}
+}
+
+// logTimeLayouts are the timestamps recognized at the start of a log line,
+// longest first. Timestamps without a zone are taken as UTC.
+var logTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006/01/02 15:04:05.999999999",
+}
+
+// klogTime matches the header of klog lines, e.g. "I0501 14:03:40.123456",
+// which has no year
+var klogTime = regexp.MustCompile(`^[IWEF](\d{4} \d{2}:\d{2}:\d{2}\.\d+)`)
+
+// ParseLogTime parses the timestamp a log line starts with: RFC 3339 as
+// written by kubectl logs --timestamps, "2006-01-02 15:04:05" and
+// "2006/01/02 15:04:05" with optional fractions, and klog headers, which
+// lack a year and get year
+func ParseLogTime(line string, year int) (time.Time, bool) {
+	if m := klogTime.FindStringSubmatch(line); m != nil {
+		t, err := time.Parse("0102 15:04:05.999999999", m[1])
+		if err != nil {
+			return time.Time{}, false
+		}
+		return t.AddDate(year-t.Year(), 0, 0), true
+	}
+	// the timestamp is the first one or two words, e.g. "2024-05-01 14:03:40,123"
+	words := strings.Fields(strings.Replace(line, ",", ".", 1))
+	for n := 2; n >= 1; n-- {
+		if len(words) < n {
+			continue
+		}
+		prefix := strings.Trim(strings.Join(words[:n], " "), "[]")
+		for _, layout := range logTimeLayouts {
+			if t, err := time.Parse(layout, prefix); err == nil {
+				return t.UTC(), true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// LogEvents returns the lines of a log file as timeline events. Lines
+// without a timestamp, such as the rest of a stack trace, take the time of
+// the line before them; those before the first timestamp are skipped.
+// year completes timestamps without one.
+func LogEvents(path string, year int) ([]TimelineEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []TimelineEvent
+	var last time.Time
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if t, ok := ParseLogTime(line, year); ok {
+			last = t
+		}
+		if last.IsZero() || strings.TrimSpace(line) == "" {
+			continue
+		}
+		events = append(events, TimelineEvent{Time: last, Source: SourceLog, Text: line})
+	}
+	return events, scanner.Err()
+}
+
+// Timeline interleaves packets and log lines by time, keeping only the
+// events within window of a log line matching match. With match nil every
+// event is kept. Events at the same time keep log lines before packets.
+func Timeline(packets, logs []TimelineEvent, match *regexp.Regexp, window time.Duration) []TimelineEvent {
+	var anchors []time.Time
+	for i := range logs {
+		if match != nil && match.MatchString(logs[i].Text) {
+			logs[i].Match = true
+			anchors = append(anchors, logs[i].Time)
+		}
+	}
+
+	events := make([]TimelineEvent, 0, len(packets)+len(logs))
+	events = append(events, logs...)
+	events = append(events, packets...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	if match == nil {
+		return events
+	}
+
+	// anchors are in log order, which is nearly chronological; sort them
+	// so each event is checked against its nearest anchors only
+	sort.Slice(anchors, func(i, j int) bool { return anchors[i].Before(anchors[j]) })
+	var kept []TimelineEvent
+	for _, event := range events {
+		i := sort.Search(len(anchors), func(i int) bool { return !anchors[i].Before(event.Time.Add(-window)) })
+		if i < len(anchors) && !anchors[i].After(event.Time.Add(window)) {
+			kept = append(kept, event)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,143 @@
+package netmon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// workloadKinds maps the workload kinds accepted by ParseWorkload, with
+// kubectl's plural and short names, to their resource name
+var workloadKinds = map[string]string{
+	"daemonset": "daemonset", "daemonsets": "daemonset", "ds": "daemonset",
+	"statefulset": "statefulset", "statefulsets": "statefulset", "sts": "statefulset",
+	"deployment": "deployment", "deployments": "deployment", "deploy": "deployment",
+}
+
+// Workload is a controller whose pods are checked as a group
+type Workload struct {
+	// Kind is daemonset, statefulset or deployment
+	Kind string
+	Name string
+}
+
+func (w Workload) String() string {
+	return w.Kind + "/" + w.Name
+}
+
+// ParseWorkload parses a kubectl-style kind/name such as daemonset/collector
+// or ds/collector
+func ParseWorkload(s string) (Workload, error) {
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return Workload{}, configError("workload %q is not kind/name, e.g. daemonset/%s", s, s)
+	}
+	kind, ok := workloadKinds[strings.ToLower(s[:i])]
+	if !ok {
+		return Workload{}, configError("workload %q has unknown kind %q (want daemonset, statefulset or deployment)", s, s[:i])
+	}
+	name := s[i+1:]
+	if name == "" || strings.Contains(name, "/") {
+		return Workload{}, configError("workload %q has no valid name after %s/", s, s[:i])
+	}
+	return Workload{Kind: kind, Name: name}, nil
+}
+
+// labelSelector is the spec.selector of a workload
+type labelSelector struct {
+	MatchLabels      map[string]string `json:"matchLabels"`
+	MatchExpressions []struct {
+		Key      string   `json:"key"`
+		Operator string   `json:"operator"`
+		Values   []string `json:"values"`
+	} `json:"matchExpressions"`
+}
+
+// String returns the selector in kubectl's -l syntax, e.g.
+// "app=collector,tier in (edge,core)"
+func (s labelSelector) String() string {
+	keys := make([]string, 0, len(s.MatchLabels))
+	for key := range s.MatchLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var terms []string
+	for _, key := range keys {
+		terms = append(terms, key+"="+s.MatchLabels[key])
+	}
+	for _, expr := range s.MatchExpressions {
+		switch expr.Operator {
+		case "In":
+			terms = append(terms, fmt.Sprintf("%s in (%s)", expr.Key, strings.Join(expr.Values, ",")))
+		case "NotIn":
+			terms = append(terms, fmt.Sprintf("%s notin (%s)", expr.Key, strings.Join(expr.Values, ",")))
+		case "Exists":
+			terms = append(terms, expr.Key)
+		case "DoesNotExist":
+			terms = append(terms, "!"+expr.Key)
+		}
+	}
+	return strings.Join(terms, ",")
+}
+
+// Selector returns the label selector of the workload's pods
+func (w Workload) Selector(ctx context.Context) (string, error) {
+	args := []string{"get", w.Kind, w.Name, "-o", "jsonpath={.spec.selector}"}
+	out, err := runKubectl(ctx, args...)
+	if err != nil {
+		return "", kubectlError(args, err)
+	}
+	var selector labelSelector
+	if err := json.Unmarshal(out, &selector); err != nil {
+		return "", kubectlError(args, fmt.Errorf("parsing selector: %v", err))
+	}
+	if s := selector.String(); s != "" {
+		return s, nil
+	}
+	return "", kubectlError(args, fmt.Errorf("%s has an empty selector", w))
+}
+
+// CheckWorkload reports how many pods of w are ready, e.g. "5/6 pods
+// ready", followed by an entry for each of its pods. Not all pods being
+// ready fails the check, unless some are, which only warns. A pod that is
+// not ready only warns, since the aggregate accounts for it.
+func CheckWorkload(ctx context.Context, w Workload) []StatusEntry {
+	entry := StatusEntry{Resource: w.String(), Type: "workload"}
+	selector, err := w.Selector(ctx)
+	if err != nil {
+		entry.Status = "error"
+		entry.Detail = err.Error()
+		return []StatusEntry{entry}
+	}
+	pods, err := ListPodsMatching(ctx, selector)
+	if err != nil {
+		entry.Status = "error"
+		entry.Detail = err.Error()
+		return []StatusEntry{entry}
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Metadata.Name < pods[j].Metadata.Name })
+
+	entries := []StatusEntry{entry}
+	ready := 0
+	for _, pod := range pods {
+		readyContainers, total := pod.readyContainers()
+		podEntry := StatusEntry{Resource: pod.Metadata.Name, Type: "pod", Status: pod.Status.Phase, Healthy: pod.isReady(),
+			Detail: fmt.Sprintf("%d/%d containers ready", readyContainers, total)}
+		if pod.Spec.NodeName != "" {
+			podEntry.Detail += " on " + pod.Spec.NodeName
+		}
+		if podEntry.Healthy {
+			ready++
+		} else {
+			podEntry.Warning = true
+		}
+		entries = append(entries, podEntry)
+	}
+	entries[0].Status = fmt.Sprintf("%d/%d pods ready", ready, len(pods))
+	entries[0].Healthy = len(pods) > 0 && ready == len(pods)
+	entries[0].Warning = ready > 0 && ready < len(pods)
+	entries[0].Detail = "selector " + selector
+	return entries
+}